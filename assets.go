@@ -83,7 +83,7 @@ func InitializeV2Ray(internalAssets string, externalAssets string, prefix string
 
 		err = extractAssetName(fileName, false)
 		if err != nil {
-			return nil, err
+			return nil, assetMissing(fileName, err)
 		}
 
 		for _, path = range paths {
@@ -96,7 +96,7 @@ func InitializeV2Ray(internalAssets string, externalAssets string, prefix string
 			}
 		}
 
-		return nil, err
+		return nil, assetMissing(fileName, err)
 	}
 
 	filesystem.NewFileReader = func(path string) (io.ReadCloser, error) {
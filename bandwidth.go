@@ -0,0 +1,174 @@
+package libcore
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+)
+
+const maxRateLimitSleep = 100 * time.Millisecond
+
+// tokenBucket allows rate bytes per second with a burst of one second. Takes
+// larger than the available tokens go into debt, which later takes wait for.
+type tokenBucket struct {
+	rate   int64
+	access sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	b.access.Lock()
+	defer b.access.Unlock()
+	if atomic.LoadInt64(&b.rate) == 0 {
+		b.tokens = float64(rate)
+	} else if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = time.Now()
+	atomic.StoreInt64(&b.rate, rate)
+}
+
+func (b *tokenBucket) refill(rate int64) {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) take(n int64) {
+	if atomic.LoadInt64(&b.rate) == 0 {
+		return
+	}
+	b.access.Lock()
+	if rate := atomic.LoadInt64(&b.rate); rate > 0 {
+		b.refill(rate)
+		b.tokens -= float64(n)
+	}
+	b.access.Unlock()
+	// Sleep in slices so a changed limit applies to waiting flows.
+	for {
+		b.access.Lock()
+		rate := atomic.LoadInt64(&b.rate)
+		if rate == 0 {
+			b.access.Unlock()
+			return
+		}
+		b.refill(rate)
+		if b.tokens >= 0 {
+			b.access.Unlock()
+			return
+		}
+		wait := time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+		b.access.Unlock()
+		if wait > maxRateLimitSleep {
+			wait = maxRateLimitSleep
+		}
+		time.Sleep(wait)
+	}
+}
+
+type bandwidthLimit struct {
+	upload   tokenBucket
+	download tokenBucket
+}
+
+// rateLimitCounter waits on the limit of uid and the global one when bytes
+// are added, so it can shape a StatCounterConn. The limit of uid is looked up
+// each time, so changes apply to open connections.
+type rateLimitCounter struct {
+	t        *Tun2ray
+	uid      uint16
+	download bool
+}
+
+func (c rateLimitCounter) Value() int64 {
+	return 0
+}
+
+func (c rateLimitCounter) Set(int64) int64 {
+	return 0
+}
+
+func (c rateLimitCounter) Add(n int64) int64 {
+	if limit, loaded := c.t.appLimits.Load(c.uid); loaded {
+		c.bucket(limit.(*bandwidthLimit)).take(n)
+	}
+	c.bucket(&c.t.globalLimit).take(n)
+	return 0
+}
+
+func (c rateLimitCounter) bucket(limit *bandwidthLimit) *tokenBucket {
+	if c.download {
+		return &limit.download
+	}
+	return &limit.upload
+}
+
+// SetBandwidthLimit limits uid, or all traffic if uid is negative, to upload
+// and download bytes per second. Zero removes the limit. It applies to open
+// connections too.
+func (t *Tun2ray) SetBandwidthLimit(uid int32, upload int64, download int64) error {
+	limit := &t.globalLimit
+	if uid >= 0 {
+		if !t.dumpUid && !t.trafficStats {
+			return newError("per-app bandwidth limit requires uid dump or traffic stats")
+		}
+		if upload <= 0 && download <= 0 {
+			if limit, loaded := t.appLimits.LoadAndDelete(uint16(uid)); loaded {
+				limit.(*bandwidthLimit).upload.setRate(0)
+				limit.(*bandwidthLimit).download.setRate(0)
+			}
+			return nil
+		}
+		value, _ := t.appLimits.LoadOrStore(uint16(uid), new(bandwidthLimit))
+		limit = value.(*bandwidthLimit)
+	}
+	limit.upload.setRate(upload)
+	limit.download.setRate(download)
+	return nil
+}
+
+func (t *Tun2ray) newLimitedConn(conn net.Conn, uid uint16) net.Conn {
+	limitedConn := new(internet.StatCounterConn)
+	limitedConn.Connection = conn
+	limitedConn.ReadCounter = rateLimitCounter{t, uid, false}
+	limitedConn.WriteCounter = rateLimitCounter{t, uid, true}
+	return limitedConn
+}
+
+func (t *Tun2ray) newLimitedPacketConn(conn packetConn, uid uint16) packetConn {
+	return limitedPacketConn{
+		packetConn: conn,
+		upload:     rateLimitCounter{t, uid, false},
+		download:   rateLimitCounter{t, uid, true},
+	}
+}
+
+type limitedPacketConn struct {
+	packetConn
+	upload   rateLimitCounter
+	download rateLimitCounter
+}
+
+func (c limitedPacketConn) readFrom() (buffer *buf.Buffer, addr net.Addr, err error) {
+	buffer, addr, err = c.packetConn.readFrom()
+	if err == nil {
+		c.download.Add(int64(buffer.Len()))
+	}
+	return
+}
+
+func (c limitedPacketConn) writeTo(buffer *buf.Buffer, addr net.Addr) (err error) {
+	c.upload.Add(int64(buffer.Len()))
+	return c.packetConn.writeTo(buffer, addr)
+}
@@ -0,0 +1,106 @@
+package libcore
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun/tuntest"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var bucket tokenBucket
+	bucket.take(1 << 30)
+
+	bucket.setRate(1 << 20)
+	start := time.Now()
+	bucket.take(1 << 20)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("burst waited %s", elapsed)
+	}
+	bucket.take(256 << 10)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("unexpected wait %s for a quarter second of debt", elapsed)
+	}
+
+	// Removing the limit releases waiting flows.
+	bucket.setRate(1 << 10)
+	done := make(chan struct{})
+	go func() {
+		bucket.take(64 << 10)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	bucket.setRate(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("take still waiting after the limit was removed")
+	}
+}
+
+func TestTun2rayBandwidthLimit(t *testing.T) {
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationSystem)
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	destination := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+	payload := bytes.Repeat([]byte{1}, 1000)
+	exchange := func(count int) time.Duration {
+		start := time.Now()
+		for i := 0; i < count; i++ {
+			err := device.Write(tuntest.UDPPacket(source, destination, payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+				return packet.Protocol == header.UDPProtocolNumber
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return time.Since(start)
+	}
+
+	if elapsed := exchange(5); elapsed > 200*time.Millisecond {
+		t.Fatalf("unlimited exchange took %s", elapsed)
+	}
+	// The one second burst covers four replies, the fifth waits a quarter second.
+	tun.SetBandwidthLimit(-1, 0, 4000)
+	if elapsed := exchange(5); elapsed < 200*time.Millisecond {
+		t.Fatalf("limited exchange took %s", elapsed)
+	}
+	tun.SetBandwidthLimit(-1, 0, 0)
+	if elapsed := exchange(5); elapsed > 200*time.Millisecond {
+		t.Fatalf("exchange took %s after the limit was removed", elapsed)
+	}
+}
+
+func TestTun2rayAppBandwidthLimit(t *testing.T) {
+	tun, _, _ := newTestTun2ray(t, comm.TunImplementationSystem)
+	if err := tun.SetBandwidthLimit(10000, 0, 4000); err == nil {
+		t.Fatal("per-app limit accepted without uid lookup")
+	}
+
+	tun, _, _ = newTestTun2ray(t, comm.TunImplementationSystem, func(config *TunConfig) {
+		config.TrafficStats = true
+	})
+	err := tun.SetBandwidthLimit(10000, 0, 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Connections of other uids don't add limits.
+	tun.newLimitedConn(nil, 10001)
+	if _, loaded := tun.appLimits.Load(uint16(10001)); loaded {
+		t.Fatal("limit created for an unlimited uid")
+	}
+	err = tun.SetBandwidthLimit(10000, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, loaded := tun.appLimits.Load(uint16(10000)); loaded {
+		t.Fatal("removed limit kept")
+	}
+}
@@ -0,0 +1,21 @@
+package comm
+
+const (
+	EventSeverityInfo = iota
+	EventSeverityWarning
+	EventSeverityError
+)
+
+const (
+	// EventError is a fatal error of the core, like a plugin exiting.
+	EventError = iota
+	// EventTunStopped is a stack no longer reading the device.
+	EventTunStopped
+	// EventOutboundFailure is a connection failing in its outbound before
+	// anything came back.
+	EventOutboundFailure
+	EventDNSFailure
+	EventAssetMissing
+	EventProtectFailed
+	EventConnectionLimit
+)
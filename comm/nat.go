@@ -0,0 +1,7 @@
+package comm
+
+const (
+	UDPNATEndpointIndependent = iota
+	UDPNATAddressDependent
+	UDPNATSymmetric
+)
@@ -0,0 +1,125 @@
+package libcore
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"libcore/comm"
+)
+
+type Connection struct {
+	Id          int64
+	Network     string
+	Source      string
+	Destination string
+	Domain      string
+	Protocol    string
+	Outbound    string
+	Uid         int32
+	Start       int64
+
+	Uplink   int64
+	Downlink int64
+}
+
+type ConnectionIterator interface {
+	HasNext() bool
+	Next() *Connection
+}
+
+type trackedConnection struct {
+	uplink   uint64
+	downlink uint64
+
+	id          uint32
+	source      v2rayNet.Destination
+	destination v2rayNet.Destination
+	domain      string
+	protocol    string
+	outbound    string
+	uid         uint32
+	start       time.Time
+	closer      io.Closer
+}
+
+func (c *trackedConnection) export() *Connection {
+	return &Connection{
+		Id:          int64(c.id),
+		Network:     c.destination.Network.SystemString(),
+		Source:      c.source.NetAddr(),
+		Destination: c.destination.NetAddr(),
+		Domain:      c.domain,
+		Protocol:    c.protocol,
+		Outbound:    c.outbound,
+		Uid:         int32(c.uid),
+		Start:       c.start.UnixMilli(),
+		Uplink:      int64(atomic.LoadUint64(&c.uplink)),
+		Downlink:    int64(atomic.LoadUint64(&c.downlink)),
+	}
+}
+
+type connectionTable struct {
+	index       uint32
+	connections sync.Map
+}
+
+func (t *connectionTable) add(connection *trackedConnection) {
+	connection.id = atomic.AddUint32(&t.index, 1)
+	connection.start = time.Now()
+	t.connections.Store(connection.id, connection)
+}
+
+func (t *connectionTable) remove(connection *trackedConnection) {
+	t.connections.Delete(connection.id)
+}
+
+func (t *connectionTable) list() []*trackedConnection {
+	var connections []*trackedConnection
+	t.connections.Range(func(key, value interface{}) bool {
+		connections = append(connections, value.(*trackedConnection))
+		return true
+	})
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].id < connections[j].id
+	})
+	return connections
+}
+
+type connectionIterator struct {
+	connections []*trackedConnection
+}
+
+func (i *connectionIterator) HasNext() bool {
+	return len(i.connections) > 0
+}
+
+func (i *connectionIterator) Next() *Connection {
+	if len(i.connections) == 0 {
+		return nil
+	}
+	connection := i.connections[0]
+	i.connections = i.connections[1:]
+	return connection.export()
+}
+
+func (t *Tun2ray) GetConnections() ConnectionIterator {
+	return &connectionIterator{t.connections.list()}
+}
+
+func (t *Tun2ray) CloseConnection(id int64) {
+	if connection, loaded := t.connections.connections.Load(uint32(id)); loaded {
+		comm.CloseIgnore(connection.(*trackedConnection).closer)
+	}
+}
+
+func (t *Tun2ray) CloseConnections(uid int32) {
+	for _, connection := range t.connections.list() {
+		if connection.uid == uint32(uid) {
+			comm.CloseIgnore(connection.closer)
+		}
+	}
+}
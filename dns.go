@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/netip"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/v2fly/v2ray-core/v5/common"
@@ -85,8 +86,9 @@ func (l *localTransport) ExchangeRaw(ctx context.Context, message *buf.Buffer) (
 	query := &QueryContext{
 		ctx: ctx,
 	}
+	pending := traceDNSQuery(ctx, message.Bytes(), "local")
 	var response *buf.Buffer
-	return response, task.Run(ctx, func() error {
+	err := task.Run(ctx, func() error {
 		err := l.r.QueryRaw(query, message.Bytes())
 		if err != nil {
 			return err
@@ -97,6 +99,13 @@ func (l *localTransport) ExchangeRaw(ctx context.Context, message *buf.Buffer) (
 		response = buf.FromBytes(query.message)
 		return nil
 	})
+	if err != nil {
+		pending.finish(nil, err)
+		reportDNSFailure("local", err)
+	} else {
+		pending.finish(response.Bytes(), nil)
+	}
+	return response, err
 }
 
 func (l *localTransport) Lookup(ctx context.Context, domain string, strategy dns.QueryStrategy) ([]net.IP, error) {
@@ -112,8 +121,9 @@ func (l *localTransport) Lookup(ctx context.Context, domain string, strategy dns
 	query := &QueryContext{
 		ctx: ctx,
 	}
+	pending := traceDNSLookup(ctx, domain, strategy, "local")
 	var response []net.IP
-	return response, task.Run(ctx, func() error {
+	err := task.Run(ctx, func() error {
 		err := l.r.LookupIP(query, network, domain)
 		if err != nil {
 			return err
@@ -127,6 +137,9 @@ func (l *localTransport) Lookup(ctx context.Context, domain string, strategy dns
 		}
 		return nil
 	})
+	pending.finishLookup(response, err)
+	reportDNSFailure("local", err)
+	return response, err
 }
 
 func (l *localTransport) IsLocalTransport() {
@@ -136,14 +149,19 @@ func (l *localTransport) Close() error {
 	return nil
 }
 
+// localResolverSet reports if the localhost DNS server is a transport of
+// libcore.
+func localResolverSet() bool {
+	resolverAccess.Lock()
+	defer resolverAccess.Unlock()
+	return encryptedResolver != nil || localResolver != nil
+}
+
 func SetLocalhostResolver(local LocalResolver) {
-	if local == nil {
-		localdns.SetTransport(nil)
-	} else {
-		localdns.SetTransport(&localTransport{
-			local,
-		})
-	}
+	resolverAccess.Lock()
+	defer resolverAccess.Unlock()
+	localResolver = local
+	updateResolvers()
 }
 
 func init() {
@@ -153,14 +171,40 @@ func init() {
 var dnsAddress = v2rayNet.IPAddress([]byte{1, 0, 0, 1})
 
 func SetCurrentDomainNameSystemQueryInstance(instance *V2RayInstance) {
-	if instance == nil {
+	resolverAccess.Lock()
+	defer resolverAccess.Unlock()
+	currentInstance = instance
+	updateResolvers()
+}
+
+var (
+	resolverAccess    sync.Mutex
+	localResolver     LocalResolver
+	encryptedResolver *encryptedTransport
+	currentInstance   *V2RayInstance
+)
+
+func updateResolvers() {
+	switch {
+	case encryptedResolver != nil:
+		localdns.SetTransport(encryptedResolver)
+	case localResolver != nil:
+		localdns.SetTransport(&localTransport{localResolver})
+	default:
+		localdns.SetTransport(nil)
+	}
+
+	instance, encrypted := currentInstance, encryptedResolver
+	if instance == nil && encrypted == nil {
 		net.DefaultResolver = &net.Resolver{
 			PreferGo: false,
 		}
-	} else {
-		net.DefaultResolver = &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return
+	}
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if instance != nil {
 				conn, err := instance.dialContext(session.ContextWithInbound(ctx, &session.Inbound{
 					Tag: "dns-in",
 				}), v2rayNet.Destination{
@@ -169,11 +213,18 @@ func SetCurrentDomainNameSystemQueryInstance(instance *V2RayInstance) {
 					Port:    53,
 				})
 				if err == nil {
-					conn = &pinnedPacketConn{conn}
+					return &pinnedPacketConn{conn}, nil
 				}
-				return conn, err
-			},
-		}
+				if encrypted == nil {
+					return nil, err
+				}
+				newError("failed to dial dns through v2ray, using ", encrypted.server).Base(err).WriteToLog()
+			}
+			if strings.HasPrefix(network, "tcp") {
+				return newExchangeStreamConn(ctx, encrypted), nil
+			}
+			return newExchangeConn(ctx, encrypted), nil
+		},
 	}
 }
 
@@ -0,0 +1,354 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type DNSQuery struct {
+	// Time is the unix time of the query in milliseconds.
+	Time   int64
+	Domain string
+	Type   string
+	Uid    int32
+	// Upstream is the server that answered, it is empty for one the DNS
+	// client of v2ray asks itself.
+	Upstream string
+	// RCode is the response code, or -1 if there was no response.
+	RCode int32
+	// Answers holds the A, AAAA and CNAME answers, one per line.
+	Answers string
+	// Latency is in milliseconds.
+	Latency int32
+	// Cached is set for answers from a cache, which is only known for fake
+	// DNS and when every DNS server is the local one.
+	Cached bool
+	Error  string
+}
+
+type DNSQueryListener interface {
+	OnDNSQuery(query *DNSQuery)
+}
+
+type dnsQueryLog struct {
+	size     int32
+	access   sync.Mutex
+	entries  []*DNSQuery
+	next     int
+	listener DNSQueryListener
+}
+
+var dnsLog dnsQueryLog
+
+// SetDNSQueryLogSize sets how many queries are kept, zero disables the log.
+func SetDNSQueryLogSize(size int32) {
+	if size < 0 {
+		size = 0
+	}
+	dnsLog.access.Lock()
+	defer dnsLog.access.Unlock()
+	entries := dnsLog.ordered()
+	if len(entries) > int(size) {
+		entries = entries[len(entries)-int(size):]
+	}
+	dnsLog.entries = append(make([]*DNSQuery, 0, size), entries...)
+	dnsLog.next = 0
+	if size > 0 {
+		dnsLog.next = len(entries) % int(size)
+	}
+	atomic.StoreInt32(&dnsLog.size, size)
+}
+
+// SetDNSQueryListener streams queries to listener as they complete.
+func SetDNSQueryListener(listener DNSQueryListener) {
+	dnsLog.access.Lock()
+	defer dnsLog.access.Unlock()
+	dnsLog.listener = listener
+}
+
+// ReadDNSQueries passes the logged queries to listener, oldest first.
+func ReadDNSQueries(listener DNSQueryListener) {
+	dnsLog.access.Lock()
+	entries := dnsLog.ordered()
+	dnsLog.access.Unlock()
+	for _, entry := range entries {
+		listener.OnDNSQuery(entry)
+	}
+}
+
+func ClearDNSQueries() {
+	dnsLog.access.Lock()
+	defer dnsLog.access.Unlock()
+	dnsLog.entries = dnsLog.entries[:0]
+	dnsLog.next = 0
+}
+
+func (l *dnsQueryLog) enabled() bool {
+	return atomic.LoadInt32(&l.size) > 0
+}
+
+func (l *dnsQueryLog) ordered() []*DNSQuery {
+	if len(l.entries) < cap(l.entries) {
+		return append([]*DNSQuery(nil), l.entries...)
+	}
+	return append(append([]*DNSQuery(nil), l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+func (l *dnsQueryLog) add(entry *DNSQuery) {
+	l.access.Lock()
+	if cap(l.entries) == 0 {
+		l.access.Unlock()
+		return
+	}
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[l.next] = entry
+	}
+	l.next = (l.next + 1) % cap(l.entries)
+	listener := l.listener
+	l.access.Unlock()
+	if listener != nil {
+		listener.OnDNSQuery(entry)
+	}
+}
+
+type dnsQueryKey struct {
+	source string
+	id     uint16
+}
+
+type pendingDNSQuery struct {
+	entry *DNSQuery
+	start time.Time
+}
+
+// newPendingDNSQuery parses a raw query, returning nil when the log is
+// disabled or the message is not a query.
+func newPendingDNSQuery(query []byte, uid int32, upstream string) *pendingDNSQuery {
+	if !dnsLog.enabled() {
+		return nil
+	}
+	question, ok := parseDNSQuestion(query)
+	if !ok {
+		return nil
+	}
+	return newPendingDNSQuestion(question, uid, upstream)
+}
+
+func newPendingDNSLookup(domain string, strategy dns.QueryStrategy, upstream string) *pendingDNSQuery {
+	if !dnsLog.enabled() {
+		return nil
+	}
+	return newPendingDNSQuestion(dnsQuestion{domain, dnsLookupType(strategy)}, 0, upstream)
+}
+
+func newPendingDNSQuestion(question dnsQuestion, uid int32, upstream string) *pendingDNSQuery {
+	now := time.Now()
+	return &pendingDNSQuery{
+		entry: &DNSQuery{
+			Time:     now.UnixMilli(),
+			Domain:   question.domain,
+			Type:     question.qType,
+			Uid:      uid,
+			Upstream: upstream,
+			RCode:    -1,
+		},
+		start: now,
+	}
+}
+
+type dnsQuestion struct {
+	domain string
+	qType  string
+}
+
+func parseDNSQuestion(query []byte) (dnsQuestion, bool) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return dnsQuestion{}, false
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return dnsQuestion{}, false
+	}
+	return dnsQuestion{strings.TrimSuffix(question.Name.String(), "."), dnsTypeName(question.Type)}, true
+}
+
+func dnsLookupType(strategy dns.QueryStrategy) string {
+	switch strategy {
+	case dns.QueryStrategy_USE_IP4:
+		return "A"
+	case dns.QueryStrategy_USE_IP6:
+		return "AAAA"
+	default:
+		return "A,AAAA"
+	}
+}
+
+// dnsQueryTrace goes with the context of a DNS session of the tun, whose
+// queries are logged there with the uid. Transports of the DNS client note the
+// upstreams they are asked in it instead of logging the query again.
+type dnsQueryTrace struct {
+	// cache is set when every server of the DNS client is a transport of
+	// libcore, so an answer none of them gave came from the cache.
+	cache     bool
+	access    sync.Mutex
+	upstreams map[dnsQuestion]string
+}
+
+type dnsQueryTraceKey struct{}
+
+func contextWithDNSQueryTrace(ctx context.Context, trace *dnsQueryTrace) context.Context {
+	return context.WithValue(ctx, dnsQueryTraceKey{}, trace)
+}
+
+// traceDNSQuery notes upstream for a raw query in the trace of ctx, or returns
+// the query to log when ctx has none.
+func traceDNSQuery(ctx context.Context, query []byte, upstream string) *pendingDNSQuery {
+	trace, _ := ctx.Value(dnsQueryTraceKey{}).(*dnsQueryTrace)
+	if trace == nil {
+		return newPendingDNSQuery(query, 0, upstream)
+	}
+	if question, ok := parseDNSQuestion(query); ok {
+		trace.asked(question, upstream)
+	}
+	return nil
+}
+
+func traceDNSLookup(ctx context.Context, domain string, strategy dns.QueryStrategy, upstream string) *pendingDNSQuery {
+	trace, _ := ctx.Value(dnsQueryTraceKey{}).(*dnsQueryTrace)
+	if trace == nil {
+		return newPendingDNSLookup(domain, strategy, upstream)
+	}
+	for _, qType := range strings.Split(dnsLookupType(strategy), ",") {
+		trace.asked(dnsQuestion{domain, qType}, upstream)
+	}
+	return nil
+}
+
+func (t *dnsQueryTrace) asked(question dnsQuestion, upstream string) {
+	question.domain = strings.ToLower(question.domain)
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.upstreams == nil {
+		t.upstreams = make(map[dnsQuestion]string)
+	}
+	t.upstreams[question] = upstream
+}
+
+// finish logs q with the upstream asked for it, or as answered from the cache.
+func (t *dnsQueryTrace) finish(q *pendingDNSQuery, response []byte, err error) {
+	if q == nil {
+		return
+	}
+	question := dnsQuestion{strings.ToLower(q.entry.Domain), q.entry.Type}
+	t.access.Lock()
+	upstream, asked := t.upstreams[question]
+	delete(t.upstreams, question)
+	t.access.Unlock()
+	if asked {
+		q.entry.Upstream = upstream
+	} else if err == nil {
+		q.entry.Cached = t.cache
+	}
+	q.finish(response, err)
+}
+
+func (q *pendingDNSQuery) finish(response []byte, err error) {
+	if q == nil {
+		return
+	}
+	q.entry.Latency = int32(time.Since(q.start).Milliseconds())
+	var rcodeErr dns.RCodeError
+	switch {
+	case err == nil:
+		q.entry.RCode, q.entry.Answers = parseDNSAnswers(response)
+	case errors.As(err, &rcodeErr):
+		q.entry.RCode = int32(rcodeErr)
+	default:
+		q.entry.Error = err.Error()
+	}
+	dnsLog.add(q.entry)
+}
+
+func (q *pendingDNSQuery) finishLookup(ips []net.IP, err error) {
+	if q == nil {
+		return
+	}
+	q.entry.Latency = int32(time.Since(q.start).Milliseconds())
+	var rcodeErr dns.RCodeError
+	switch {
+	case err == nil:
+		q.entry.RCode = int32(dnsmessage.RCodeSuccess)
+		answers := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+		q.entry.Answers = strings.Join(answers, "\n")
+	case errors.As(err, &rcodeErr):
+		q.entry.RCode = int32(rcodeErr)
+	default:
+		q.entry.Error = err.Error()
+	}
+	dnsLog.add(q.entry)
+}
+
+func parseDNSAnswers(response []byte) (rcode int32, answers string) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil || parser.SkipAllQuestions() != nil {
+		return -1, ""
+	}
+	var records []string
+	for {
+		answerHeader, err := parser.AnswerHeader()
+		if err != nil {
+			break
+		}
+		switch answerHeader.Type {
+		case dnsmessage.TypeA:
+			var resource dnsmessage.AResource
+			if resource, err = parser.AResource(); err == nil {
+				records = append(records, netip.AddrFrom4(resource.A).String())
+			}
+		case dnsmessage.TypeAAAA:
+			var resource dnsmessage.AAAAResource
+			if resource, err = parser.AAAAResource(); err == nil {
+				records = append(records, netip.AddrFrom16(resource.AAAA).String())
+			}
+		case dnsmessage.TypeCNAME:
+			var resource dnsmessage.CNAMEResource
+			if resource, err = parser.CNAMEResource(); err == nil {
+				records = append(records, strings.TrimSuffix(resource.CNAME.String(), "."))
+			}
+		default:
+			err = parser.SkipAnswer()
+		}
+		if err != nil {
+			break
+		}
+	}
+	return int32(header.RCode), strings.Join(records, "\n")
+}
+
+func dnsTypeName(qType dnsmessage.Type) string {
+	return strings.TrimPrefix(qType.String(), "Type")
+}
+
+func dnsMessageID(message []byte) (uint16, bool) {
+	if len(message) < 12 {
+		return 0, false
+	}
+	return uint16(message[0])<<8 | uint16(message[1]), true
+}
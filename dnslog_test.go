@@ -0,0 +1,217 @@
+package libcore
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun/tuntest"
+)
+
+type testDNSQueryListener struct {
+	access  sync.Mutex
+	queries []*DNSQuery
+}
+
+func (l *testDNSQueryListener) OnDNSQuery(query *DNSQuery) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	l.queries = append(l.queries, query)
+}
+
+func (l *testDNSQueryListener) domains() []string {
+	l.access.Lock()
+	defer l.access.Unlock()
+	var domains []string
+	for _, query := range l.queries {
+		domains = append(domains, query.Domain)
+	}
+	return domains
+}
+
+func readDNSQueryDomains() []string {
+	listener := &testDNSQueryListener{}
+	ReadDNSQueries(listener)
+	return listener.domains()
+}
+
+func TestDNSQueryLog(t *testing.T) {
+	SetDNSQueryLogSize(2)
+	t.Cleanup(func() {
+		SetDNSQueryLogSize(0)
+		SetDNSQueryListener(nil)
+	})
+	stream := &testDNSQueryListener{}
+	SetDNSQueryListener(stream)
+
+	for _, domain := range []string{"a.example", "b.example", "c.example"} {
+		pending := newPendingDNSQuery(testDNSQuery(t, domain, dnsmessage.TypeA), 10000, "test")
+		pending.finish(testDNSResponse(t, testDNSQuery(t, domain, dnsmessage.TypeA)), nil)
+	}
+	if domains := readDNSQueryDomains(); len(domains) != 2 || domains[0] != "b.example" || domains[1] != "c.example" {
+		t.Fatalf("unexpected log %v", domains)
+	}
+	if domains := stream.domains(); len(domains) != 3 {
+		t.Fatalf("unexpected stream %v", domains)
+	}
+	query := stream.queries[0]
+	if query.Type != "A" || query.Uid != 10000 || query.Upstream != "test" || query.RCode != 0 || query.Answers != "10.0.0.1" {
+		t.Fatalf("unexpected query %+v", *query)
+	}
+
+	SetDNSQueryLogSize(1)
+	if domains := readDNSQueryDomains(); len(domains) != 1 || domains[0] != "c.example" {
+		t.Fatalf("unexpected log after resize %v", domains)
+	}
+	ClearDNSQueries()
+	if domains := readDNSQueryDomains(); len(domains) != 0 {
+		t.Fatalf("unexpected log after clear %v", domains)
+	}
+
+	SetDNSQueryLogSize(0)
+	if newPendingDNSQuery(testDNSQuery(t, "d.example", dnsmessage.TypeA), 0, "test") != nil {
+		t.Fatal("query recorded while the log is disabled")
+	}
+}
+
+func TestTun2rayDNSQueryLog(t *testing.T) {
+	SetDNSQueryLogSize(16)
+	t.Cleanup(func() {
+		SetDNSQueryLogSize(0)
+	})
+	_, device, _ := newTestTun2ray(t, comm.TunImplementationSystem, func(config *TunConfig) {
+		config.FakeDNS = true
+	})
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	for i := 0; i < 2; i++ {
+		err := device.Write(tuntest.UDPPacket(source, netip.MustParseAddrPort("172.19.0.2:53"), testDNSQuery(t, "log.test", dnsmessage.TypeA)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+			return packet.Protocol == header.UDPProtocolNumber
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listener := &testDNSQueryListener{}
+	ReadDNSQueries(listener)
+	if len(listener.queries) != 2 {
+		t.Fatalf("unexpected log %v", listener.domains())
+	}
+	first, second := listener.queries[0], listener.queries[1]
+	if first.Domain != "log.test" || first.Upstream != "fakedns" || first.Cached || !second.Cached {
+		t.Fatalf("unexpected queries %+v %+v", *first, *second)
+	}
+	if first.Answers != second.Answers || first.Answers == "" {
+		t.Fatalf("unexpected answers %q %q", first.Answers, second.Answers)
+	}
+}
+
+// Queries dropped before a session exists must not stay pending.
+func TestTun2rayDNSQueryDropped(t *testing.T) {
+	SetDNSQueryLogSize(16)
+	t.Cleanup(func() {
+		SetDNSQueryLogSize(0)
+	})
+	tun, device, _ := newTestTun2ray(t, comm.TunImplementationSystem)
+	err := tun.v2ray.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = device.Write(tuntest.UDPPacket(netip.MustParseAddrPort("172.19.0.1:40000"), netip.MustParseAddrPort("172.19.0.2:53"), testDNSQuery(t, "dropped.test", dnsmessage.TypeA)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	tun.dnsQueries.Range(func(key, value interface{}) bool {
+		t.Fatalf("query %v left pending", key)
+		return false
+	})
+}
+
+type testLocalResolver struct {
+	t *testing.T
+}
+
+func (r testLocalResolver) HasRawSupport() bool {
+	return true
+}
+
+func (r testLocalResolver) QueryRaw(ctx *QueryContext, message []byte) error {
+	ctx.RawSuccess(testDNSResponse(r.t, message))
+	return nil
+}
+
+func (r testLocalResolver) LookupIP(ctx *QueryContext, network string, domain string) error {
+	return errors.New("not implemented")
+}
+
+// Queries through the DNS outbound are logged once, at the tun, with the
+// server or cache of the DNS client that answered.
+func TestTun2rayDNSQueryUpstream(t *testing.T) {
+	SetDNSQueryLogSize(16)
+	SetLocalhostResolver(testLocalResolver{t})
+	t.Cleanup(func() {
+		SetDNSQueryLogSize(0)
+		SetLocalhostResolver(nil)
+	})
+	instance := NewV2rayInstance()
+	err := instance.LoadConfig(`{
+  "log": {"loglevel": "none"},
+  "dns": {"servers": ["localhost"]},
+  "outbounds": [{"protocol": "freedom", "tag": "direct"}, {"protocol": "dns", "tag": "dns-out"}],
+  "routing": {"rules": [{"type": "field", "inboundTag": ["dns-in"], "outboundTag": "dns-out"}]}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.Start(testErrorHandler{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		instance.Close()
+	})
+	_, device, _ := newTestTun2ray(t, comm.TunImplementationSystem, func(config *TunConfig) {
+		config.V2Ray = instance
+	})
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	for i, qType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeA, dnsmessage.TypeTXT} {
+		query := testDNSQuery(t, "upstream.test", qType)
+		query[1] = byte(i)
+		err = device.Write(tuntest.UDPPacket(source, netip.MustParseAddrPort("172.19.0.2:53"), query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+			return packet.Protocol == header.UDPProtocolNumber
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listener := &testDNSQueryListener{}
+	ReadDNSQueries(listener)
+	if len(listener.queries) != 3 {
+		t.Fatalf("unexpected log %v", listener.domains())
+	}
+	for i, expected := range []DNSQuery{
+		{Type: "A", Upstream: "local"},
+		{Type: "A", Cached: true},
+		{Type: "TXT", Upstream: "local"},
+	} {
+		query := listener.queries[i]
+		if query.Domain != "upstream.test" || query.Type != expected.Type || query.Upstream != expected.Upstream || query.Cached != expected.Cached || query.RCode != 0 {
+			t.Fatalf("unexpected query %d %+v", i, *query)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common"
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/task"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"github.com/v2fly/v2ray-core/v5/features/dns/localdns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var _ localdns.LocalTransport = (*encryptedTransport)(nil)
+
+// encryptedTransport is a DNS-over-HTTPS (RFC 8484) or DNS-over-TLS
+// (RFC 7858) client whose sockets are protected from the tun.
+type encryptedTransport struct {
+	server      string
+	destination v2rayNet.Destination
+	tlsConfig   *tls.Config
+	dialer      protectedDialer
+	http        *http.Transport
+
+	access sync.Mutex
+	closed bool
+	// conns are the idle DoT connections.
+	conns []net.Conn
+}
+
+// dotMaxIdleConns is how many DoT connections are kept open between queries.
+const dotMaxIdleConns = 4
+
+// newEncryptedTransport parses a https:// or tls:// server. When the server
+// host is a domain, it is only used for TLS verification and bootstrap must
+// be its IP, so no plaintext lookup is ever made.
+func newEncryptedTransport(server string, bootstrap string, protector Protector) (*encryptedTransport, error) {
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return nil, newError("invalid dns server ", server).Base(err)
+	}
+	var defaultPort v2rayNet.Port
+	switch serverURL.Scheme {
+	case "https":
+		defaultPort = 443
+		if serverURL.Path == "" {
+			serverURL.Path = "/dns-query"
+		}
+	case "tls":
+		defaultPort = 853
+	default:
+		return nil, newError("unsupported dns server scheme ", serverURL.Scheme)
+	}
+	host := serverURL.Hostname()
+	address := net.ParseIP(host)
+	if address == nil {
+		address = net.ParseIP(bootstrap)
+		if address == nil {
+			return nil, newError("bootstrap address required for dns server ", host)
+		}
+	}
+	port := defaultPort
+	if serverURL.Port() != "" {
+		port, err = v2rayNet.PortFromString(serverURL.Port())
+		if err != nil {
+			return nil, newError("invalid dns server port ", serverURL.Port()).Base(err)
+		}
+	}
+	if protector == nil {
+		protector = noopProtectorInstance
+	}
+	t := &encryptedTransport{
+		server:      serverURL.String(),
+		destination: v2rayNet.TCPDestination(v2rayNet.IPAddress(address), port),
+		tlsConfig: &tls.Config{
+			ServerName: host,
+		},
+		dialer: protectedDialer{protector: protector},
+	}
+	if serverURL.Scheme == "https" {
+		t.http = &http.Transport{
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   time.Minute,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return t.dialer.dial(ctx, nil, t.destination, nil)
+			},
+			TLSClientConfig: t.tlsConfig,
+		}
+	}
+	return t, nil
+}
+
+func (t *encryptedTransport) Type() dns.TransportType {
+	return dns.TransportTypeExchangeRaw
+}
+
+func (t *encryptedTransport) Write(ctx context.Context, message *dnsmessage.Message) error {
+	return common.ErrNoClue
+}
+
+func (t *encryptedTransport) Exchange(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+	return nil, common.ErrNoClue
+}
+
+func (t *encryptedTransport) ExchangeRaw(ctx context.Context, message *buf.Buffer) (*buf.Buffer, error) {
+	response, err := t.exchange(ctx, message.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return buf.FromBytes(response), nil
+}
+
+func (t *encryptedTransport) exchange(ctx context.Context, message []byte) (response []byte, err error) {
+	if len(message) < 12 {
+		return nil, newError("short dns query")
+	}
+	pending := traceDNSQuery(ctx, message, t.server)
+	defer func() {
+		pending.finish(response, err)
+		reportDNSFailure(t.server, err)
+	}()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dns.DefaultTimeout)
+		defer cancel()
+	}
+	if t.http != nil {
+		return t.exchangeHTTPS(ctx, message)
+	}
+	return response, task.Run(ctx, func() error {
+		response, err = t.exchangeTLS(ctx, message)
+		return err
+	})
+}
+
+func (t *encryptedTransport) exchangeHTTPS(ctx context.Context, message []byte) ([]byte, error) {
+	// The ID should be zero for cache friendliness (RFC 8484 4.1).
+	id := binary.BigEndian.Uint16(message)
+	query := make([]byte, len(message))
+	copy(query, message)
+	binary.BigEndian.PutUint16(query, 0)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.server, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := t.http.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError("unexpected dns server status: ", resp.Status)
+	}
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 {
+		return nil, newError("short dns response")
+	}
+	binary.BigEndian.PutUint16(response, id)
+	return response, nil
+}
+
+// exchangeTLS sends the query over an idle connection, or a new one if all are
+// busy, so a slow answer doesn't hold up other queries. Idle connections the
+// server closed are replaced.
+func (t *encryptedTransport) exchangeTLS(ctx context.Context, message []byte) ([]byte, error) {
+	for {
+		conn := t.idleConn()
+		reused := conn != nil
+		if !reused {
+			var err error
+			conn, err = t.dialTLS(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		response, err := exchangeStream(conn, message)
+		if err == nil {
+			t.putIdleConn(conn)
+			return response, nil
+		}
+		conn.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *encryptedTransport) dialTLS(ctx context.Context) (net.Conn, error) {
+	conn, err := t.dialer.dial(ctx, nil, t.destination, nil)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, t.tlsConfig)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (t *encryptedTransport) idleConn() net.Conn {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if len(t.conns) == 0 {
+		return nil
+	}
+	conn := t.conns[len(t.conns)-1]
+	t.conns = t.conns[:len(t.conns)-1]
+	return conn
+}
+
+func (t *encryptedTransport) putIdleConn(conn net.Conn) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.closed || len(t.conns) >= dotMaxIdleConns {
+		conn.Close()
+		return
+	}
+	t.conns = append(t.conns, conn)
+}
+
+func exchangeStream(conn net.Conn, message []byte) ([]byte, error) {
+	packet := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(packet, uint16(len(message)))
+	copy(packet[2:], message)
+	_, err := conn.Write(packet)
+	if err != nil {
+		return nil, err
+	}
+	var length uint16
+	err = binary.Read(conn, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, length)
+	_, err = io.ReadFull(conn, response)
+	return response, err
+}
+
+func (t *encryptedTransport) Lookup(ctx context.Context, domain string, strategy dns.QueryStrategy) ([]net.IP, error) {
+	var types []dnsmessage.Type
+	if strategy != dns.QueryStrategy_USE_IP6 {
+		types = append(types, dnsmessage.TypeA)
+	}
+	if strategy != dns.QueryStrategy_USE_IP4 {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+	var ips []net.IP
+	var lastErr error
+	for _, qType := range types {
+		answers, err := t.lookup(ctx, domain, qType)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ips = append(ips, answers...)
+	}
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, dns.ErrEmptyResponse
+	}
+	return ips, nil
+}
+
+func (t *encryptedTransport) lookup(ctx context.Context, domain string, qType dnsmessage.Type) ([]net.IP, error) {
+	if !strings.HasSuffix(domain, ".") {
+		domain = domain + "."
+	}
+	name, err := dnsmessage.NewName(domain)
+	if err != nil {
+		return nil, newError("domain name too long").Base(err)
+	}
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qType,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	response, err := t.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	err = message.Unpack(response)
+	if err != nil {
+		return nil, newError("failed to parse DNS response").Base(err)
+	}
+	if message.RCode != dnsmessage.RCodeSuccess {
+		return nil, dns.RCodeError(message.RCode)
+	}
+	var ips []net.IP
+	for _, answer := range message.Answers {
+		switch resource := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, resource.A[:])
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, resource.AAAA[:])
+		}
+	}
+	return ips, nil
+}
+
+func (t *encryptedTransport) IsLocalTransport() {
+}
+
+func (t *encryptedTransport) Close() error {
+	if t.http != nil {
+		t.http.CloseIdleConnections()
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.closed = true
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+	t.conns = nil
+	return nil
+}
+
+// exchangeConn lets the Go resolver send its queries through the encrypted
+// transport.
+type exchangeConn struct {
+	ctx       context.Context
+	transport *encryptedTransport
+	responses chan []byte
+	closed    chan struct{}
+	deadline  time.Time
+}
+
+func newExchangeConn(ctx context.Context, transport *encryptedTransport) *exchangeConn {
+	return &exchangeConn{
+		ctx:       ctx,
+		transport: transport,
+		responses: make(chan []byte, 2),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (c *exchangeConn) Write(p []byte) (int, error) {
+	message := make([]byte, len(p))
+	copy(message, p)
+	go func() {
+		ctx := c.ctx
+		if !c.deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, c.deadline)
+			defer cancel()
+		}
+		response, err := c.transport.exchange(ctx, message)
+		if err != nil {
+			newError("encrypted dns exchange failed").Base(err).WriteToLog()
+			return
+		}
+		select {
+		case c.responses <- response:
+		case <-c.closed:
+		}
+	}()
+	return len(p), nil
+}
+
+// Read returns a response that doesn't fit p as its header and questions with
+// the TC bit set, so the resolver retries over TCP.
+func (c *exchangeConn) Read(p []byte) (int, error) {
+	response, err := c.receive()
+	if err != nil {
+		return 0, err
+	}
+	if len(response) > len(p) {
+		response = truncateDNSResponse(response)
+		if len(response) > len(p) {
+			return 0, newError("dns response too large")
+		}
+	}
+	return copy(p, response), nil
+}
+
+func (c *exchangeConn) receive() ([]byte, error) {
+	var timeout <-chan time.Time
+	if !c.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(c.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case response := <-c.responses:
+		return response, nil
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func truncateDNSResponse(response []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return response
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return response
+	}
+	header.Truncated = true
+	message := dnsmessage.Message{Header: header, Questions: questions}
+	truncated, err := message.Pack()
+	if err != nil {
+		return response
+	}
+	return truncated
+}
+
+func (c *exchangeConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *exchangeConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+func (c *exchangeConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func (c *exchangeConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *exchangeConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: c.transport.destination.Address.IP(), Port: int(c.transport.destination.Port)}
+}
+
+func (c *exchangeConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *exchangeConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *exchangeConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// exchangeStreamConn is an exchangeConn framed as DNS over TCP, which the Go
+// resolver uses after a truncated response. It hides the packet methods, or
+// the resolver would use it as a packet conn again.
+type exchangeStreamConn struct {
+	net.Conn
+	exchangeConn *exchangeConn
+	pending      []byte
+}
+
+func newExchangeStreamConn(ctx context.Context, transport *encryptedTransport) *exchangeStreamConn {
+	conn := newExchangeConn(ctx, transport)
+	return &exchangeStreamConn{Conn: conn, exchangeConn: conn}
+}
+
+func (c *exchangeStreamConn) Write(p []byte) (int, error) {
+	if len(p) < 2 || int(binary.BigEndian.Uint16(p)) != len(p)-2 {
+		return 0, newError("unexpected dns stream write")
+	}
+	_, err := c.exchangeConn.Write(p[2:])
+	return len(p), err
+}
+
+func (c *exchangeStreamConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		response, err := c.exchangeConn.receive()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = make([]byte, 2+len(response))
+		binary.BigEndian.PutUint16(c.pending, uint16(len(response)))
+		copy(c.pending[2:], response)
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// SetEncryptedResolver replaces the local resolver and the fallback of the Go
+// resolver with a DoH (https://host/dns-query) or DoT (tls://host:853)
+// server. An empty server restores them.
+func SetEncryptedResolver(server string, bootstrap string, protector Protector) error {
+	var transport *encryptedTransport
+	if server != "" {
+		var err error
+		transport, err = newEncryptedTransport(server, bootstrap, protector)
+		if err != nil {
+			return err
+		}
+	}
+	resolverAccess.Lock()
+	defer resolverAccess.Unlock()
+	if encryptedResolver != nil {
+		encryptedResolver.Close()
+	}
+	encryptedResolver = transport
+	updateResolvers()
+	return nil
+}
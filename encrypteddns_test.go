@@ -0,0 +1,258 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type countingProtector struct {
+	count int32
+}
+
+func (p *countingProtector) Protect(int32) bool {
+	atomic.AddInt32(&p.count, 1)
+	return true
+}
+
+// testDNSResponse answers A and AAAA queries, with 100 addresses for names
+// under large.test.
+func testDNSResponse(t *testing.T, query []byte) []byte {
+	var message dnsmessage.Message
+	err := message.Unpack(query)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	message.Response = true
+	for _, question := range message.Questions {
+		header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: 60}
+		switch question.Type {
+		case dnsmessage.TypeA:
+			if strings.HasSuffix(question.Name.String(), "large.test.") {
+				for i := 0; i < 100; i++ {
+					message.Answers = append(message.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{10, 0, 1, byte(i)}}})
+				}
+				continue
+			}
+			message.Answers = append(message.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}})
+		case dnsmessage.TypeAAAA:
+			message.Answers = append(message.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0xfd, 15: 1}}})
+		}
+	}
+	response, err := message.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+	return response
+}
+
+// startTestDNSServers serves DoH and DoT with the httptest certificate, which
+// is valid for example.com. DoT answers for slow.test are delayed.
+func startTestDNSServers(t *testing.T) (dohPort int, dotPort int, roots *x509.CertPool) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		if binary.BigEndian.Uint16(query) != 0 {
+			t.Error("doh query id not zero")
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(testDNSResponse(t, query))
+	}))
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.TLS)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var length uint16
+					if binary.Read(conn, binary.BigEndian, &length) != nil {
+						return
+					}
+					query := make([]byte, length)
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					if bytes.Contains(query, []byte("\x04slow\x04test")) {
+						time.Sleep(time.Second)
+					}
+					response := testDNSResponse(t, query)
+					binary.Write(conn, binary.BigEndian, uint16(len(response)))
+					conn.Write(response)
+				}
+			}()
+		}
+	}()
+	roots = x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	return server.Listener.Addr().(*net.TCPAddr).Port, listener.Addr().(*net.TCPAddr).Port, roots
+}
+
+func TestEncryptedTransport(t *testing.T) {
+	dohPort, dotPort, roots := startTestDNSServers(t)
+	for _, c := range []struct {
+		name   string
+		server string
+	}{
+		{"doh", "https://example.com:" + strconv.Itoa(dohPort) + "/dns-query"},
+		{"dot", "tls://example.com:" + strconv.Itoa(dotPort)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			protector := &countingProtector{}
+			transport, err := newEncryptedTransport(c.server, "127.0.0.1", protector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport.tlsConfig.RootCAs = roots
+			defer transport.Close()
+
+			for i := 0; i < 2; i++ {
+				ips, err := transport.Lookup(context.Background(), "example.org", dns.QueryStrategy_USE_IP)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(ips) != 2 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) || !ips[1].Equal(net.ParseIP("fd00::1")) {
+					t.Fatalf("unexpected answers %v", ips)
+				}
+			}
+			// Both queries share one protected connection.
+			if count := atomic.LoadInt32(&protector.count); count != 1 {
+				t.Fatalf("expected one protected socket, got %d", count)
+			}
+
+			_, err = transport.exchange(context.Background(), []byte{0})
+			if err == nil {
+				t.Fatal("expected error for a short query")
+			}
+		})
+	}
+
+	_, err := newEncryptedTransport("tls://dns.example.com", "", nil)
+	if err == nil {
+		t.Fatal("expected error without bootstrap address")
+	}
+	_, err = newEncryptedTransport("udp://1.1.1.1", "", nil)
+	if err == nil {
+		t.Fatal("expected error for unsupported scheme")
+	}
+}
+
+func TestEncryptedDefaultResolver(t *testing.T) {
+	_, dotPort, roots := startTestDNSServers(t)
+	transport, err := newEncryptedTransport("tls://example.com:"+strconv.Itoa(dotPort), "127.0.0.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.tlsConfig.RootCAs = roots
+	resolverAccess.Lock()
+	encryptedResolver = transport
+	updateResolvers()
+	resolverAccess.Unlock()
+	defer SetEncryptedResolver("", "", nil)
+
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip4", "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("unexpected answers %v", ips)
+	}
+}
+
+// A slow answer doesn't hold up other DoT queries.
+func TestEncryptedTransportConcurrent(t *testing.T) {
+	_, dotPort, roots := startTestDNSServers(t)
+	transport, err := newEncryptedTransport("tls://example.com:"+strconv.Itoa(dotPort), "127.0.0.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.tlsConfig.RootCAs = roots
+	defer transport.Close()
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := transport.Lookup(context.Background(), "slow.test", dns.QueryStrategy_USE_IP4)
+		slow <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	_, err = transport.Lookup(context.Background(), "example.org", dns.QueryStrategy_USE_IP4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("query waited %s for a slow one", elapsed)
+	}
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Responses too large for the Go resolver are truncated and retried over TCP.
+func TestEncryptedDefaultResolverTruncated(t *testing.T) {
+	_, dotPort, roots := startTestDNSServers(t)
+	transport, err := newEncryptedTransport("tls://example.com:"+strconv.Itoa(dotPort), "127.0.0.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.tlsConfig.RootCAs = roots
+	resolverAccess.Lock()
+	encryptedResolver = transport
+	updateResolvers()
+	resolverAccess.Unlock()
+	defer SetEncryptedResolver("", "", nil)
+
+	conn := newExchangeConn(context.Background(), transport)
+	defer conn.Close()
+	conn.Write(testDNSQuery(t, "large.test", dnsmessage.TypeA))
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message dnsmessage.Message
+	err = message.Unpack(response[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !message.Truncated || len(message.Questions) != 1 || len(message.Answers) != 0 {
+		t.Fatalf("unexpected truncated response %+v", message)
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip4", "large.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 100 {
+		t.Fatalf("expected 100 answers, got %d", len(ips))
+	}
+}
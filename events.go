@@ -0,0 +1,138 @@
+package libcore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	v2rayErrors "github.com/v2fly/v2ray-core/v5/common/errors"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"libcore/comm"
+	"libcore/tun"
+)
+
+// eventInterval is how often an event of the same kind is repeated, for
+// failures that happen for every connection once they start.
+const eventInterval = time.Minute
+
+// Event tells the app about something it may react to. Code and Severity are
+// the comm.Event values, the fields depend on the code.
+type Event struct {
+	Code     int32
+	Severity int32
+	Message  string
+	fields   map[string]string
+}
+
+type EventListener interface {
+	OnEvent(event *Event)
+}
+
+// Field returns the named field, or an empty string.
+func (e *Event) Field(name string) string {
+	return e.fields[name]
+}
+
+// FieldsJSON returns all fields as a JSON object.
+func (e *Event) FieldsJSON() string {
+	content, _ := json.Marshal(e.fields)
+	return string(content)
+}
+
+var events struct {
+	access   sync.Mutex
+	listener EventListener
+	last     map[string]time.Time
+}
+
+// SetEventListener streams events to listener, replacing the messages of
+// ErrorHandler with typed ones.
+func SetEventListener(listener EventListener) {
+	events.access.Lock()
+	defer events.access.Unlock()
+	events.listener = listener
+}
+
+func newEvent(code int32, severity int32, message string, fields map[string]string) *Event {
+	return &Event{code, severity, message, fields}
+}
+
+func emitEvent(event *Event) {
+	events.access.Lock()
+	listener := events.listener
+	events.access.Unlock()
+	if listener != nil {
+		listener.OnEvent(event)
+	}
+}
+
+// emitEventOnce emits the event unless one with the same key was emitted in
+// the last eventInterval.
+func emitEventOnce(key string, event *Event) {
+	events.access.Lock()
+	now := time.Now()
+	if last, ok := events.last[key]; ok && now.Sub(last) < eventInterval {
+		events.access.Unlock()
+		return
+	}
+	if events.last == nil {
+		events.last = make(map[string]time.Time)
+	}
+	events.last[key] = now
+	events.access.Unlock()
+	emitEvent(event)
+}
+
+// handleEvent passes the events of the stack on, and to the ErrorHandler for
+// apps not listening to events yet.
+func (t *Tun2ray) handleEvent(event *tun.Event) {
+	emitEvent(newEvent(event.Code, event.Severity, event.Message, event.Fields))
+	if t.errorHandler != nil {
+		t.errorHandler.HandleError(event.Message)
+	}
+}
+
+// reportDNSFailure tells about an upstream that gave no answer. Answers with an
+// error code are the domain's problem, not the upstream's.
+func reportDNSFailure(upstream string, err error) {
+	if err == nil {
+		return
+	}
+	var rcodeErr dns.RCodeError
+	cause := v2rayErrors.Cause(err)
+	if errors.As(cause, &rcodeErr) || cause == dns.ErrEmptyResponse || errors.Is(cause, context.Canceled) {
+		return
+	}
+	emitEventOnce("dns "+upstream, newEvent(comm.EventDNSFailure, comm.EventSeverityWarning, "dns query to "+upstream+" failed: "+err.Error(), map[string]string{
+		"upstream": upstream,
+		"error":    err.Error(),
+	}))
+}
+
+// reportOutboundFailure tells about a connection that failed in its outbound
+// before anything came back from it.
+func reportOutboundFailure(outbound string, err error) {
+	if err == nil {
+		return
+	}
+	cause := v2rayErrors.Cause(err)
+	if cause == io.EOF || cause == io.ErrClosedPipe || errors.Is(cause, context.Canceled) {
+		return
+	}
+	emitEventOnce("outbound "+outbound, newEvent(comm.EventOutboundFailure, comm.EventSeverityWarning, "outbound "+outbound+" failed: "+err.Error(), map[string]string{
+		"outbound": outbound,
+		"error":    err.Error(),
+	}))
+}
+
+// assetMissing reports an asset that could not be opened and returns err.
+func assetMissing(name string, err error) error {
+	emitEventOnce("asset "+name, newEvent(comm.EventAssetMissing, comm.EventSeverityError, "asset "+name+" missing: "+err.Error(), map[string]string{
+		"name":  name,
+		"error": err.Error(),
+	}))
+	return err
+}
@@ -0,0 +1,89 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"libcore/comm"
+	"libcore/tun"
+)
+
+type testEventListener chan *Event
+
+func (l testEventListener) OnEvent(event *Event) {
+	l <- event
+}
+
+func listenEvents(t *testing.T) testEventListener {
+	listener := make(testEventListener, 4)
+	SetEventListener(listener)
+	t.Cleanup(func() {
+		SetEventListener(nil)
+		events.access.Lock()
+		events.last = nil
+		events.access.Unlock()
+	})
+	return listener
+}
+
+func TestDNSFailureEvent(t *testing.T) {
+	listener := listenEvents(t)
+	reportDNSFailure("local", dns.RCodeError(3))
+	reportDNSFailure("local", newError("lookup failed").Base(dns.ErrEmptyResponse))
+	reportDNSFailure("local", errors.New("i/o timeout"))
+	reportDNSFailure("local", errors.New("i/o timeout"))
+	if len(listener) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(listener))
+	}
+	event := <-listener
+	if event.Code != comm.EventDNSFailure || event.Severity != comm.EventSeverityWarning {
+		t.Fatalf("unexpected event %d/%d", event.Code, event.Severity)
+	}
+	if event.Field("upstream") != "local" || event.FieldsJSON() != `{"error":"i/o timeout","upstream":"local"}` {
+		t.Fatalf("unexpected fields %s", event.FieldsJSON())
+	}
+}
+
+func TestOutboundFailureEvent(t *testing.T) {
+	listener := listenEvents(t)
+	reportOutboundFailure("proxy", newError("failed to process outbound traffic").Base(context.Canceled))
+	reportOutboundFailure("proxy", newError("failed to process outbound traffic").Base(errors.New("connection refused")))
+	reportOutboundFailure("proxy", errors.New("connection refused"))
+	reportOutboundFailure("direct", nil)
+	if len(listener) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(listener))
+	}
+	event := <-listener
+	if event.Code != comm.EventOutboundFailure || event.Field("outbound") != "proxy" {
+		t.Fatalf("unexpected event %d %s", event.Code, event.FieldsJSON())
+	}
+}
+
+func TestTun2rayHandleEvent(t *testing.T) {
+	listener := listenEvents(t)
+	var messages []string
+	tun2ray := &Tun2ray{errorHandler: testMessageHandler(func(err string) {
+		messages = append(messages, err)
+	})}
+	tun2ray.handleEvent(&tun.Event{
+		Code:     comm.EventTunStopped,
+		Severity: comm.EventSeverityError,
+		Message:  "tcp forwarder stopped",
+		Fields:   map[string]string{"implementation": "system"},
+	})
+	event := <-listener
+	if event.Code != comm.EventTunStopped || event.Field("implementation") != "system" {
+		t.Fatalf("unexpected event %d %s", event.Code, event.FieldsJSON())
+	}
+	if len(messages) != 1 || messages[0] != "tcp forwarder stopped" {
+		t.Fatalf("unexpected messages %v", messages)
+	}
+}
+
+type testMessageHandler func(err string)
+
+func (h testMessageHandler) HandleError(err string) {
+	h(err)
+}
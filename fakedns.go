@@ -0,0 +1,441 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/net/dns/dnsmessage"
+	"libcore/comm"
+)
+
+const (
+	defaultFakeDNSRange4 = "198.18.0.0/15"
+	defaultFakeDNSRange6 = "fc00::/18"
+)
+
+// defaultFakeDNSExclude are names that must resolve to real addresses: LAN
+// names, time servers and connectivity checks.
+var defaultFakeDNSExclude = []string{
+	"local",
+	"lan",
+	"home.arpa",
+	"localhost",
+	"pool.ntp.org",
+	"time.android.com",
+	"time.apple.com",
+	"time.windows.com",
+	"connectivitycheck.gstatic.com",
+	"connectivitycheck.android.com",
+	"captive.apple.com",
+	"msftconnecttest.com",
+}
+
+// fakeDNSSaveDelay is how long new mappings wait to be saved, so a burst of
+// queries writes the cache once.
+var fakeDNSSaveDelay = 10 * time.Second
+
+// fakeIPPool hands out addresses from the configured ranges in order and
+// recycles the oldest mapping once a range is exhausted. New mappings are
+// saved to path after fakeDNSSaveDelay, so they survive the process being
+// killed.
+type fakeIPPool struct {
+	access    sync.Mutex
+	saveTimer *time.Timer
+	closed    bool
+	saving    sync.Mutex
+	path      string
+	ipv6Mode  int32
+	prefix4   netip.Prefix
+	prefix6   netip.Prefix
+	next4     netip.Addr
+	next6     netip.Addr
+	domains   map[netip.Addr]string
+	addresses map[string][2]netip.Addr
+	// exclude are domains that get real addresses, with their subdomains.
+	exclude []string
+}
+
+type fakeIPEntry struct {
+	Domain  string     `json:"domain"`
+	Address netip.Addr `json:"address"`
+}
+
+type fakeIPCache struct {
+	Range4  string        `json:"range4"`
+	Range6  string        `json:"range6"`
+	Next4   netip.Addr    `json:"next4"`
+	Next6   netip.Addr    `json:"next6"`
+	Entries []fakeIPEntry `json:"entries"`
+}
+
+// newFakeIPPool creates a pool for the ranges, which default to the benchmark
+// ones. exclude lists domains, one per line, answered by the real DNS in
+// addition to defaultFakeDNSExclude.
+func newFakeIPPool(range4 string, range6 string, exclude string, ipv6Mode int32, path string) (*fakeIPPool, error) {
+	if range4 == "" {
+		range4 = defaultFakeDNSRange4
+	}
+	if range6 == "" {
+		range6 = defaultFakeDNSRange6
+	}
+	prefix4, err := netip.ParsePrefix(range4)
+	if err != nil || !prefix4.Addr().Is4() || prefix4.Bits() > 30 {
+		return nil, newError("invalid fake dns range ", range4).Base(err)
+	}
+	prefix6, err := netip.ParsePrefix(range6)
+	if err != nil || !prefix6.Addr().Is6() || prefix6.Bits() > 126 {
+		return nil, newError("invalid fake dns range ", range6).Base(err)
+	}
+	p := &fakeIPPool{
+		path:      path,
+		ipv6Mode:  ipv6Mode,
+		prefix4:   prefix4.Masked(),
+		prefix6:   prefix6.Masked(),
+		domains:   make(map[netip.Addr]string),
+		addresses: make(map[string][2]netip.Addr),
+		exclude:   append([]string(nil), defaultFakeDNSExclude...),
+	}
+	for _, domain := range strings.Split(exclude, "\n") {
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+		if domain != "" {
+			p.exclude = append(p.exclude, domain)
+		}
+	}
+	// Skip the network and first address, the latter is often the gateway.
+	p.next4 = p.prefix4.Addr().Next().Next()
+	p.next6 = p.prefix6.Addr().Next().Next()
+	if path != "" {
+		err = p.load()
+		if err != nil && !os.IsNotExist(err) {
+			newError("failed to load fake dns cache, starting empty").Base(err).AtWarning().WriteToLog()
+		}
+	}
+	return p, nil
+}
+
+func (p *fakeIPPool) load() error {
+	content, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var cache fakeIPCache
+	err = json.Unmarshal(content, &cache)
+	if err != nil {
+		return err
+	}
+	// A cache for other ranges is of no use.
+	if cache.Range4 != p.prefix4.String() || cache.Range6 != p.prefix6.String() {
+		return nil
+	}
+	for _, entry := range cache.Entries {
+		if p.contains(entry.Address) {
+			p.store(entry.Domain, entry.Address)
+		}
+	}
+	if p.prefix4.Contains(cache.Next4) {
+		p.next4 = cache.Next4
+	}
+	if p.prefix6.Contains(cache.Next6) {
+		p.next6 = cache.Next6
+	}
+	return nil
+}
+
+func (p *fakeIPPool) save() error {
+	if p.path == "" {
+		return nil
+	}
+	p.saving.Lock()
+	defer p.saving.Unlock()
+	p.access.Lock()
+	cache := fakeIPCache{
+		Range4:  p.prefix4.String(),
+		Range6:  p.prefix6.String(),
+		Next4:   p.next4,
+		Next6:   p.next6,
+		Entries: make([]fakeIPEntry, 0, len(p.domains)),
+	}
+	for address, domain := range p.domains {
+		cache.Entries = append(cache.Entries, fakeIPEntry{domain, address})
+	}
+	p.access.Unlock()
+	content, err := json.Marshal(&cache)
+	if err != nil {
+		return err
+	}
+	temp := p.path + ".tmp"
+	err = os.WriteFile(temp, content, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, p.path)
+}
+
+// scheduleSave saves the pool after fakeDNSSaveDelay unless a save is
+// already pending. It must be called with access held.
+func (p *fakeIPPool) scheduleSave() {
+	if p.path == "" || p.closed || p.saveTimer != nil {
+		return
+	}
+	p.saveTimer = time.AfterFunc(fakeDNSSaveDelay, func() {
+		p.access.Lock()
+		p.saveTimer = nil
+		p.access.Unlock()
+		if err := p.save(); err != nil {
+			newError("failed to save fake dns cache").Base(err).AtWarning().WriteToLog()
+		}
+	})
+}
+
+// close saves the pool and stops saving new mappings.
+func (p *fakeIPPool) close() error {
+	p.access.Lock()
+	p.closed = true
+	if p.saveTimer != nil {
+		p.saveTimer.Stop()
+		p.saveTimer = nil
+	}
+	p.access.Unlock()
+	return p.save()
+}
+
+func (p *fakeIPPool) contains(address netip.Addr) bool {
+	return p.prefix4.Contains(address) || p.prefix6.Contains(address)
+}
+
+func (p *fakeIPPool) store(domain string, address netip.Addr) {
+	if old, loaded := p.domains[address]; loaded {
+		p.remove(old, address)
+	}
+	p.domains[address] = domain
+	addresses := p.addresses[domain]
+	if address.Is4() {
+		addresses[0] = address
+	} else {
+		addresses[1] = address
+	}
+	p.addresses[domain] = addresses
+}
+
+func (p *fakeIPPool) remove(domain string, address netip.Addr) {
+	addresses := p.addresses[domain]
+	if addresses[0] == address {
+		addresses[0] = netip.Addr{}
+	} else if addresses[1] == address {
+		addresses[1] = netip.Addr{}
+	}
+	if addresses[0].IsValid() || addresses[1].IsValid() {
+		p.addresses[domain] = addresses
+	} else {
+		delete(p.addresses, domain)
+	}
+}
+
+func (p *fakeIPPool) allocate(domain string, ipv6 bool) (netip.Addr, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	p.access.Lock()
+	defer p.access.Unlock()
+	index, prefix, next := 0, p.prefix4, &p.next4
+	if ipv6 {
+		index, prefix, next = 1, p.prefix6, &p.next6
+	}
+	if address := p.addresses[domain][index]; address.IsValid() {
+		return address, true
+	}
+	address := *next
+	*next = address.Next()
+	if !prefix.Contains(*next) {
+		*next = prefix.Addr().Next().Next()
+	}
+	p.store(domain, address)
+	p.scheduleSave()
+	return address, false
+}
+
+func (p *fakeIPPool) lookup(address netip.Addr) (string, bool) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	domain, loaded := p.domains[address.Unmap()]
+	return domain, loaded
+}
+
+// restore replaces a fake destination with its domain. It fails when the
+// address is fake but unknown, as there is nothing to connect to.
+func (p *fakeIPPool) restore(destination *v2rayNet.Destination) (string, error) {
+	if !destination.Address.Family().IsIP() {
+		return "", nil
+	}
+	address, _ := netip.AddrFromSlice(destination.Address.IP())
+	address = address.Unmap()
+	if !p.contains(address) {
+		return "", nil
+	}
+	domain, loaded := p.lookup(address)
+	if !loaded {
+		return "", newError("unknown fake address ", address)
+	}
+	destination.Address = v2rayNet.DomainAddress(domain)
+	return domain, nil
+}
+
+func (p *fakeIPPool) excluded(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, exclude := range p.exclude {
+		if domain == exclude || strings.HasSuffix(domain, "."+exclude) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange answers A and AAAA queries with fake addresses, other queries and
+// excluded domains return nil and are sent to the real DNS. cached is set if
+// the domain already had an address.
+func (p *fakeIPPool) exchange(query []byte) (response []byte, cached bool) {
+	var message dnsmessage.Message
+	err := message.Unpack(query)
+	if err != nil || message.Response || len(message.Questions) != 1 {
+		return nil, false
+	}
+	question := message.Questions[0]
+	if question.Class != dnsmessage.ClassINET || (question.Type != dnsmessage.TypeA && question.Type != dnsmessage.TypeAAAA) || p.excluded(question.Name.String()) {
+		return nil, false
+	}
+	message.Response = true
+	message.RecursionAvailable = true
+	message.Authoritative = false
+	message.Additionals = nil
+	header := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Type:  question.Type,
+		Class: question.Class,
+		TTL:   1,
+	}
+	switch {
+	case question.Type == dnsmessage.TypeA && p.ipv6Mode != comm.IPv6Only:
+		var address netip.Addr
+		address, cached = p.allocate(question.Name.String(), false)
+		message.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AResource{A: address.As4()}}}
+	case question.Type == dnsmessage.TypeAAAA && p.ipv6Mode != comm.IPv6Disable:
+		var address netip.Addr
+		address, cached = p.allocate(question.Name.String(), true)
+		message.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AAAAResource{AAAA: address.As16()}}}
+	}
+	response, err = message.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return response, cached
+}
+
+// exchangeFakeDNS answers query from the pool and logs it for uid, or returns
+// nil for queries left to the real DNS.
+func (t *Tun2ray) exchangeFakeDNS(query []byte, uid func() int32) []byte {
+	response, cached := t.fakeDNS.exchange(query)
+	if response == nil {
+		return nil
+	}
+	if dnsLog.enabled() {
+		if pending := newPendingDNSQuery(query, uid(), "fakedns"); pending != nil {
+			pending.entry.Cached = cached
+			pending.finish(response, nil)
+		}
+	}
+	return response
+}
+
+// fakeDNSConn answers DNS over TCP queries from the pool like UDP ones and
+// passes the others on. Responses from upstream are written as whole messages
+// so they don't interleave with the fake ones.
+type fakeDNSConn struct {
+	net.Conn
+	t        *Tun2ray
+	uid      int32
+	query    []byte
+	access   sync.Mutex
+	upstream []byte
+}
+
+func (c *fakeDNSConn) Read(p []byte) (int, error) {
+	for len(c.query) == 0 {
+		var length uint16
+		err := binary.Read(c.Conn, binary.BigEndian, &length)
+		if err != nil {
+			return 0, err
+		}
+		query := make([]byte, 2+int(length))
+		binary.BigEndian.PutUint16(query, length)
+		_, err = io.ReadFull(c.Conn, query[2:])
+		if err != nil {
+			return 0, err
+		}
+		response := c.t.exchangeFakeDNS(query[2:], func() int32 {
+			return c.uid
+		})
+		if response == nil {
+			c.query = query
+			break
+		}
+		packet := make([]byte, 2+len(response))
+		binary.BigEndian.PutUint16(packet, uint16(len(response)))
+		copy(packet[2:], response)
+		c.access.Lock()
+		_, err = c.Conn.Write(packet)
+		c.access.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.query)
+	c.query = c.query[n:]
+	return n, nil
+}
+
+func (c *fakeDNSConn) Write(p []byte) (int, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.upstream = append(c.upstream, p...)
+	for len(c.upstream) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(c.upstream))
+		if len(c.upstream) < size {
+			break
+		}
+		_, err := c.Conn.Write(c.upstream[:size])
+		if err != nil {
+			return 0, err
+		}
+		c.upstream = c.upstream[size:]
+	}
+	if len(c.upstream) == 0 {
+		c.upstream = nil
+	}
+	return len(p), nil
+}
+
+// fakeAddr carries a restored domain destination to dispatcherConn.writeTo.
+type fakeAddr struct {
+	destination v2rayNet.Destination
+}
+
+func (a *fakeAddr) Network() string {
+	return "udp"
+}
+
+func (a *fakeAddr) String() string {
+	return a.destination.NetAddr()
+}
+
+func destinationFromAddr(addr net.Addr) v2rayNet.Destination {
+	if addr, ok := addr.(*fakeAddr); ok {
+		return addr.destination
+	}
+	return v2rayNet.DestinationFromAddr(addr)
+}
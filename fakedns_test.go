@@ -0,0 +1,290 @@
+package libcore
+
+import (
+	"bytes"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun/tuntest"
+)
+
+func testDNSQuery(t *testing.T, domain string, qType dnsmessage.Type) []byte {
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x4242, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(domain + "."),
+			Type:  qType,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := message.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func testFakeAnswer(t *testing.T, pool *fakeIPPool, domain string, qType dnsmessage.Type) netip.Addr {
+	t.Helper()
+	response, _ := pool.exchange(testDNSQuery(t, domain, qType))
+	if response == nil {
+		t.Fatal("query not answered")
+	}
+	var message dnsmessage.Message
+	err := message.Unpack(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.ID != 0x4242 || !message.Response || len(message.Answers) != 1 {
+		t.Fatalf("unexpected response %+v", message)
+	}
+	switch body := message.Answers[0].Body.(type) {
+	case *dnsmessage.AResource:
+		return netip.AddrFrom4(body.A)
+	case *dnsmessage.AAAAResource:
+		return netip.AddrFrom16(body.AAAA)
+	}
+	t.Fatalf("unexpected answer %+v", message.Answers[0])
+	return netip.Addr{}
+}
+
+func TestFakeIPPool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fakedns.json")
+	pool, err := newFakeIPPool("198.18.0.0/30", "", "", comm.IPv6Enable, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := testFakeAnswer(t, pool, "example.com", dnsmessage.TypeA)
+	if first != netip.MustParseAddr("198.18.0.2") {
+		t.Fatalf("unexpected address %s", first)
+	}
+	if again := testFakeAnswer(t, pool, "Example.COM", dnsmessage.TypeA); again != first {
+		t.Fatalf("expected %s for the same domain, got %s", first, again)
+	}
+	ipv6 := testFakeAnswer(t, pool, "example.com", dnsmessage.TypeAAAA)
+	if !netip.MustParsePrefix(defaultFakeDNSRange6).Contains(ipv6) {
+		t.Fatalf("unexpected address %s", ipv6)
+	}
+	second := testFakeAnswer(t, pool, "example.org", dnsmessage.TypeA)
+	if second != netip.MustParseAddr("198.18.0.3") {
+		t.Fatalf("unexpected address %s", second)
+	}
+	if response, _ := pool.exchange(testDNSQuery(t, "example.com", dnsmessage.TypeTXT)); response != nil {
+		t.Fatal("txt query answered")
+	}
+
+	err = pool.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err = newFakeIPPool("198.18.0.0/30", "", "", comm.IPv6Enable, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain, _ := pool.lookup(second); domain != "example.org" {
+		t.Fatalf("mapping not restored, got %q", domain)
+	}
+
+	// The range is exhausted, so the oldest address is reused.
+	third := testFakeAnswer(t, pool, "example.net", dnsmessage.TypeA)
+	if third != first {
+		t.Fatalf("expected %s to be recycled, got %s", first, third)
+	}
+	if domain, _ := pool.lookup(first); domain != "example.net" {
+		t.Fatalf("unexpected domain %q", domain)
+	}
+	if domain, _ := pool.lookup(ipv6); domain != "example.com" {
+		t.Fatalf("ipv6 mapping lost, got %q", domain)
+	}
+}
+
+func TestFakeIPPoolSave(t *testing.T) {
+	oldDelay := fakeDNSSaveDelay
+	fakeDNSSaveDelay = 10 * time.Millisecond
+	t.Cleanup(func() {
+		fakeDNSSaveDelay = oldDelay
+	})
+	path := filepath.Join(t.TempDir(), "fakedns.json")
+	pool, err := newFakeIPPool("", "", "", comm.IPv6Enable, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.close()
+	address := testFakeAnswer(t, pool, "example.com", dnsmessage.TypeA)
+
+	// New mappings are saved without closing the pool.
+	deadline := time.Now().Add(testTimeout)
+	for {
+		restored, err := newFakeIPPool("", "", "", comm.IPv6Enable, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if domain, _ := restored.lookup(address); domain == "example.com" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("mapping not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTun2rayFakeDNS(t *testing.T) {
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationGVisor, func(config *TunConfig) {
+		config.FakeDNS = true
+	})
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	isTCP := func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.TCPProtocolNumber
+	}
+
+	err := device.Write(tuntest.UDPPacket(source, netip.MustParseAddrPort("172.19.0.2:53"), testDNSQuery(t, "echo.test", dnsmessage.TypeA)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.UDPProtocolNumber
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message dnsmessage.Message
+	err = message.Unpack(reply.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(message.Answers) != 1 {
+		t.Fatalf("unexpected dns response %+v", message)
+	}
+	address := netip.AddrFrom4(message.Answers[0].Body.(*dnsmessage.AResource).A)
+	destination := netip.AddrPortFrom(address, port)
+
+	source6 := netip.MustParseAddrPort("[fdfe:dcba:9876::1]:40000")
+	err = device.Write(tuntest.UDPPacket(source6, netip.MustParseAddrPort("[fdfe:dcba:9876::2]:53"), testDNSQuery(t, "echo.test", dnsmessage.TypeAAAA)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err = device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.UDPProtocolNumber
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = message.Unpack(reply.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(message.Answers) != 1 || !netip.MustParsePrefix(defaultFakeDNSRange6).Contains(netip.AddrFrom16(message.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA)) {
+		t.Fatalf("unexpected dns response over ipv6 %+v", message)
+	}
+
+	err = device.Write(tuntest.TCPPacket(source, destination, header.TCPFlagSyn, 1000, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	synAck, err := device.Expect(testTimeout, isTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = device.Write(tuntest.TCPPacket(source, destination, header.TCPFlagAck|header.TCPFlagPsh, 1001, synAck.Seq+1, []byte("ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err = device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return isTCP(packet) && len(packet.Payload) > 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply.Payload, []byte("ping")) {
+		t.Fatalf("unexpected reply %q", reply.Payload)
+	}
+
+	connections := tun.GetConnections()
+	if !connections.HasNext() {
+		t.Fatal("connection missing from connection table")
+	}
+	if connection := connections.Next(); connection.Domain != "echo.test" {
+		t.Fatalf("unexpected domain %q", connection.Domain)
+	}
+}
+
+func TestFakeIPPoolExclude(t *testing.T) {
+	pool, err := newFakeIPPool("", "", "corp.example\n", comm.IPv6Enable, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"corp.example", "Host.Corp.Example", "0.pool.ntp.org", "printer.lan"} {
+		if response, _ := pool.exchange(testDNSQuery(t, domain, dnsmessage.TypeA)); response != nil {
+			t.Fatalf("excluded domain %s answered", domain)
+		}
+	}
+	testFakeAnswer(t, pool, "notcorp.example", dnsmessage.TypeA)
+}
+
+// Queries over TCP get the same fake addresses as over UDP, others are passed
+// on to the echoing upstream in whole messages.
+func TestTun2rayFakeDNSTCP(t *testing.T) {
+	_, device, _ := newTestTun2ray(t, comm.TunImplementationGVisor, func(config *TunConfig) {
+		config.FakeDNS = true
+	})
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	destination := netip.MustParseAddrPort("172.19.0.2:53")
+	isTCP := func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.TCPProtocolNumber
+	}
+	framed := func(message []byte) []byte {
+		return append([]byte{byte(len(message) >> 8), byte(len(message))}, message...)
+	}
+
+	err := device.Write(tuntest.UDPPacket(netip.MustParseAddrPort("172.19.0.1:40001"), destination, testDNSQuery(t, "echo.test", dnsmessage.TypeA)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.UDPProtocolNumber
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpResponse := reply.Payload
+
+	err = device.Write(tuntest.TCPPacket(source, destination, header.TCPFlagSyn, 1000, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	synAck, err := device.Expect(testTimeout, isTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := uint32(1001)
+	exchange := func(query []byte) []byte {
+		t.Helper()
+		err := device.Write(tuntest.TCPPacket(source, destination, header.TCPFlagAck|header.TCPFlagPsh, seq, synAck.Seq+1, framed(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq += uint32(len(query) + 2)
+		reply, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+			return isTCP(packet) && len(packet.Payload) > 0
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply.Payload
+	}
+
+	if response := exchange(testDNSQuery(t, "echo.test", dnsmessage.TypeA)); !bytes.Equal(response, framed(udpResponse)) {
+		t.Fatalf("tcp response %x differs from udp %x", response, udpResponse)
+	}
+	txt := testDNSQuery(t, "echo.test", dnsmessage.TypeTXT)
+	if response := exchange(txt); !bytes.Equal(response, framed(txt)) {
+		t.Fatalf("txt query not passed on, got %x", response)
+	}
+}
@@ -0,0 +1,183 @@
+package libcore
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"libcore/comm"
+	"libcore/tun"
+)
+
+const (
+	FirewallActionAllow int32 = iota
+	FirewallActionDrop
+	FirewallActionReject
+)
+
+// Dropped TCP connections are already established by the stack, they are
+// held open without answering for this long before being reset. Connections
+// over the limit are reset at once, so a port scan can't use up descriptors.
+const (
+	firewallDropTimeout = time.Minute
+	firewallMaxDrops    = 64
+)
+
+var firewallDrops = make(chan struct{}, firewallMaxDrops)
+
+// FirewallRule matches new connections before they are dispatched. A zero
+// Uid and empty strings match anything. Uids are only known with DumpUID or
+// TrafficStats enabled.
+type FirewallRule struct {
+	Uid         int32
+	NetworkType string
+	WifiSSID    string
+	// Protocol is tcp or udp.
+	Protocol string
+	// Ports lists destination ports and ranges, like "53,8000-8080".
+	Ports  string
+	Action int32
+}
+
+type firewallRule struct {
+	FirewallRule
+	network v2rayNet.Network
+	ports   [][2]v2rayNet.Port
+}
+
+func parsePortRanges(ports string) ([][2]v2rayNet.Port, error) {
+	var ranges [][2]v2rayNet.Port
+	for _, item := range strings.Split(ports, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(item, "-")
+		if !isRange {
+			to = from
+		}
+		fromPort, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+		if err != nil {
+			return nil, newError("invalid port ", item).Base(err)
+		}
+		toPort, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil || toPort < fromPort {
+			return nil, newError("invalid port range ", item).Base(err)
+		}
+		ranges = append(ranges, [2]v2rayNet.Port{v2rayNet.Port(fromPort), v2rayNet.Port(toPort)})
+	}
+	return ranges, nil
+}
+
+// AddFirewallRule appends rule. Rules are checked in order and the first
+// match decides, connections matching none are allowed. Changes apply to new
+// connections only.
+func (t *Tun2ray) AddFirewallRule(rule *FirewallRule) error {
+	compiled := &firewallRule{FirewallRule: *rule}
+	switch strings.ToLower(rule.Protocol) {
+	case "":
+	case "tcp":
+		compiled.network = v2rayNet.Network_TCP
+	case "udp":
+		compiled.network = v2rayNet.Network_UDP
+	default:
+		return newError("unknown firewall protocol ", rule.Protocol)
+	}
+	if rule.Action < FirewallActionAllow || rule.Action > FirewallActionReject {
+		return newError("unknown firewall action ", rule.Action)
+	}
+	var err error
+	compiled.ports, err = parsePortRanges(rule.Ports)
+	if err != nil {
+		return err
+	}
+	t.firewallAccess.Lock()
+	defer t.firewallAccess.Unlock()
+	t.firewallRules = append(t.firewallRules, compiled)
+	return nil
+}
+
+func (t *Tun2ray) ClearFirewallRules() {
+	t.firewallAccess.Lock()
+	defer t.firewallAccess.Unlock()
+	t.firewallRules = nil
+}
+
+func (r *firewallRule) match(uid uint16, destination v2rayNet.Destination) bool {
+	if r.Uid != 0 && r.Uid != int32(uid) {
+		return false
+	}
+	if r.network != v2rayNet.Network_Unknown && r.network != destination.Network {
+		return false
+	}
+	if r.NetworkType != "" && r.NetworkType != networkType {
+		return false
+	}
+	if r.WifiSSID != "" && r.WifiSSID != wifiSSID {
+		return false
+	}
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, ports := range r.ports {
+		if destination.Port >= ports[0] && destination.Port <= ports[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tun2ray) firewallAction(uid uint16, source v2rayNet.Destination, destination v2rayNet.Destination) int32 {
+	t.firewallAccess.RLock()
+	defer t.firewallAccess.RUnlock()
+	for _, rule := range t.firewallRules {
+		if !rule.match(uid, destination) {
+			continue
+		}
+		if rule.Action != FirewallActionAllow {
+			newError("[", strings.ToUpper(destination.Network.SystemString()), "] ", source.NetAddr(), " ==> ", destination.NetAddr(), " of uid ", uid, " blocked by firewall").AtDebug().WriteToLog()
+		}
+		return rule.Action
+	}
+	return FirewallActionAllow
+}
+
+// resetConn closes conn with a RST where the stack supports it.
+func resetConn(conn net.Conn) {
+	switch conn := conn.(type) {
+	case *net.TCPConn:
+		_ = conn.SetLinger(0)
+	case interface{ Abort() }:
+		conn.Abort()
+		return
+	}
+	comm.CloseIgnore(conn)
+}
+
+// dropConn discards what the application sends, so the connection looks like
+// the peer never answers.
+func dropConn(conn net.Conn) {
+	select {
+	case firewallDrops <- struct{}{}:
+		defer func() {
+			<-firewallDrops
+		}()
+	default:
+		resetConn(conn)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(firewallDropTimeout))
+	_, _ = io.Copy(io.Discard, conn)
+	resetConn(conn)
+}
+
+func rejectPacket(closer io.Closer, reason tun.Unreachable) {
+	if rejecter, ok := closer.(tun.Rejecter); ok {
+		if err := rejecter.Reject(reason); err != nil {
+			newError("failed to reject packet").Base(err).AtWarning().WriteToLog()
+		}
+	}
+}
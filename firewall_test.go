@@ -0,0 +1,235 @@
+package libcore
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun/tuntest"
+)
+
+func TestFirewallRuleMatch(t *testing.T) {
+	tun := &Tun2ray{}
+	for _, rule := range []*FirewallRule{
+		{Uid: 10005, Protocol: "udp", Ports: "53, 8000-8080", Action: FirewallActionReject},
+		{Uid: 10005, NetworkType: "cellular", Action: FirewallActionDrop},
+		{Protocol: "tcp", Ports: "443", Action: FirewallActionAllow},
+		{Protocol: "tcp", Action: FirewallActionDrop},
+	} {
+		if err := tun.AddFirewallRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rule := range []*FirewallRule{
+		{Protocol: "icmp"},
+		{Ports: "80-79"},
+		{Ports: "http"},
+		{Action: 3},
+	} {
+		if err := tun.AddFirewallRule(rule); err == nil {
+			t.Fatalf("expected error for rule %+v", rule)
+		}
+	}
+
+	oldNetworkType := networkType
+	t.Cleanup(func() {
+		networkType = oldNetworkType
+	})
+	networkType = "wifi"
+	source := v2rayNet.UDPDestination(v2rayNet.ParseAddress("172.19.0.1"), 40000)
+	for _, test := range []struct {
+		uid         uint16
+		destination v2rayNet.Destination
+		action      int32
+	}{
+		{10005, v2rayNet.UDPDestination(v2rayNet.ParseAddress("1.1.1.1"), 8080), FirewallActionReject},
+		{10005, v2rayNet.UDPDestination(v2rayNet.ParseAddress("1.1.1.1"), 8081), FirewallActionAllow},
+		{10006, v2rayNet.UDPDestination(v2rayNet.ParseAddress("1.1.1.1"), 53), FirewallActionAllow},
+		{10006, v2rayNet.TCPDestination(v2rayNet.ParseAddress("1.1.1.1"), 443), FirewallActionAllow},
+		{10006, v2rayNet.TCPDestination(v2rayNet.ParseAddress("1.1.1.1"), 80), FirewallActionDrop},
+	} {
+		if action := tun.firewallAction(test.uid, source, test.destination); action != test.action {
+			t.Fatalf("uid %d to %s: expected action %d, got %d", test.uid, test.destination, test.action, action)
+		}
+	}
+	networkType = "cellular"
+	if action := tun.firewallAction(10005, source, v2rayNet.UDPDestination(v2rayNet.ParseAddress("1.1.1.1"), 8081)); action != FirewallActionDrop {
+		t.Fatalf("expected drop on cellular, got %d", action)
+	}
+
+	tun.ClearFirewallRules()
+	if action := tun.firewallAction(10005, source, v2rayNet.UDPDestination(v2rayNet.ParseAddress("1.1.1.1"), 53)); action != FirewallActionAllow {
+		t.Fatalf("expected allow without rules, got %d", action)
+	}
+}
+
+func TestTun2rayFirewallUDP(t *testing.T) {
+	SetUidDumper(testUidDumper{10005}, false)
+	t.Cleanup(func() {
+		SetUidDumper(nil, false)
+	})
+	for _, i := range testImplementations {
+		t.Run(i.name, func(t *testing.T) {
+			tun, device, port := newTestTun2ray(t, i.implementation, func(config *TunConfig) {
+				config.DumpUID = true
+			})
+			source := netip.MustParseAddrPort("172.19.0.1:40000")
+			destination := netip.AddrPortFrom(netip.MustParseAddr("198.18.0.1"), port)
+
+			err := tun.AddFirewallRule(&FirewallRule{Uid: 10005, Protocol: "udp", Action: FirewallActionReject})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = device.Write(tuntest.UDPPacket(source, destination, []byte("ping")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			unreachable, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+				return packet.Protocol == header.ICMPv4ProtocolNumber
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unreachable.ICMPType != uint8(header.ICMPv4DstUnreachable) || unreachable.ICMPCode != uint8(header.ICMPv4PortUnreachable) {
+				t.Fatalf("unexpected icmp type %d code %d", unreachable.ICMPType, unreachable.ICMPCode)
+			}
+			if unreachable.Source.Addr() != destination.Addr() || unreachable.Destination.Addr() != source.Addr() {
+				t.Fatalf("unexpected icmp %s -> %s", unreachable.Source, unreachable.Destination)
+			}
+			// The quote is truncated after the UDP header, so it is not a valid packet.
+			quoted := header.IPv4(unreachable.Payload)
+			quotedUdp := header.UDP(quoted[quoted.HeaderLength():])
+			quotedSource, _ := netip.AddrFromSlice([]byte(quoted.SourceAddress()))
+			quotedDestination, _ := netip.AddrFromSlice([]byte(quoted.DestinationAddress()))
+			if netip.AddrPortFrom(quotedSource, quotedUdp.SourcePort()) != source || netip.AddrPortFrom(quotedDestination, quotedUdp.DestinationPort()) != destination {
+				t.Fatalf("unexpected quoted packet %s -> %s", quotedSource, quotedDestination)
+			}
+
+			tun.ClearFirewallRules()
+			err = tun.AddFirewallRule(&FirewallRule{Uid: 10005, Action: FirewallActionDrop})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = device.Write(tuntest.UDPPacket(source, destination, []byte("ping")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = device.Expect(200*time.Millisecond, func(*tuntest.Packet) bool {
+				return true
+			})
+			if err != tuntest.ErrTimeout {
+				t.Fatalf("expected dropped packet to go unanswered, got %v", err)
+			}
+			if tun.GetConnections().HasNext() {
+				t.Fatal("dropped packet opened a session")
+			}
+		})
+	}
+}
+
+func TestTun2rayFirewallPing(t *testing.T) {
+	for _, i := range testImplementations {
+		t.Run(i.name, func(t *testing.T) {
+			tun, device, _ := newTestTun2ray(t, i.implementation)
+			source := netip.MustParseAddr("172.19.0.1")
+			destination := netip.MustParseAddr("198.18.0.1")
+
+			// Rules with a protocol are for udp and tcp only.
+			err := tun.AddFirewallRule(&FirewallRule{Protocol: "udp", Action: FirewallActionDrop})
+			if err == nil {
+				err = tun.AddFirewallRule(&FirewallRule{Action: FirewallActionReject})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A traceroute probe is not sent out either.
+			request := tuntest.ICMPEchoPacket(source, destination, 0x1234, 1, []byte("ping"))
+			tuntest.SetTTL(request, 3)
+			err = device.Write(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unreachable, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+				return packet.Protocol == header.ICMPv4ProtocolNumber
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unreachable.ICMPType != uint8(header.ICMPv4DstUnreachable) || unreachable.ICMPCode != uint8(header.ICMPv4AdminProhibited) {
+				t.Fatalf("unexpected icmp type %d code %d", unreachable.ICMPType, unreachable.ICMPCode)
+			}
+			if unreachable.Source.Addr() != destination || unreachable.Destination.Addr() != source {
+				t.Fatalf("unexpected icmp %s -> %s", unreachable.Source, unreachable.Destination)
+			}
+		})
+	}
+}
+
+func TestTun2rayFirewallTCP(t *testing.T) {
+	SetUidDumper(testUidDumper{10005}, false)
+	t.Cleanup(func() {
+		SetUidDumper(nil, false)
+	})
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationGVisor, func(config *TunConfig) {
+		config.DumpUID = true
+	})
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	destination := netip.AddrPortFrom(netip.MustParseAddr("198.18.0.1"), port)
+	isTCP := func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.TCPProtocolNumber
+	}
+
+	err := tun.AddFirewallRule(&FirewallRule{Uid: 10005, Protocol: "tcp", Ports: "1-65535", Action: FirewallActionReject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = device.Write(tuntest.TCPPacket(source, destination, header.TCPFlagSyn, 1000, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	synAck, err := device.Expect(testTimeout, isTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = device.Write(tuntest.TCPPacket(source, destination, header.TCPFlagAck, 1001, synAck.Seq+1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return isTCP(packet) && packet.TCPFlags&header.TCPFlagRst != 0
+	})
+	if err != nil {
+		t.Fatalf("expected reset, got %v", err)
+	}
+}
+
+func TestFirewallDropLimit(t *testing.T) {
+	for i := 0; i < firewallMaxDrops; i++ {
+		firewallDrops <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < firewallMaxDrops; i++ {
+			<-firewallDrops
+		}
+	}()
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		dropConn(server)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection over the drop limit held open")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected closed connection, got %v", err)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"libcore/comm"
+	"libcore/tun"
 )
 
 var _ stack.InjectableLinkEndpoint = (*rwEndpoint)(nil)
@@ -22,12 +24,20 @@ type rwEndpoint struct {
 
 	inbound    *readVDispatcher
 	dispatcher stack.NetworkDispatcher
+
+	eventHandler func(event *tun.Event)
+
+	// access keeps writes, which may come from ping handlers after the stack
+	// is closed, off a closed descriptor.
+	access sync.RWMutex
+	closed bool
 }
 
-func newRwEndpoint(dev int32, mtu int32) (*rwEndpoint, error) {
+func newRwEndpoint(dev int32, mtu int32, eventHandler func(event *tun.Event)) (*rwEndpoint, error) {
 	e := &rwEndpoint{
-		fd:  int(dev),
-		mtu: uint32(mtu),
+		fd:           int(dev),
+		mtu:          uint32(mtu),
+		eventHandler: eventHandler,
 	}
 	i, err := newReadVDispatcher(e.fd, e)
 	if err != nil {
@@ -42,6 +52,11 @@ func (e *rwEndpoint) InjectInbound(networkProtocol tcpip.NetworkProtocolNumber,
 }
 
 func (e *rwEndpoint) InjectOutbound(dest tcpip.Address, packet []byte) tcpip.Error {
+	e.access.RLock()
+	defer e.access.RUnlock()
+	if e.closed {
+		return &tcpip.ErrClosedForSend{}
+	}
 	return rawfile.NonBlockingWrite(e.fd, packet)
 }
 
@@ -58,7 +73,9 @@ func (e *rwEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
 		e.dispatcher = dispatcher
 		e.wg.Add(1)
 		go func() {
-			e.dispatchLoop(e.inbound)
+			if err := e.dispatchLoop(e.inbound); err != nil {
+				e.stopped(err)
+			}
 			e.wg.Done()
 		}()
 	}
@@ -80,6 +97,26 @@ func (e *rwEndpoint) dispatchLoop(inboundDispatcher *readVDispatcher) tcpip.Erro
 	}
 }
 
+// stopped reports the dispatch loop ending with err. Loops stopped by Attach
+// end without an error.
+func (e *rwEndpoint) stopped(err tcpip.Error) {
+	newErr := newError("read packet failed: ", err.String())
+	newErr.AtError().WriteToLog()
+	if e.eventHandler == nil {
+		return
+	}
+	// The handler may close the stack, which waits for this loop.
+	go e.eventHandler(&tun.Event{
+		Code:     comm.EventTunStopped,
+		Severity: comm.EventSeverityError,
+		Message:  newErr.String(),
+		Fields: map[string]string{
+			"implementation": "gvisor",
+			"error":          err.String(),
+		},
+	})
+}
+
 // WritePackets writes packets back into io.ReadWriter.
 func (e *rwEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
 	// Preallocate to avoid repeated reallocation as we append to batch.
@@ -94,6 +131,11 @@ func (e *rwEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error
 			batch = rawfile.AppendIovecFromBytes(batch, v, rawfile.MaxIovs)
 		}
 	}
+	e.access.RLock()
+	defer e.access.RUnlock()
+	if e.closed {
+		return 0, &tcpip.ErrClosedForSend{}
+	}
 	err := rawfile.NonBlockingWriteIovec(e.fd, batch)
 	if err != nil {
 		return 0, err
@@ -130,6 +172,14 @@ func (*rwEndpoint) ARPHardwareType() header.ARPHardwareType {
 func (e *rwEndpoint) AddHeader(*stack.PacketBuffer) {
 }
 
+// close closes the descriptor once the dispatch loop is stopped.
+func (e *rwEndpoint) close() error {
+	e.access.Lock()
+	defer e.access.Unlock()
+	e.closed = true
+	return unix.Close(e.fd)
+}
+
 // Wait implements stack.LinkEndpoint.Wait.
 func (e *rwEndpoint) Wait() {
 	e.wg.Wait()
@@ -2,14 +2,12 @@ package gvisor
 
 import (
 	"errors"
-	"io"
-	"os"
 
 	"github.com/sirupsen/logrus"
 	"github.com/v2fly/v2ray-core/v5/common/buf"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
-	"gvisor.dev/gvisor/pkg/tcpip/link/sniffer"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
@@ -26,29 +24,26 @@ var _ tun.Tun = (*GVisor)(nil)
 
 type GVisor struct {
 	Endpoint stack.LinkEndpoint
-	PcapFile *os.File
 	Stack    *stack.Stack
+	device   *rwEndpoint
 }
 
 func (t *GVisor) Close() error {
 	t.Stack.Close()
-	if t.PcapFile != nil {
-		_ = t.PcapFile.Close()
-	}
-	return nil
+	// Stack.Close leaves the link endpoint reading from the descriptor.
+	t.Endpoint.Attach(nil)
+	return t.device.close()
 }
 
 const DefaultNIC tcpip.NICID = 0x01
 
-func New(dev int32, mtu int32, handler tun.Handler, nicId tcpip.NICID, pcap bool, pcapFile *os.File, snapLen uint32, ipv6Mode int32) (*GVisor, error) {
-	var endpoint stack.LinkEndpoint
-	endpoint, _ = newRwEndpoint(dev, mtu)
-	if pcap {
-		pcapEndpoint, err := sniffer.NewWithWriter(endpoint, &pcapFileWrapper{pcapFile}, snapLen)
-		if err != nil {
-			return nil, err
-		}
-		endpoint = pcapEndpoint
+// New starts a stack on the non-blocking descriptor dev, which is closed with
+// the stack.
+func New(dev int32, mtu int32, handler tun.Handler, nicId tcpip.NICID, capture tun.PacketCapture, ipv6Mode int32, udpLimiter *tun.PacketLimiter, eventHandler func(event *tun.Event)) (*GVisor, error) {
+	device, _ := newRwEndpoint(dev, mtu, eventHandler)
+	var endpoint stack.LinkEndpoint = device
+	if capture != nil {
+		endpoint = newCaptureEndpoint(endpoint, capture)
 	}
 	var o stack.Options
 	switch ipv6Mode {
@@ -119,25 +114,46 @@ func New(dev int32, mtu int32, handler tun.Handler, nicId tcpip.NICID, pcap bool
 	s.SetTransportProtocolOption(tcp.ProtocolNumber, &mOpt)
 
 	gTcpHandler(s, handler)
-	gUdpHandler(s, handler)
+	gUdpHandler(s, handler, udpLimiter)
 	gIcmpHandler(s, endpoint, handler)
 	gMust(s.CreateNIC(nicId, endpoint))
 	gMust(s.SetSpoofing(nicId, true))
 	gMust(s.SetPromiscuousMode(nicId, true))
 
-	return &GVisor{endpoint, pcapFile, s}, nil
+	return &GVisor{endpoint, s, device}, nil
 }
 
-type pcapFileWrapper struct {
-	io.Writer
+// captureEndpoint passes the packets exchanged with the device to a capture.
+type captureEndpoint struct {
+	nested.Endpoint
+	capture tun.PacketCapture
 }
 
-func (w *pcapFileWrapper) Write(p []byte) (n int, err error) {
-	n, err = w.Writer.Write(p)
-	if err != nil {
-		logrus.Debug("write pcap file failed: ", err)
+func newCaptureEndpoint(lower stack.LinkEndpoint, capture tun.PacketCapture) stack.LinkEndpoint {
+	e := &captureEndpoint{capture: capture}
+	e.Endpoint.Init(lower, e)
+	return e
+}
+
+func (e *captureEndpoint) capturePacket(inbound bool, pkt *stack.PacketBuffer) {
+	views := pkt.Views()
+	packet := make([][]byte, len(views))
+	for i, v := range views {
+		packet[i] = v
+	}
+	e.capture.Capture(inbound, packet)
+}
+
+func (e *captureEndpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	e.capturePacket(true, pkt)
+	e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+}
+
+func (e *captureEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
+		e.capturePacket(false, pkt)
 	}
-	return n, nil
+	return e.Endpoint.WritePackets(pkts)
 }
 
 func gMust(err tcpip.Error) {
@@ -0,0 +1,315 @@
+package gvisor
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	"github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun"
+	"libcore/tun/tuntest"
+)
+
+const timeout = 5 * time.Second
+
+type tcpConnection struct {
+	source      net.Destination
+	destination net.Destination
+	conn        net.Conn
+}
+
+type udpPacket struct {
+	source      net.Destination
+	destination net.Destination
+	payload     []byte
+	writeBack   func([]byte, *net.UDPAddr) (int, error)
+}
+
+type testHandler struct {
+	connections chan tcpConnection
+	packets     chan udpPacket
+	pings       chan net.Destination
+	access      sync.Mutex
+	ping        func(closer io.Closer) bool
+}
+
+func (h *testHandler) NewConnection(source net.Destination, destination net.Destination, conn net.Conn) {
+	h.connections <- tcpConnection{source, destination, conn}
+}
+
+func (h *testHandler) NewPacket(source net.Destination, destination net.Destination, data *buf.Buffer, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) {
+	h.packets <- udpPacket{source, destination, append([]byte(nil), data.Bytes()...), writeBack}
+	data.Release()
+}
+
+func (h *testHandler) NewPingPacket(source net.Destination, destination net.Destination, message *buf.Buffer, writeBack func([]byte) error, closer io.Closer) bool {
+	h.pings <- destination
+	h.access.Lock()
+	ping := h.ping
+	h.access.Unlock()
+	if ping != nil {
+		return ping(closer)
+	}
+	return false
+}
+
+// setPing answers the pings with ping, it is set after the stack started.
+func (h *testHandler) setPing(ping func(closer io.Closer) bool) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	h.ping = ping
+}
+
+func newTestTun(t *testing.T) (*tuntest.Device, *testHandler) {
+	device, err := tuntest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &testHandler{connections: make(chan tcpConnection, 1), packets: make(chan udpPacket, 1), pings: make(chan net.Destination, 1)}
+	tun, err := New(device.Detach(), 1500, handler, DefaultNIC, nil, comm.IPv6Enable, nil, func(event *tun.Event) {
+		t.Error(event.Message)
+	})
+	if err != nil {
+		device.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tun.Close()
+		device.Close()
+	})
+	return device, handler
+}
+
+var cases = []struct {
+	name        string
+	source      netip.AddrPort
+	destination netip.AddrPort
+}{
+	{"ipv4", netip.MustParseAddrPort("172.19.0.1:40000"), netip.MustParseAddrPort("1.1.1.1:443")},
+	{"ipv6", netip.MustParseAddrPort("[fdfe:dcba:9876::1]:40000"), netip.MustParseAddrPort("[2606:4700::1111]:443")},
+}
+
+func TestTCP(t *testing.T) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			device, handler := newTestTun(t)
+			isTCP := func(packet *tuntest.Packet) bool {
+				return packet.Protocol == header.TCPProtocolNumber
+			}
+
+			err := device.Write(tuntest.TCPPacket(c.source, c.destination, header.TCPFlagSyn, 1000, 0, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			synAck, err := device.Expect(timeout, isTCP)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if synAck.Source != c.destination || synAck.Destination != c.source {
+				t.Fatalf("unexpected syn-ack %s -> %s", synAck.Source, synAck.Destination)
+			}
+			if synAck.TCPFlags != header.TCPFlagSyn|header.TCPFlagAck || synAck.Ack != 1001 {
+				t.Fatalf("unexpected syn-ack flags %s ack %d", synAck.TCPFlags, synAck.Ack)
+			}
+
+			err = device.Write(tuntest.TCPPacket(c.source, c.destination, header.TCPFlagAck|header.TCPFlagPsh, 1001, synAck.Seq+1, []byte("ping")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var connection tcpConnection
+			select {
+			case connection = <-handler.connections:
+			case <-time.After(timeout):
+				t.Fatal("tcp connection not dispatched")
+			}
+			defer connection.conn.Close()
+			if connection.source.NetAddr() != c.source.String() || connection.destination.NetAddr() != c.destination.String() {
+				t.Fatalf("unexpected connection %s -> %s", connection.source.NetAddr(), connection.destination.NetAddr())
+			}
+			payload := make([]byte, 4)
+			_, err = io.ReadFull(connection.conn, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, []byte("ping")) {
+				t.Fatalf("unexpected payload %q", payload)
+			}
+
+			_, err = connection.conn.Write([]byte("pong"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply, err := device.Expect(timeout, func(packet *tuntest.Packet) bool {
+				return isTCP(packet) && len(packet.Payload) > 0
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Source != c.destination || reply.Destination != c.source || !bytes.Equal(reply.Payload, []byte("pong")) {
+				t.Fatalf("unexpected reply %s -> %s %q", reply.Source, reply.Destination, reply.Payload)
+			}
+		})
+	}
+}
+
+func TestUDP(t *testing.T) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			device, handler := newTestTun(t)
+			err := device.Write(tuntest.UDPPacket(c.source, c.destination, []byte("ping")))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var packet udpPacket
+			select {
+			case packet = <-handler.packets:
+			case <-time.After(timeout):
+				t.Fatal("udp packet not dispatched")
+			}
+			if packet.source.NetAddr() != c.source.String() || packet.destination.NetAddr() != c.destination.String() {
+				t.Fatalf("unexpected session %s -> %s", packet.source.NetAddr(), packet.destination.NetAddr())
+			}
+			if !bytes.Equal(packet.payload, []byte("ping")) {
+				t.Fatalf("unexpected payload %q", packet.payload)
+			}
+
+			_, err = packet.writeBack([]byte("pong"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply, err := device.Expect(timeout, func(packet *tuntest.Packet) bool {
+				return packet.Protocol == header.UDPProtocolNumber
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Source != c.destination || reply.Destination != c.source || !bytes.Equal(reply.Payload, []byte("pong")) {
+				t.Fatalf("unexpected reply %s -> %s %q", reply.Source, reply.Destination, reply.Payload)
+			}
+		})
+	}
+}
+
+func TestICMPEcho(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		source      netip.Addr
+		destination netip.Addr
+		reply       uint8
+	}{
+		{"ipv4", netip.MustParseAddr("172.19.0.1"), netip.MustParseAddr("1.1.1.1"), uint8(header.ICMPv4EchoReply)},
+		{"ipv6", netip.MustParseAddr("fdfe:dcba:9876::1"), netip.MustParseAddr("2606:4700::1111"), uint8(header.ICMPv6EchoReply)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			device, handler := newTestTun(t)
+			err := device.Write(tuntest.ICMPEchoPacket(c.source, c.destination, 0x1234, 1, []byte("ping")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case destination := <-handler.pings:
+				if destination.Address.IP().String() != c.destination.String() {
+					t.Fatalf("unexpected ping destination %s", destination.Address)
+				}
+			case <-time.After(timeout):
+				t.Fatal("ping not dispatched")
+			}
+
+			reply, err := device.Expect(timeout, func(packet *tuntest.Packet) bool {
+				return packet.ICMPType == c.reply
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Source.Addr() != c.destination || reply.Destination.Addr() != c.source {
+				t.Fatalf("unexpected echo reply %s -> %s", reply.Source, reply.Destination)
+			}
+			if reply.Ident != 0x1234 || reply.Sequence != 1 || !bytes.Equal(reply.Payload, []byte("ping")) {
+				t.Fatalf("unexpected echo reply ident %d sequence %d payload %q", reply.Ident, reply.Sequence, reply.Payload)
+			}
+		})
+	}
+}
+
+func TestICMPTimeExceeded(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		source      netip.Addr
+		destination netip.Addr
+		router      netip.Addr
+		icmpType    uint8
+	}{
+		{"ipv4", netip.MustParseAddr("172.19.0.1"), netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("10.0.0.1"), uint8(header.ICMPv4TimeExceeded)},
+		{"ipv6", netip.MustParseAddr("fdfe:dcba:9876::1"), netip.MustParseAddr("2606:4700::1111"), netip.MustParseAddr("2001:db8::1"), uint8(header.ICMPv6TimeExceeded)},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			device, handler := newTestTun(t)
+			handler.setPing(func(closer io.Closer) bool {
+				writer := closer.(tun.ICMPErrorWriter)
+				if writer.TTL() != 3 {
+					t.Errorf("unexpected ttl %d", writer.TTL())
+				}
+				if err := writer.WriteICMPError(c.router, c.icmpType, 0); err != nil {
+					t.Error(err)
+				}
+				closer.Close()
+				return true
+			})
+			request := tuntest.ICMPEchoPacket(c.source, c.destination, 0x1234, 1, []byte("ping"))
+			tuntest.SetTTL(request, 3)
+			err := device.Write(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reply, err := device.Expect(timeout, func(packet *tuntest.Packet) bool {
+				return packet.ICMPType == c.icmpType
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Source.Addr() != c.router || reply.Destination.Addr() != c.source {
+				t.Fatalf("unexpected time exceeded %s -> %s", reply.Source, reply.Destination)
+			}
+			if !bytes.Equal(reply.Payload, request[:len(request)-len("ping")]) {
+				t.Fatalf("unexpected quoted request %x", reply.Payload)
+			}
+		})
+	}
+}
+
+func TestTunStopped(t *testing.T) {
+	// Reading the write end of a pipe fails like a revoked device.
+	// The stack closes the write end.
+	fds := make([]int, 2)
+	err := unix.Pipe2(fds, unix.O_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+	events := make(chan *tun.Event, 1)
+	tun, err := New(int32(fds[1]), 1500, &testHandler{}, DefaultNIC, nil, comm.IPv6Enable, nil, func(event *tun.Event) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	select {
+	case event := <-events:
+		if event.Code != comm.EventTunStopped || event.Fields["implementation"] != "gvisor" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(timeout):
+		t.Fatal("stopped stack not reported")
+	}
+}
@@ -1,6 +1,8 @@
 package gvisor
 
 import (
+	"net/netip"
+
 	"github.com/v2fly/v2ray-core/v5/common/buf"
 	"github.com/v2fly/v2ray-core/v5/common/net"
 	"golang.org/x/sys/unix"
@@ -81,7 +83,7 @@ func gIcmpHandler(s *stack.Stack, ep stack.LinkEndpoint, handler tun.Handler) {
 			}
 
 			return nil
-		}, nil) {
+		}, &gIcmpRequest{ep, originHdr, ipHdr.TTL()}) {
 			hdr.SetType(header.ICMPv4EchoReply)
 			hdr.SetChecksum(0)
 			hdr.SetChecksum(header.ICMPv4Checksum(hdr, packet.Data().AsRange().Checksum()))
@@ -168,7 +170,7 @@ func gIcmpHandler(s *stack.Stack, ep stack.LinkEndpoint, handler tun.Handler) {
 			}
 
 			return nil
-		}, nil) {
+		}, &gIcmpRequest{ep, originHdr, ipHdr.HopLimit()}) {
 			hdr.SetType(header.ICMPv6EchoReply)
 			hdr.SetChecksum(0)
 			hdr.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
@@ -189,3 +191,32 @@ func gIcmpHandler(s *stack.Stack, ep stack.LinkEndpoint, handler tun.Handler) {
 		return true
 	})
 }
+
+// gIcmpRequest answers a ping request with an ICMP error quoting its headers.
+type gIcmpRequest struct {
+	ep     stack.LinkEndpoint
+	origin buffer.View
+	ttl    uint8
+}
+
+func (r *gIcmpRequest) Close() error {
+	return nil
+}
+
+func (r *gIcmpRequest) TTL() uint8 {
+	return r.ttl
+}
+
+func (r *gIcmpRequest) WriteICMPError(source netip.Addr, icmpType uint8, icmpCode uint8) error {
+	backPacket := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.NewViewFromBytes(tun.ICMPError(source, r.origin, icmpType, icmpCode)).ToVectorisedView(),
+	})
+	defer backPacket.DecRef()
+	var packetList stack.PacketBufferList
+	packetList.PushFront(backPacket)
+	_, err := r.ep.WritePackets(packetList)
+	if err != nil {
+		return newError("failed to write packet to device: ", err.String())
+	}
+	return nil
+}
@@ -54,3 +54,10 @@ func (g gTcpConn) Close() error {
 	g.TCPConn.SetDeadline(time.Now().Add(-1))
 	return g.TCPConn.Close()
 }
+
+// Abort resets the connection instead of closing it gracefully.
+func (g gTcpConn) Abort() {
+	g.ep.Abort()
+	g.TCPConn.SetDeadline(time.Now().Add(-1))
+	g.TCPConn.Close()
+}
@@ -15,7 +15,7 @@ import (
 	"libcore/tun"
 )
 
-func gUdpHandler(s *stack.Stack, handler tun.Handler) {
+func gUdpHandler(s *stack.Stack, handler tun.Handler, limiter *tun.PacketLimiter) {
 	s.SetTransportProtocolHandler(udp.ProtocolNumber, func(id stack.TransportEndpointID, buffer *stack.PacketBuffer) bool {
 		// Ref: gVisor pkg/tcpip/transport/udp/endpoint.go HandlePacket
 		udpHdr := header.UDP(buffer.TransportHeader().View())
@@ -37,6 +37,11 @@ func gUdpHandler(s *stack.Stack, handler tun.Handler) {
 			return true
 		}
 
+		if !limiter.Acquire() {
+			return true
+		}
+
+		origin := append(append([]byte(nil), buffer.NetworkHeader().View()...), udpHdr[:header.UDPMinimumSize]...)
 		data := buffer.Data().ExtractVV()
 		packet := &gUdpPacket{
 			s:        s,
@@ -44,17 +49,21 @@ func gUdpHandler(s *stack.Stack, handler tun.Handler) {
 			nicID:    buffer.NICID,
 			netHdr:   buffer.Network(),
 			netProto: buffer.NetworkProtocolNumber,
+			origin:   origin,
 		}
 		destUdpAddr := &net.UDPAddr{
 			IP:   dst.Address.IP(),
 			Port: int(dst.Port),
 		}
-		go handler.NewPacket(src, dst, buf.FromBytes(data.ToView()), func(bytes []byte, addr *net.UDPAddr) (int, error) {
-			if addr == nil {
-				addr = destUdpAddr
-			}
-			return packet.WriteBack(bytes, addr)
-		}, nil)
+		go func() {
+			handler.NewPacket(src, dst, buf.FromBytes(data.ToView()), func(bytes []byte, addr *net.UDPAddr) (int, error) {
+				if addr == nil {
+					addr = destUdpAddr
+				}
+				return packet.WriteBack(bytes, addr)
+			}, packet)
+			limiter.Release()
+		}()
 		return true
 	})
 }
@@ -65,6 +74,21 @@ type gUdpPacket struct {
 	nicID    tcpip.NICID
 	netHdr   header.Network
 	netProto tcpip.NetworkProtocolNumber
+	origin   []byte
+}
+
+func (p *gUdpPacket) Close() error {
+	return nil
+}
+
+// Reject answers the packet with an ICMP destination unreachable quoting its
+// headers.
+func (p *gUdpPacket) Reject(reason tun.Unreachable) error {
+	message := buffer.NewViewFromBytes(tun.ICMPUnreachable(p.origin, reason))
+	if err := p.s.WriteRawPacket(p.nicID, p.netProto, message.ToVectorisedView()); err != nil {
+		return fmt.Errorf("%#v write unreachable: %s", p.id, err)
+	}
+	return nil
 }
 
 func (p *gUdpPacket) WriteBack(b []byte, addr *net.UDPAddr) (int, error) {
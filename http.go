@@ -68,6 +68,7 @@ func NewHttpClient() HTTPClient {
 	client := new(httpClient)
 	client.client.Transport = &client.transport
 	client.transport.TLSClientConfig = &client.tls
+	client.tls.KeyLogWriter = tlsKeyLogWriter()
 	client.transport.DisableKeepAlives = true
 	return client
 }
@@ -0,0 +1,226 @@
+package libcore
+
+import (
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	appOutbound "github.com/v2fly/v2ray-core/v5/app/proxyman/outbound"
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	v2rayErrors "github.com/v2fly/v2ray-core/v5/common/errors"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/net/pingproto"
+	"github.com/v2fly/v2ray-core/v5/proxy/freedom"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun"
+)
+
+const (
+	// Ping requests with a TTL up to the default hop limit of traceroute are
+	// taken as its probes. Tethered clients and apps lowering the TTL for
+	// other reasons stay above it.
+	traceTTL          = 30
+	traceProbeTimeout = 5 * time.Second
+
+	sizeofSockExtendedErr = 16
+)
+
+// outboundErrorTracker keeps the first error the outbound of a UDP session
+// failed with.
+type outboundErrorTracker struct {
+	access sync.Mutex
+	err    error
+}
+
+func (t *outboundErrorTracker) SubmitError(err error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *outboundErrorTracker) Err() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	return t.err
+}
+
+// unreachableReason maps the error of a failed UDP session to the ICMP error
+// sent back.
+func unreachableReason(err error) tun.Unreachable {
+	cause := v2rayErrors.Cause(err)
+	switch {
+	case errors.Is(cause, unix.ECONNREFUSED):
+		return tun.UnreachablePort
+	case errors.Is(cause, unix.ENETUNREACH):
+		return tun.UnreachableNetwork
+	case errors.Is(cause, unix.EACCES), errors.Is(cause, unix.EPERM):
+		return tun.UnreachableProhibited
+	default:
+		return tun.UnreachableHost
+	}
+}
+
+// rejectPing answers a ping request with a destination unreachable from its
+// destination.
+func rejectPing(destination v2rayNet.Destination, closer io.Closer, reason tun.Unreachable) {
+	writer, ok := closer.(tun.ICMPErrorWriter)
+	if !ok {
+		return
+	}
+	addr, _ := netip.AddrFromSlice(destination.Address.IP())
+	addr = addr.Unmap()
+	var err error
+	if addr.Is4() {
+		err = writer.WriteICMPError(addr, uint8(header.ICMPv4DstUnreachable), uint8(reason.ICMPv4Code()))
+	} else {
+		err = writer.WriteICMPError(addr, uint8(header.ICMPv6DstUnreachable), uint8(reason.ICMPv6Code()))
+	}
+	if err != nil {
+		newError("failed to reject ping").Base(err).AtWarning().WriteToLog()
+	}
+}
+
+// tracePing sends a ping request routed to a freedom outbound from its own
+// socket with the TTL of the request, and relays the time exceeded of the
+// router it expires at. The shared socket of the ping outbound drops those.
+func (t *Tun2ray) tracePing(source v2rayNet.Destination, destination v2rayNet.Destination, message *buf.Buffer, writeBack func([]byte) error, writer tun.ICMPErrorWriter, closer io.Closer) bool {
+	v2ray := t.v2ray.acquire()
+	if v2ray == nil {
+		return false
+	}
+	handler, _ := pingOutbound(v2ray, pingContext(v2ray, source, destination), destination).(*appOutbound.Handler)
+	v2ray.release()
+	if handler == nil {
+		return false
+	}
+	if _, isFreedom := handler.GetOutbound().(*freedom.Handler); !isFreedom {
+		return false
+	}
+	go func() {
+		err := sendTraceProbe(destination, message.Bytes(), writer.TTL(), writeBack, writer)
+		if err != nil {
+			newError("failed to trace ", destination.Address).Base(err).WriteToLog()
+		}
+		message.Release()
+		comm.CloseIgnore(closer)
+	}()
+	return true
+}
+
+func sendTraceProbe(destination v2rayNet.Destination, message []byte, ttl uint8, writeBack func([]byte) error, writer tun.ICMPErrorWriter) error {
+	addr, _ := netip.AddrFromSlice(destination.Address.IP())
+	addr = addr.Unmap()
+	family, proto, level, ttlOption, recvErrOption := unix.AF_INET, unix.IPPROTO_ICMP, unix.IPPROTO_IP, unix.IP_TTL, unix.IP_RECVERR
+	var sockaddr unix.Sockaddr = &unix.SockaddrInet4{Addr: addr.As4()}
+	if addr.Is6() {
+		family, proto, level, ttlOption, recvErrOption = unix.AF_INET6, unix.IPPROTO_ICMPV6, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, unix.IPV6_RECVERR
+		sockaddr = &unix.SockaddrInet6{Addr: addr.As16()}
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(fd)
+	if pingproto.ControlFunc != nil {
+		pingproto.ControlFunc(uintptr(fd))
+	}
+	err = unix.SetsockoptInt(fd, level, ttlOption, int(ttl))
+	if err == nil {
+		err = unix.SetsockoptInt(fd, level, recvErrOption, 1)
+	}
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	// The kernel replaces the identifier of the request with the port of
+	// the socket.
+	ident := header.ICMPv4(message).Ident()
+	err = unix.Sendto(fd, message, 0, sockaddr)
+	if err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+
+	pollFds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		var n int
+		n, err = unix.Poll(pollFds, int(traceProbeTimeout/time.Millisecond))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("poll", err)
+		}
+		if n == 0 {
+			return os.ErrDeadlineExceeded
+		}
+		break
+	}
+
+	reply := buf.New()
+	defer reply.Release()
+	if pollFds[0].Revents&unix.POLLERR != 0 {
+		oob := make([]byte, 128)
+		_, oobn, _, _, err := unix.Recvmsg(fd, reply.Extend(buf.Size), oob, unix.MSG_ERRQUEUE)
+		if err != nil {
+			return os.NewSyscallError("recvmsg", err)
+		}
+		router, icmpType, icmpCode, ok := parseICMPError(oob[:oobn])
+		if !ok {
+			return newError("no icmp error in error queue")
+		}
+		return writer.WriteICMPError(router, icmpType, icmpCode)
+	}
+	n, _, err := unix.Recvfrom(fd, reply.Extend(buf.Size), 0)
+	if err != nil {
+		return os.NewSyscallError("recvfrom", err)
+	}
+	response := reply.Bytes()[:n]
+	if addr.Is4() {
+		header.ICMPv4(response).SetIdentWithChecksumUpdate(ident)
+	} else {
+		header.ICMPv6(response).SetIdent(ident)
+	}
+	return writeBack(response)
+}
+
+// parseICMPError reads the router and the ICMP type and code from the
+// IP_RECVERR or IPV6_RECVERR control message of the error queue, a
+// sock_extended_err followed by the sockaddr of the offender.
+func parseICMPError(oob []byte) (netip.Addr, uint8, uint8, bool) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.Addr{}, 0, 0, false
+	}
+	for _, message := range messages {
+		data := message.Data
+		if len(data) < sizeofSockExtendedErr {
+			continue
+		}
+		origin, icmpType, icmpCode := data[4], data[5], data[6]
+		offender := data[sizeofSockExtendedErr:]
+		var router netip.Addr
+		switch {
+		case message.Header.Level == unix.IPPROTO_IP && message.Header.Type == unix.IP_RECVERR && origin == unix.SO_EE_ORIGIN_ICMP:
+			if len(offender) < unix.SizeofSockaddrInet4 {
+				continue
+			}
+			router, _ = netip.AddrFromSlice(offender[4:8])
+		case message.Header.Level == unix.IPPROTO_IPV6 && message.Header.Type == unix.IPV6_RECVERR && origin == unix.SO_EE_ORIGIN_ICMP6:
+			if len(offender) < unix.SizeofSockaddrInet6 {
+				continue
+			}
+			router, _ = netip.AddrFromSlice(offender[8:24])
+		default:
+			continue
+		}
+		return router, icmpType, icmpCode, true
+	}
+	return netip.Addr{}, 0, 0, false
+}
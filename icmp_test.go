@@ -0,0 +1,93 @@
+package libcore
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/tun"
+	"libcore/tun/tuntest"
+)
+
+func testErrQueueMessage(level int32, typ int32, origin uint8, icmpType uint8, offender []byte) []byte {
+	data := make([]byte, sizeofSockExtendedErr+len(offender))
+	data[4], data[5] = origin, icmpType
+	copy(data[sizeofSockExtendedErr:], offender)
+	oob := make([]byte, unix.CmsgSpace(len(data)))
+	cmsg := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	cmsg.Level, cmsg.Type = level, typ
+	cmsg.SetLen(unix.CmsgLen(len(data)))
+	copy(oob[unix.CmsgLen(0):], data)
+	return oob
+}
+
+func TestParseICMPError(t *testing.T) {
+	offender4 := make([]byte, unix.SizeofSockaddrInet4)
+	copy(offender4[4:], []byte{10, 0, 0, 1})
+	router, icmpType, icmpCode, ok := parseICMPError(testErrQueueMessage(unix.IPPROTO_IP, unix.IP_RECVERR, unix.SO_EE_ORIGIN_ICMP, uint8(header.ICMPv4TimeExceeded), offender4))
+	if !ok || router != netip.MustParseAddr("10.0.0.1") || icmpType != uint8(header.ICMPv4TimeExceeded) || icmpCode != 0 {
+		t.Fatalf("unexpected icmp error %s %d %d %v", router, icmpType, icmpCode, ok)
+	}
+
+	offender6 := make([]byte, unix.SizeofSockaddrInet6)
+	copy(offender6[8:], netip.MustParseAddr("2001:db8::1").AsSlice())
+	router, icmpType, _, ok = parseICMPError(testErrQueueMessage(unix.IPPROTO_IPV6, unix.IPV6_RECVERR, unix.SO_EE_ORIGIN_ICMP6, uint8(header.ICMPv6TimeExceeded), offender6))
+	if !ok || router != netip.MustParseAddr("2001:db8::1") || icmpType != uint8(header.ICMPv6TimeExceeded) {
+		t.Fatalf("unexpected icmpv6 error %s %d %v", router, icmpType, ok)
+	}
+
+	// Errors raised locally carry no router.
+	if _, _, _, ok = parseICMPError(testErrQueueMessage(unix.IPPROTO_IP, unix.IP_RECVERR, unix.SO_EE_ORIGIN_LOCAL, 0, offender4)); ok {
+		t.Fatal("parsed a local error")
+	}
+}
+
+func TestUnreachableReason(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		reason tun.Unreachable
+	}{
+		{newError("failed to process outbound traffic").Base(&net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", unix.ECONNREFUSED)}), tun.UnreachablePort},
+		{newError("failed to open connection").Base(os.NewSyscallError("sendto", unix.ENETUNREACH)), tun.UnreachableNetwork},
+		{newError("failed to open connection").Base(unix.EPERM), tun.UnreachableProhibited},
+		{newError("connection ends"), tun.UnreachableHost},
+	} {
+		if reason := unreachableReason(test.err); reason != test.reason {
+			t.Fatalf("%s: expected %d, got %d", test.err, test.reason, reason)
+		}
+	}
+}
+
+func TestTun2rayUDPUnreachable(t *testing.T) {
+	for _, i := range testImplementations {
+		t.Run(i.name, func(t *testing.T) {
+			_, device, port := newTestTun2ray(t, i.implementation, func(config *TunConfig) {
+				config.FakeDNS = true
+			})
+			source := netip.MustParseAddrPort("172.19.0.1:40000")
+			destination := netip.AddrPortFrom(netip.MustParseAddr("198.18.0.100"), port)
+
+			// A fake address without a domain can not be dispatched.
+			err := device.Write(tuntest.UDPPacket(source, destination, []byte("ping")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			unreachable, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+				return packet.Protocol == header.ICMPv4ProtocolNumber
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unreachable.ICMPType != uint8(header.ICMPv4DstUnreachable) || unreachable.ICMPCode != uint8(header.ICMPv4HostUnreachable) {
+				t.Fatalf("unexpected icmp type %d code %d", unreachable.ICMPType, unreachable.ICMPCode)
+			}
+			if unreachable.Source.Addr() != destination.Addr() || unreachable.Destination.Addr() != source.Addr() {
+				t.Fatalf("unexpected icmp %s -> %s", unreachable.Source, unreachable.Destination)
+			}
+		})
+	}
+}
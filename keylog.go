@@ -0,0 +1,95 @@
+//go:build !disable_debug
+
+package libcore
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	_ "unsafe"
+
+	"github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	"github.com/v2fly/v2ray-core/v5/transport/internet/tcp"
+	"github.com/v2fly/v2ray-core/v5/transport/internet/tls"
+)
+
+const keyLogFile = "sslkeylog.txt"
+
+var (
+	keyLogAccess sync.Mutex
+	keyLog       *os.File
+)
+
+// SetTLSKeyLog appends the secrets of TLS client handshakes made by
+// HTTPClient and the v2ray tcp transport without a header to sslkeylog.txt
+// in the external assets dir, in NSS key log format, so captures can be
+// decrypted by Wireshark. Only handshakes started after enabling are logged.
+func SetTLSKeyLog(enabled bool) error {
+	keyLogAccess.Lock()
+	defer keyLogAccess.Unlock()
+	if keyLog != nil {
+		keyLog.Close()
+		keyLog = nil
+	}
+	if !enabled {
+		return nil
+	}
+	file, err := os.OpenFile(filepath.Join(externalAssetsPath, keyLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return newError("unable to open key log file").Base(err)
+	}
+	keyLog = file
+	return nil
+}
+
+type keyLogWriter struct{}
+
+func (keyLogWriter) Write(p []byte) (int, error) {
+	keyLogAccess.Lock()
+	defer keyLogAccess.Unlock()
+	if keyLog == nil {
+		return len(p), nil
+	}
+	return keyLog.Write(p)
+}
+
+func tlsKeyLogWriter() io.Writer {
+	keyLogAccess.Lock()
+	defer keyLogAccess.Unlock()
+	if keyLog == nil {
+		return nil
+	}
+	return keyLogWriter{}
+}
+
+//go:linkname transportDialerCache github.com/v2fly/v2ray-core/v5/transport/internet.transportDialerCache
+var transportDialerCache map[string]func(ctx context.Context, dest net.Destination, streamSettings *internet.MemoryStreamConfig) (internet.Connection, error)
+
+// The tls package builds its tls.Config inside the transports, so the tcp
+// dialer is wrapped to add the TLS layer with the key log writer on top of
+// the registered dialer, which does everything else. Headers go inside TLS,
+// so connections with one are left to the registered dialer, as are xtls and
+// transports that handshake in their own dialers.
+func init() {
+	dialTCP := transportDialerCache["tcp"]
+	transportDialerCache["tcp"] = func(ctx context.Context, dest net.Destination, streamSettings *internet.MemoryStreamConfig) (internet.Connection, error) {
+		writer := tlsKeyLogWriter()
+		config := tls.ConfigFromStreamSettings(streamSettings)
+		if writer == nil || config == nil || streamSettings.ProtocolSettings.(*tcp.Config).HeaderSettings != nil {
+			return dialTCP(ctx, dest, streamSettings)
+		}
+		plainSettings := *streamSettings
+		plainSettings.SecurityType = ""
+		plainSettings.SecuritySettings = nil
+		conn, err := dialTCP(ctx, dest, &plainSettings)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := config.GetTLSConfig(tls.WithDestination(dest))
+		tlsConfig.KeyLogWriter = writer
+		return tls.Client(conn, tlsConfig), nil
+	}
+}
@@ -0,0 +1,16 @@
+//go:build disable_debug
+
+package libcore
+
+import "io"
+
+func SetTLSKeyLog(enabled bool) error {
+	if enabled {
+		return newError("key log is not available in this build")
+	}
+	return nil
+}
+
+func tlsKeyLogWriter() io.Writer {
+	return nil
+}
@@ -0,0 +1,88 @@
+//go:build !disable_debug
+
+package libcore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	"github.com/v2fly/v2ray-core/v5/transport/internet/tcp"
+	"github.com/v2fly/v2ray-core/v5/transport/internet/tls"
+)
+
+func readTestKeyLog(t *testing.T) []string {
+	content, err := os.ReadFile(filepath.Join(externalAssetsPath, keyLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestTLSKeyLog(t *testing.T) {
+	oldAssetsPath := externalAssetsPath
+	externalAssetsPath = t.TempDir()
+	t.Cleanup(func() {
+		externalAssetsPath = oldAssetsPath
+		_ = SetTLSKeyLog(false)
+	})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	err := SetTLSKeyLog(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewHttpClient().(*httpClient)
+	client.tls.InsecureSkipVerify = true
+	request := client.NewRequest()
+	err = request.SetURL(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = request.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := readTestKeyLog(t)
+	for _, line := range lines {
+		if len(strings.Fields(line)) != 3 {
+			t.Fatalf("unexpected key log line %q", line)
+		}
+	}
+	if !strings.HasPrefix(lines[len(lines)-1], "SERVER_TRAFFIC_SECRET_0 ") {
+		t.Fatalf("unexpected key log %v", lines)
+	}
+
+	address := server.Listener.Addr().(*net.TCPAddr)
+	conn, err := internet.Dial(context.Background(), net.TCPDestination(net.IPAddress(address.IP), net.Port(address.Port)), &internet.MemoryStreamConfig{
+		ProtocolName:     "tcp",
+		ProtocolSettings: &tcp.Config{},
+		SecuritySettings: &tls.Config{AllowInsecure: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.(*tls.Conn).Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transportLines := readTestKeyLog(t); len(transportLines) != 2*len(lines) {
+		t.Fatalf("expected transport handshake to be logged, got %v", transportLines)
+	}
+
+	err = SetTLSKeyLog(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client := NewHttpClient().(*httpClient); client.tls.KeyLogWriter != nil {
+		t.Fatal("expected no key log writer when disabled")
+	}
+}
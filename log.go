@@ -17,8 +17,8 @@ import (
 	"unsafe"
 
 	"github.com/sirupsen/logrus"
-	appLog "github.com/v2fly/v2ray-core/v5/app/log"
 	commonLog "github.com/v2fly/v2ray-core/v5/common/log"
+	"github.com/v2fly/v2ray-core/v5/common/serial"
 )
 
 var (
@@ -74,34 +74,32 @@ func (hook *androidHook) Fire(e *logrus.Entry) error {
 	return nil
 }
 
-type v2rayLogWriter struct{}
-
-func (w *v2rayLogWriter) Write(s string) error {
-	var priority C.int
-	if strings.Contains(s, "[Debug]") {
-		s = strings.Replace(s, "[Debug]", "", 1)
-		priority = C.ANDROID_LOG_DEBUG
-	} else if strings.Contains(s, "[Info]") {
-		s = strings.Replace(s, "[Info]", "", 1)
-		priority = C.ANDROID_LOG_INFO
-	} else if strings.Contains(s, "[Warning]") {
-		s = strings.Replace(s, "[Warning]", "", 1)
-		priority = C.ANDROID_LOG_WARN
-	} else if strings.Contains(s, "[Error]") {
-		s = strings.Replace(s, "[Error]", "", 1)
-		priority = C.ANDROID_LOG_ERROR
-	} else {
-		priority = C.ANDROID_LOG_DEBUG
+// logcatHandler writes the messages of v2ray with the priority of their
+// severity.
+type logcatHandler struct{}
+
+func (logcatHandler) Handle(msg commonLog.Message) {
+	var priority C.int = C.ANDROID_LOG_INFO
+	content := msg.String()
+	if general, ok := msg.(*commonLog.GeneralMessage); ok {
+		content = serial.ToString(general.Content)
+		switch general.Severity {
+		case commonLog.Severity_Debug:
+			priority = C.ANDROID_LOG_DEBUG
+		case commonLog.Severity_Warning:
+			priority = C.ANDROID_LOG_WARN
+		case commonLog.Severity_Error:
+			priority = C.ANDROID_LOG_ERROR
+		}
 	}
 
-	str := C.CString(strings.TrimSpace(s))
+	str := C.CString(strings.TrimSpace(content))
 	C.__android_log_write(priority, tagV2Ray, str)
 	C.free(unsafe.Pointer(str))
-	return nil
 }
 
-func (w *v2rayLogWriter) Close() error {
-	return nil
+func newConsoleLogHandler() commonLog.Handler {
+	return logcatHandler{}
 }
 
 type stdLogWriter struct{}
@@ -118,12 +116,4 @@ func init() {
 	log.SetFlags(log.Flags() &^ log.LstdFlags)
 	logrus.SetFormatter(&androidFormatter{})
 	logrus.AddHook(&androidHook{})
-
-	_ = appLog.RegisterHandlerCreator(appLog.LogType_Console, func(lt appLog.LogType,
-		options appLog.HandlerCreatorOptions,
-	) (commonLog.Handler, error) {
-		return commonLog.NewLogger(func() commonLog.Writer {
-			return &v2rayLogWriter{}
-		}), nil
-	})
 }
@@ -0,0 +1,9 @@
+//go:build !android
+
+package libcore
+
+import commonLog "github.com/v2fly/v2ray-core/v5/common/log"
+
+func newConsoleLogHandler() commonLog.Handler {
+	return commonLog.NewLogger(commonLog.CreateStdoutLogWriter())
+}
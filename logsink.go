@@ -0,0 +1,323 @@
+package libcore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	appLog "github.com/v2fly/v2ray-core/v5/app/log"
+	commonLog "github.com/v2fly/v2ray-core/v5/common/log"
+	"github.com/v2fly/v2ray-core/v5/common/serial"
+)
+
+// logRecord is a line of the JSON log. Source is libcore for logrus, v2ray for
+// the messages of v2ray and access for its access log.
+type logRecord struct {
+	// Time is the unix time in milliseconds.
+	Time    int64                  `json:"time"`
+	Level   string                 `json:"level"`
+	Source  string                 `json:"source"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+type LogListener interface {
+	OnLog(record string)
+}
+
+// logSink keeps the latest records in a ring and writes all of them to a file
+// that is rotated once it exceeds rotateSize bytes.
+type logSink struct {
+	active  int32
+	access  sync.Mutex
+	records []string
+	next    int
+
+	path       string
+	rotateSize int64
+	keep       int
+	file       *os.File
+	size       int64
+}
+
+var jsonLog logSink
+
+// SetLogBufferSize sets how many log records are kept in memory, zero disables
+// the buffer.
+func SetLogBufferSize(size int32) {
+	if size < 0 {
+		size = 0
+	}
+	jsonLog.access.Lock()
+	defer jsonLog.access.Unlock()
+	records := jsonLog.ordered()
+	if len(records) > int(size) {
+		records = records[len(records)-int(size):]
+	}
+	jsonLog.records = append(make([]string, 0, size), records...)
+	jsonLog.next = 0
+	if size > 0 {
+		jsonLog.next = len(records) % int(size)
+	}
+	jsonLog.updateActive()
+}
+
+// SetLogFile appends the log records to path, one JSON object per line. Once
+// the file exceeds rotateSize bytes it is renamed to path.1, shifting keep
+// older ones. An empty path stops writing.
+func SetLogFile(path string, rotateSize int64, keep int32) error {
+	jsonLog.access.Lock()
+	defer jsonLog.access.Unlock()
+	if jsonLog.file != nil {
+		jsonLog.file.Close()
+		jsonLog.file = nil
+	}
+	jsonLog.path = path
+	jsonLog.rotateSize = rotateSize
+	jsonLog.keep = int(keep)
+	defer jsonLog.updateActive()
+	if path == "" {
+		return nil
+	}
+	return jsonLog.open()
+}
+
+// ReadLogs passes the buffered records to listener, oldest first.
+func ReadLogs(listener LogListener) {
+	jsonLog.access.Lock()
+	records := jsonLog.ordered()
+	jsonLog.access.Unlock()
+	for _, record := range records {
+		listener.OnLog(record)
+	}
+}
+
+// ExportLogs writes the buffered records to path as JSON lines.
+func ExportLogs(path string) error {
+	jsonLog.access.Lock()
+	records := jsonLog.ordered()
+	jsonLog.access.Unlock()
+	file, err := os.Create(path)
+	if err != nil {
+		return newError("unable to create log export").Base(err)
+	}
+	writer := bufio.NewWriter(file)
+	for _, record := range records {
+		writer.WriteString(record)
+		writer.WriteByte('\n')
+	}
+	err = writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func ClearLogs() {
+	jsonLog.access.Lock()
+	defer jsonLog.access.Unlock()
+	jsonLog.records = jsonLog.records[:0]
+	jsonLog.next = 0
+}
+
+func (l *logSink) updateActive() {
+	var active int32
+	if cap(l.records) > 0 || l.file != nil {
+		active = 1
+	}
+	atomic.StoreInt32(&l.active, active)
+}
+
+func (l *logSink) enabled() bool {
+	return atomic.LoadInt32(&l.active) != 0
+}
+
+func (l *logSink) ordered() []string {
+	if len(l.records) < cap(l.records) {
+		return append([]string(nil), l.records...)
+	}
+	return append(append([]string(nil), l.records[l.next:]...), l.records[:l.next]...)
+}
+
+func (l *logSink) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return newError("unable to open log file").Base(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return newError("unable to open log file").Base(err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate shifts path.N to path.N+1, dropping the ones beyond keep, and starts
+// a new file. Errors stop the file, as they cannot be logged from here.
+func (l *logSink) rotate() {
+	l.file.Close()
+	l.file = nil
+	for i := l.keep; i > 0; i-- {
+		from := l.path
+		if i > 1 {
+			from = fmt.Sprint(l.path, ".", i-1)
+		}
+		_ = os.Rename(from, fmt.Sprint(l.path, ".", i))
+	}
+	if l.keep <= 0 {
+		_ = os.Remove(l.path)
+	}
+	if l.open() != nil {
+		l.updateActive()
+	}
+}
+
+func (l *logSink) add(record *logRecord) {
+	if !l.enabled() {
+		return
+	}
+	content, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	if cap(l.records) > 0 {
+		if len(l.records) < cap(l.records) {
+			l.records = append(l.records, string(content))
+		} else {
+			l.records[l.next] = string(content)
+		}
+		l.next = (l.next + 1) % cap(l.records)
+	}
+	if l.file != nil {
+		if l.rotateSize > 0 && l.size > 0 && l.size+int64(len(content))+1 > l.rotateSize {
+			l.rotate()
+			if l.file == nil {
+				return
+			}
+		}
+		n, _ := l.file.Write(append(content, '\n'))
+		l.size += int64(n)
+	}
+}
+
+type jsonLogHook struct{}
+
+func (jsonLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (jsonLogHook) Fire(entry *logrus.Entry) error {
+	if !jsonLog.enabled() {
+		return nil
+	}
+	var fields map[string]interface{}
+	if len(entry.Data) > 0 {
+		fields = make(map[string]interface{}, len(entry.Data))
+		for key, value := range entry.Data {
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			fields[key] = value
+		}
+	}
+	jsonLog.add(&logRecord{
+		Time:    entry.Time.UnixMilli(),
+		Level:   entry.Level.String(),
+		Source:  "libcore",
+		Message: entry.Message,
+		Fields:  fields,
+	})
+	return nil
+}
+
+// v2rayLogHandler records the messages of v2ray before passing them to the
+// console. Like the logger of v2ray, both are done by a goroutine that runs
+// while there are messages, which are dropped when it falls behind.
+type v2rayLogHandler struct {
+	next    commonLog.Handler
+	buffer  chan v2rayLogMessage
+	running int32
+}
+
+type v2rayLogMessage struct {
+	time time.Time
+	msg  commonLog.Message
+}
+
+func newV2rayLogHandler(next commonLog.Handler) *v2rayLogHandler {
+	return &v2rayLogHandler{
+		next:   next,
+		buffer: make(chan v2rayLogMessage, 256),
+	}
+}
+
+func (h *v2rayLogHandler) Handle(msg commonLog.Message) {
+	select {
+	case h.buffer <- v2rayLogMessage{time.Now(), msg}:
+	default:
+	}
+	if atomic.CompareAndSwapInt32(&h.running, 0, 1) {
+		go h.run()
+	}
+}
+
+// run writes the buffered messages and returns once none came for a minute.
+func (h *v2rayLogHandler) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	var written bool
+	for {
+		select {
+		case message := <-h.buffer:
+			h.write(message)
+			written = true
+		case <-ticker.C:
+			if written {
+				written = false
+				continue
+			}
+			atomic.StoreInt32(&h.running, 0)
+			// A message sent before running was cleared started no goroutine.
+			if len(h.buffer) == 0 || !atomic.CompareAndSwapInt32(&h.running, 0, 1) {
+				return
+			}
+		}
+	}
+}
+
+func (h *v2rayLogHandler) write(message v2rayLogMessage) {
+	if jsonLog.enabled() {
+		record := &logRecord{
+			Time:    message.time.UnixMilli(),
+			Level:   "info",
+			Source:  "access",
+			Message: message.msg.String(),
+		}
+		if general, ok := message.msg.(*commonLog.GeneralMessage); ok {
+			record.Level = strings.ToLower(general.Severity.String())
+			record.Source = "v2ray"
+			record.Message = serial.ToString(general.Content)
+		}
+		jsonLog.add(record)
+	}
+	h.next.Handle(message.msg)
+}
+
+func init() {
+	logrus.AddHook(jsonLogHook{})
+	_ = appLog.RegisterHandlerCreator(appLog.LogType_Console, func(lt appLog.LogType,
+		options appLog.HandlerCreatorOptions,
+	) (commonLog.Handler, error) {
+		return newV2rayLogHandler(newConsoleLogHandler()), nil
+	})
+}
@@ -0,0 +1,123 @@
+package libcore
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	commonLog "github.com/v2fly/v2ray-core/v5/common/log"
+)
+
+type testLogListener []logRecord
+
+func (l *testLogListener) OnLog(content string) {
+	var record logRecord
+	if err := json.Unmarshal([]byte(content), &record); err != nil {
+		panic(err)
+	}
+	*l = append(*l, record)
+}
+
+type chanLogHandler chan commonLog.Message
+
+func (h chanLogHandler) Handle(msg commonLog.Message) {
+	h <- msg
+}
+
+func TestLogBuffer(t *testing.T) {
+	SetLogBufferSize(2)
+	t.Cleanup(func() {
+		SetLogBufferSize(0)
+	})
+	console := make(chanLogHandler, 1)
+	handler := newV2rayLogHandler(console)
+	logrus.Warn("dropped")
+	logrus.WithError(errors.New("refused")).Warn("dial failed")
+	handler.Handle(&commonLog.GeneralMessage{Severity: commonLog.Severity_Warning, Content: newError("v2ray started")})
+	<-console
+
+	var records testLogListener
+	ReadLogs(&records)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0].Source != "libcore" || records[0].Level != "warning" || records[0].Message != "dial failed" || records[0].Fields["error"] != "refused" {
+		t.Fatalf("unexpected logrus record %+v", records[0])
+	}
+	if records[1].Source != "v2ray" || records[1].Level != "warning" || !strings.HasSuffix(records[1].Message, "v2ray started") {
+		t.Fatalf("unexpected v2ray record %+v", records[1])
+	}
+
+	path := filepath.Join(t.TempDir(), "logs.json")
+	if err := ExportLogs(path); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) != 2 {
+		t.Fatalf("expected 2 exported records, got %d", len(lines))
+	}
+
+	ClearLogs()
+	records = nil
+	ReadLogs(&records)
+	if len(records) != 0 {
+		t.Fatalf("expected no records after clear, got %d", len(records))
+	}
+}
+
+func TestLogFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "libcore.log")
+	if err := SetLogFile(path, 200, 1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		SetLogFile("", 0, 0)
+	})
+	for i := 0; i < 4; i++ {
+		logrus.Warn("a log message long enough to rotate the file")
+	}
+	for _, name := range []string{path, path + ".1"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 200 {
+			t.Fatalf("%s has %d bytes", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Fatalf("expected only one rotated file, got %v", err)
+	}
+}
+
+// A slow console doesn't hold up the callers of v2ray's log.
+func TestV2rayLogHandlerAsync(t *testing.T) {
+	console := make(chanLogHandler)
+	defer func() {
+		go func() {
+			for range console {
+			}
+		}()
+	}()
+	handler := newV2rayLogHandler(console)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			handler.Handle(&commonLog.GeneralMessage{Severity: commonLog.Severity_Info, Content: "message"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handle blocked on the console")
+	}
+}
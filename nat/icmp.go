@@ -1,12 +1,14 @@
 package nat
 
 import (
+	"net/netip"
+
 	"github.com/v2fly/v2ray-core/v5/common/buf"
 	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
 	"golang.org/x/sys/unix"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
-	"libcore/comm"
+	"libcore/tun"
 )
 
 func (t *SystemTun) processICMPv4(cache *buf.Buffer, ipHdr header.IPv4, hdr header.ICMPv4) bool {
@@ -17,19 +19,20 @@ func (t *SystemTun) processICMPv4(cache *buf.Buffer, ipHdr header.IPv4, hdr head
 	source := v2rayNet.Destination{Address: v2rayNet.IPAddress([]byte(ipHdr.SourceAddress())), Network: v2rayNet.Network_UDP}
 	destination := v2rayNet.Destination{Address: v2rayNet.IPAddress([]byte(ipHdr.DestinationAddress())), Port: 7, Network: v2rayNet.Network_UDP}
 
+	headerCache := buf.New()
+	transportDataLen := len(hdr)
+	if transportDataLen > 8 {
+		transportDataLen = 8
+	}
+	originHdr := headerCache.ExtendCopy(ipHdr[:int(ipHdr.HeaderLength())+transportDataLen])
+
 	sourceAddress := ipHdr.SourceAddress()
 	ipHdr.SetSourceAddress(ipHdr.DestinationAddress())
 	ipHdr.SetDestinationAddress(sourceAddress)
 	ipHdr.SetChecksum(0)
 	ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
 
-	headerCache := buf.New()
 	netHdr := headerCache.ExtendCopy(ipHdr[:ipHdr.HeaderLength()])
-	transportDataLen := len(hdr)
-	if transportDataLen > 8 {
-		transportDataLen = 8
-	}
-	originHdr := headerCache.ExtendCopy(ipHdr[:int(ipHdr.HeaderLength())+transportDataLen])
 	messageLen := len(hdr)
 
 	cache.Resize(int32(ipHdr.HeaderLength()), cache.Len())
@@ -70,7 +73,7 @@ func (t *SystemTun) processICMPv4(cache *buf.Buffer, ipHdr header.IPv4, hdr head
 			return unix.ENETUNREACH
 		}
 		return nil
-	}, comm.Closer(headerCache.Release)) {
+	}, &icmpCloser{t, headerCache, originHdr, ipHdr.TTL()}) {
 		return true
 	}
 	hdr.SetType(header.ICMPv4EchoReply)
@@ -89,18 +92,19 @@ func (t *SystemTun) processICMPv6(cache *buf.Buffer, ipHdr header.IPv6, hdr head
 	source := v2rayNet.Destination{Address: v2rayNet.IPAddress([]byte(ipHdr.SourceAddress())), Network: v2rayNet.Network_UDP}
 	destination := v2rayNet.Destination{Address: v2rayNet.IPAddress([]byte(ipHdr.DestinationAddress())), Port: 7, Network: v2rayNet.Network_UDP}
 
-	sourceAddress := ipHdr.SourceAddress()
-	ipHdr.SetSourceAddress(ipHdr.DestinationAddress())
-	ipHdr.SetDestinationAddress(sourceAddress)
-
 	headerLength := len(ipHdr) - int(ipHdr.PayloadLength())
 	headerCache := buf.New()
-	netHdr := headerCache.ExtendCopy(ipHdr[:headerLength])
 	transportDataLen := len(hdr)
 	if transportDataLen > 8 {
 		transportDataLen = 8
 	}
 	originHdr := headerCache.ExtendCopy(ipHdr[:headerLength+transportDataLen])
+
+	sourceAddress := ipHdr.SourceAddress()
+	ipHdr.SetSourceAddress(ipHdr.DestinationAddress())
+	ipHdr.SetDestinationAddress(sourceAddress)
+
+	netHdr := headerCache.ExtendCopy(ipHdr[:headerLength])
 	messageLen := len(hdr)
 
 	cache.Resize(int32(headerLength), cache.Len())
@@ -145,7 +149,7 @@ func (t *SystemTun) processICMPv6(cache *buf.Buffer, ipHdr header.IPv6, hdr head
 			return unix.ENETUNREACH
 		}
 		return nil
-	}, comm.Closer(headerCache.Release)) {
+	}, &icmpCloser{t, headerCache, originHdr, ipHdr.HopLimit()}) {
 		return true
 	}
 	hdr.SetType(header.ICMPv6EchoReply)
@@ -159,3 +163,29 @@ func (t *SystemTun) processICMPv6(cache *buf.Buffer, ipHdr header.IPv6, hdr head
 	headerCache.Release()
 	return false
 }
+
+// icmpCloser releases the headers of a ping request, which are quoted when a
+// router on the way answers it with an error.
+type icmpCloser struct {
+	tun         *SystemTun
+	headerCache *buf.Buffer
+	origin      []byte
+	ttl         uint8
+}
+
+func (c *icmpCloser) Close() error {
+	c.headerCache.Release()
+	return nil
+}
+
+func (c *icmpCloser) TTL() uint8 {
+	return c.ttl
+}
+
+func (c *icmpCloser) WriteICMPError(source netip.Addr, icmpType uint8, icmpCode uint8) error {
+	backData := buffer.NewViewFromBytes(tun.ICMPError(source, c.origin, icmpType, icmpCode)).ToVectorisedView()
+	if err := c.tun.writeRawPacket(backData); err != nil {
+		return newError("failed to write packet to device: ", err.String())
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package nat
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v2rayErrors "github.com/v2fly/v2ray-core/v5/common/errors"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"libcore/comm"
+	"libcore/tun"
+)
+
+// limitReportInterval is how often a breach of each limit is reported as an
+// event, so a port scan does not flood it.
+const limitReportInterval = time.Minute
+
+const (
+	tcpDropUnknown = iota
+	tcpDropSynRate
+	tcpDropLimit
+	tcpDropUidLimit
+	tcpDropReasons
+)
+
+var tcpDropNames = [tcpDropReasons]string{"unknown", "syn_rate", "limit", "uid_limit"}
+
+// TCPLimit caps the sessions of the tcp forwarder, so an application opening
+// connections in a loop cannot exhaust the file descriptors. Zero values are
+// unlimited.
+type TCPLimit struct {
+	// MaxConnections caps the concurrent connections.
+	MaxConnections int32
+	// MaxConnectionsPerUid caps the concurrent connections of each uid found
+	// by Uid.
+	MaxConnectionsPerUid int32
+	// SynRate caps the new sessions per second, with a burst of one second.
+	SynRate int32
+	Uid     func(source v2rayNet.Destination, destination v2rayNet.Destination) (uint16, error)
+}
+
+// TCPDrops counts the sessions dropped by the tcp forwarder.
+type TCPDrops struct {
+	Unknown  int64
+	SynRate  int64
+	Limit    int64
+	UidLimit int64
+}
+
+type tcpLimiter struct {
+	drops [tcpDropReasons]int64
+	TCPLimit
+
+	access         sync.Mutex
+	connections    int32
+	uidConnections map[uint16]int32
+	tokens         float64
+	last           time.Time
+	reported       [tcpDropReasons]time.Time
+}
+
+func newTcpLimiter(limit TCPLimit) *tcpLimiter {
+	return &tcpLimiter{
+		TCPLimit:       limit,
+		uidConnections: make(map[uint16]int32),
+		tokens:         float64(limit.SynRate),
+		last:           time.Now(),
+	}
+}
+
+// allowSession takes a token for a new session from the syn rate bucket.
+func (l *tcpLimiter) allowSession() bool {
+	if l.SynRate <= 0 {
+		return true
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	now := time.Now()
+	rate := float64(l.SynRate)
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// acquire counts a connection against the concurrent limits. It returns the
+// function releasing it, or nil with the uid and the limit it breaches.
+func (l *tcpLimiter) acquire(source v2rayNet.Destination, destination v2rayNet.Destination) (func(), uint16, int) {
+	var uid uint16
+	var hasUid bool
+	if l.MaxConnectionsPerUid > 0 && l.Uid != nil {
+		u, err := l.Uid(source, destination)
+		if err == nil {
+			uid, hasUid = u, true
+		}
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	if l.MaxConnections > 0 && l.connections >= l.MaxConnections {
+		return nil, uid, tcpDropLimit
+	}
+	if hasUid && l.uidConnections[uid] >= l.MaxConnectionsPerUid {
+		return nil, uid, tcpDropUidLimit
+	}
+	l.connections++
+	if hasUid {
+		l.uidConnections[uid]++
+	}
+	return func() {
+		l.access.Lock()
+		defer l.access.Unlock()
+		l.connections--
+		if hasUid {
+			if l.uidConnections[uid]--; l.uidConnections[uid] <= 0 {
+				delete(l.uidConnections, uid)
+			}
+		}
+	}, uid, 0
+}
+
+// drop counts a dropped session and tells whether its reason is due to be
+// reported.
+func (l *tcpLimiter) drop(reason int) bool {
+	atomic.AddInt64(&l.drops[reason], 1)
+	if reason == tcpDropUnknown {
+		return false
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	now := time.Now()
+	if now.Sub(l.reported[reason]) < limitReportInterval {
+		return false
+	}
+	l.reported[reason] = now
+	return true
+}
+
+// allowSession takes a token for a new session, dropping it when the syn rate
+// limit is exceeded.
+func (t *tcpForwarder) allowSession(destinationAddress tcpip.Address, destinationPort uint16) bool {
+	if t.limiter.allowSession() {
+		return true
+	}
+	t.limitExceeded(tcpDropSynRate, v2rayNet.TCPDestination(v2rayNet.IPAddress([]byte(destinationAddress)), v2rayNet.Port(destinationPort)), 0)
+	return false
+}
+
+// limitExceeded logs a dropped session, reporting the first breach of its
+// limit in a while as an event.
+func (t *tcpForwarder) limitExceeded(reason int, destination v2rayNet.Destination, uid uint16) {
+	fields := map[string]string{
+		"reason":      tcpDropNames[reason],
+		"destination": destination.NetAddr(),
+	}
+	var err *v2rayErrors.Error
+	switch reason {
+	case tcpDropSynRate:
+		fields["limit"] = strconv.Itoa(int(t.limiter.SynRate))
+		err = newError("tcp syn rate limit of ", t.limiter.SynRate, "/s reached, dropped session to ", destination.NetAddr())
+	case tcpDropLimit:
+		fields["limit"] = strconv.Itoa(int(t.limiter.MaxConnections))
+		err = newError("tcp connection limit of ", t.limiter.MaxConnections, " reached, dropped connection to ", destination.NetAddr())
+	case tcpDropUidLimit:
+		fields["limit"] = strconv.Itoa(int(t.limiter.MaxConnectionsPerUid))
+		fields["uid"] = strconv.Itoa(int(uid))
+		err = newError("tcp connection limit of ", t.limiter.MaxConnectionsPerUid, " reached by uid ", uid, ", dropped connection to ", destination.NetAddr())
+	}
+	err.AtInfo().WriteToLog()
+	if t.limiter.drop(reason) {
+		go t.tun.eventHandler(&tun.Event{
+			Code:     comm.EventConnectionLimit,
+			Severity: comm.EventSeverityWarning,
+			Message:  err.String(),
+			Fields:   fields,
+		})
+	}
+}
+
+// TCPDrops returns the sessions dropped by the tcp forwarder.
+func (t *SystemTun) TCPDrops() TCPDrops {
+	drops := &t.tcpForwarder.limiter.drops
+	return TCPDrops{
+		Unknown:  atomic.LoadInt64(&drops[tcpDropUnknown]),
+		SynRate:  atomic.LoadInt64(&drops[tcpDropSynRate]),
+		Limit:    atomic.LoadInt64(&drops[tcpDropLimit]),
+		UidLimit: atomic.LoadInt64(&drops[tcpDropUidLimit]),
+	}
+}
@@ -0,0 +1,206 @@
+package nat
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun"
+	"libcore/tun/tuntest"
+)
+
+func TestTCPSynRate(t *testing.T) {
+	reports := make(chan *tun.Event, 4)
+	tun, device, _ := newLimitedTestTun(t, TCPLimit{SynRate: 2}, nil, func(event *tun.Event) {
+		reports <- event
+	})
+	destination := netip.MustParseAddrPort("1.1.1.1:443")
+	for port := uint16(40000); port < 40003; port++ {
+		err := device.Write(tuntest.TCPPacket(netip.AddrPortFrom(netip.MustParseAddr("172.19.0.1"), port), destination, header.TCPFlagSyn, 1000, 0, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, err := device.Expect(timeout, func(packet *tuntest.Packet) bool {
+			return packet.Protocol == header.TCPProtocolNumber
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := device.Expect(200*time.Millisecond, func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.TCPProtocolNumber
+	})
+	if err != tuntest.ErrTimeout {
+		t.Fatalf("expected the third session to be dropped, got %v", err)
+	}
+	if drops := tun.TCPDrops(); drops.SynRate != 1 {
+		t.Fatalf("unexpected drops %+v", drops)
+	}
+	select {
+	case event := <-reports:
+		if event.Code != comm.EventConnectionLimit || event.Fields["reason"] != "syn_rate" || event.Fields["limit"] != "2" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(timeout):
+		t.Fatal("syn rate limit not reported")
+	}
+}
+
+// freePort returns a loopback port to make a connection from, which is known
+// before the connection so its session can be started first.
+func freePort(t *testing.T) uint16 {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).AddrPort().Port()
+}
+
+// Connections to the forwarder are made from loopback, with the source ports
+// of sessions started on the device.
+func TestTCPConnectionLimit(t *testing.T) {
+	var uids sync.Map
+	reports := make(chan *tun.Event, 4)
+	tun, device, handler := newLimitedTestTun(t, TCPLimit{
+		MaxConnections:       2,
+		MaxConnectionsPerUid: 1,
+		Uid: func(source v2rayNet.Destination, destination v2rayNet.Destination) (uint16, error) {
+			uid, _ := uids.Load(source.Port)
+			return uid.(uint16), nil
+		},
+	}, nil, func(event *tun.Event) {
+		reports <- event
+	})
+	handler.conns = make(chan v2rayNet.Destination, 4)
+	forwarder := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), tun.tcpForwarder.port)
+
+	// A dropped connection may be reset before the dial returns.
+	connect := func(port uint16) (net.Conn, error) {
+		dialer := net.Dialer{LocalAddr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(forwarder.Addr(), port))}
+		conn, err := dialer.Dial("tcp", forwarder.String())
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		return conn, nil
+	}
+	dial := func(uid uint16) (uint16, net.Conn, error) {
+		port := freePort(t)
+		uids.Store(v2rayNet.Port(port), uid)
+		err := device.Write(tuntest.TCPPacket(netip.AddrPortFrom(netip.MustParseAddr("172.19.0.1"), port), netip.MustParseAddrPort("127.0.0.1:443"), header.TCPFlagSyn, 1000, 0, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = device.Expect(timeout, func(packet *tuntest.Packet) bool {
+			return packet.Protocol == header.TCPProtocolNumber && packet.Source.Port() == port
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := connect(port)
+		return port, conn, err
+	}
+	accepted := func(uid uint16) {
+		port, _, err := dial(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case source := <-handler.conns:
+			if source.Port != v2rayNet.Port(port) {
+				t.Fatalf("unexpected connection from %s", source)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("connection of uid %d not accepted", uid)
+		}
+	}
+	dropped := func(conn net.Conn, err error) {
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			_, err = conn.Read(make([]byte, 1))
+		}
+		if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("connection not dropped: %v", err)
+		}
+	}
+
+	accepted(1)
+	_, conn, err := dial(1)
+	dropped(conn, err)
+	accepted(2)
+	_, conn, err = dial(3)
+	dropped(conn, err)
+	if drops := tun.TCPDrops(); drops.UidLimit != 1 || drops.Limit != 1 {
+		t.Fatalf("unexpected drops %+v", drops)
+	}
+	reasons := make(map[string]string)
+	for len(reasons) < 2 {
+		select {
+		case event := <-reports:
+			reasons[event.Fields["reason"]] = event.Fields["uid"]
+		case <-time.After(timeout):
+			t.Fatal("connection limit not reported")
+		}
+	}
+	if uid, ok := reasons["uid_limit"]; !ok || uid != "1" {
+		t.Fatalf("unexpected events %v", reasons)
+	}
+
+	// No session was started for this port.
+	dropped(connect(freePort(t)))
+	if drops := tun.TCPDrops(); drops.Unknown != 1 {
+		t.Fatalf("unexpected drops %+v", drops)
+	}
+}
+
+func TestUDPPacketLimit(t *testing.T) {
+	device, err := tuntest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	// The first packet keeps the only slot until the handler returns.
+	handler := &testHandler{packets: make(chan udpPacket)}
+	limiter := tun.NewPacketLimiter(1)
+	tun, err := New(device.Detach(), 1500, handler, comm.IPv6Enable, nil, TCPLimit{}, limiter, func(event *tun.Event) {
+		t.Error(event.Message)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	for i := 0; i < 3; i++ {
+		err := device.Write(tuntest.UDPPacket(source, netip.MustParseAddrPort("1.1.1.1:53"), []byte{byte(i)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for limiter.Drops() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected two dropped packets, got %d", limiter.Drops())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if packet := <-handler.packets; packet.payload[0] != 0 {
+		t.Fatalf("unexpected packet %v", packet.payload)
+	}
+	select {
+	case packet := <-handler.packets:
+		t.Fatalf("packet %v not dropped", packet.payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -2,6 +2,7 @@ package nat
 
 import (
 	"os"
+	"syscall"
 
 	"github.com/v2fly/v2ray-core/v5/common/buf"
 	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
@@ -25,26 +26,40 @@ var (
 )
 
 type SystemTun struct {
-	dev          int
+	device       *os.File
+	rawDevice    syscall.RawConn
 	mtu          int
 	handler      tun.Handler
 	ipv6Mode     int32
 	tcpForwarder *tcpForwarder
-	errorHandler func(err string)
+	capture      tun.PacketCapture
+	udpLimiter   *tun.PacketLimiter
+	eventHandler func(event *tun.Event)
 }
 
-func New(dev int32, mtu int32, handler tun.Handler, ipv6Mode int32, errorHandler func(err string)) (*SystemTun, error) {
+// New starts a stack on the non-blocking descriptor dev, which is closed with
+// the stack. It is left to the caller if New fails.
+func New(dev int32, mtu int32, handler tun.Handler, ipv6Mode int32, capture tun.PacketCapture, tcpLimit TCPLimit, udpLimiter *tun.PacketLimiter, eventHandler func(event *tun.Event)) (*SystemTun, error) {
 	t := &SystemTun{
-		dev:          int(dev),
 		mtu:          int(mtu),
 		handler:      handler,
 		ipv6Mode:     ipv6Mode,
-		errorHandler: errorHandler,
+		capture:      capture,
+		udpLimiter:   udpLimiter,
+		eventHandler: eventHandler,
 	}
-	tcpServer, err := newTcpForwarder(t)
+	tcpServer, err := newTcpForwarder(t, tcpLimit)
 	if err != nil {
 		return nil, err
 	}
+	// The file registers the descriptor with the runtime poller, so closing
+	// it wakes up the dispatch loop.
+	t.device = os.NewFile(uintptr(dev), "tun")
+	t.rawDevice, err = t.device.SyscallConn()
+	if err != nil {
+		tcpServer.Close()
+		return nil, err
+	}
 	go tcpServer.dispatchLoop()
 	t.tcpForwarder = tcpServer
 
@@ -54,21 +69,24 @@ func New(dev int32, mtu int32, handler tun.Handler, ipv6Mode int32, errorHandler
 
 func (t *SystemTun) dispatchLoop() {
 	cache := buf.NewSize(int32(t.mtu))
-	defer cache.Release()
+	// Delivered packets keep the cache, release the one in use at the end.
+	defer func() {
+		cache.Release()
+	}()
 	data := cache.Use()
 
-	device := os.NewFile(uintptr(t.dev), "tun")
-	element := v2rayNet.AddConnection(device)
+	element := v2rayNet.AddConnection(t.device)
 	defer v2rayNet.RemoveConnection(element)
 
 	for {
-		n, err := device.Read(data)
+		n, err := t.device.Read(data)
 		if err != nil {
 			break
 		}
 		cache.Clear()
 		cache.Resize(0, int32(n))
 		packet := data[:n]
+		t.capturePacket(true, packet)
 		if t.deliverPacket(cache, packet) {
 			cache = buf.New()
 			data = cache.Extend(buf.Size)
@@ -82,11 +100,71 @@ func (t *SystemTun) writeRawPacket(vv buffer.VectorisedView) tcpip.Error {
 	for i, v := range views {
 		iovecs[i] = rawfile.IovecFromBytes(v)
 	}
-	return rawfile.NonBlockingWriteIovec(t.dev, iovecs)
+	if t.capture != nil {
+		packet := make([][]byte, len(views))
+		for i, v := range views {
+			packet[i] = v
+		}
+		t.capturePacket(false, packet...)
+	}
+	return t.write(func(fd int) tcpip.Error {
+		return rawfile.NonBlockingWriteIovec(fd, iovecs)
+	})
 }
 
 func (t *SystemTun) writeBuffer(bytes []byte) tcpip.Error {
-	return rawfile.NonBlockingWrite(t.dev, bytes)
+	t.capturePacket(false, bytes)
+	return t.write(func(fd int) tcpip.Error {
+		return rawfile.NonBlockingWrite(fd, bytes)
+	})
+}
+
+// write keeps the descriptor open while writing, packets written after Close
+// are dropped.
+func (t *SystemTun) write(write func(fd int) tcpip.Error) tcpip.Error {
+	var err tcpip.Error
+	if t.rawDevice.Control(func(fd uintptr) {
+		err = write(int(fd))
+	}) != nil {
+		return &tcpip.ErrClosedForSend{}
+	}
+	return err
+}
+
+func (t *SystemTun) capturePacket(inbound bool, packet ...[]byte) {
+	if t.capture == nil || t.forwarderPacket(inbound, packet[0]) {
+		return
+	}
+	t.capture.Capture(inbound, packet)
+}
+
+// forwarderPacket reports packets exchanged between the kernel and the tcp
+// forwarder, which are translated copies of what the application sees.
+func (t *SystemTun) forwarderPacket(inbound bool, packet []byte) bool {
+	var tcpHdr header.TCP
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		ipHdr := header.IPv4(packet)
+		if len(packet) < header.IPv4MinimumSize || int(ipHdr.HeaderLength()) > len(packet) || ipHdr.TransportProtocol() != header.TCPProtocolNumber {
+			return false
+		}
+		tcpHdr = header.TCP(packet[ipHdr.HeaderLength():])
+	case header.IPv6Version:
+		ipHdr := header.IPv6(packet)
+		if len(packet) < header.IPv6MinimumSize || ipHdr.TransportProtocol() != header.TCPProtocolNumber {
+			return false
+		}
+		tcpHdr = header.TCP(packet[header.IPv6MinimumSize:])
+	default:
+		return false
+	}
+	if len(tcpHdr) < 4 {
+		return false
+	}
+	if inbound {
+		return tcpHdr.SourcePort() == t.tcpForwarder.port
+	}
+	return tcpHdr.DestinationPort() == t.tcpForwarder.port
 }
 
 func (t *SystemTun) deliverPacket(cache *buf.Buffer, packet []byte) bool {
@@ -97,8 +175,7 @@ func (t *SystemTun) deliverPacket(cache *buf.Buffer, packet []byte) bool {
 		case header.TCPProtocolNumber:
 			t.tcpForwarder.processIPv4(ipHdr, ipHdr.Payload())
 		case header.UDPProtocolNumber:
-			t.processIPv4UDP(cache, ipHdr, ipHdr.Payload())
-			return true
+			return t.processIPv4UDP(cache, ipHdr, ipHdr.Payload())
 		case header.ICMPv4ProtocolNumber:
 			return t.processICMPv4(cache, ipHdr, ipHdr.Payload())
 		}
@@ -116,8 +193,7 @@ func (t *SystemTun) deliverPacket(cache *buf.Buffer, packet []byte) bool {
 		case header.TCPProtocolNumber:
 			t.tcpForwarder.processIPv6(ipHdr, ipHdr.Payload())
 		case header.UDPProtocolNumber:
-			t.processIPv6UDP(cache, ipHdr, ipHdr.Payload())
-			return true
+			return t.processIPv6UDP(cache, ipHdr, ipHdr.Payload())
 		case header.ICMPv6ProtocolNumber:
 			return t.processICMPv6(cache, ipHdr, ipHdr.Payload())
 		}
@@ -126,5 +202,6 @@ func (t *SystemTun) deliverPacket(cache *buf.Buffer, packet []byte) bool {
 }
 
 func (t *SystemTun) Close() error {
-	return t.tcpForwarder.Close()
+	t.tcpForwarder.Close()
+	return t.device.Close()
 }
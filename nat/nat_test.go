@@ -0,0 +1,314 @@
+package nat
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	"github.com/v2fly/v2ray-core/v5/common/net"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun"
+	"libcore/tun/tuntest"
+)
+
+const timeout = 5 * time.Second
+
+type udpPacket struct {
+	source      net.Destination
+	destination net.Destination
+	payload     []byte
+	writeBack   func([]byte, *net.UDPAddr) (int, error)
+}
+
+type testHandler struct {
+	packets chan udpPacket
+	pings   chan net.Destination
+	access  sync.Mutex
+	ping    func(closer io.Closer) bool
+	conns   chan net.Destination
+}
+
+// NewConnection holds the connection until it is closed by the peer when
+// conns is set.
+func (h *testHandler) NewConnection(source net.Destination, destination net.Destination, conn net.Conn) {
+	defer conn.Close()
+	if h.conns != nil {
+		h.conns <- source
+		_, _ = io.Copy(io.Discard, conn)
+	}
+}
+
+func (h *testHandler) NewPacket(source net.Destination, destination net.Destination, data *buf.Buffer, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) {
+	h.packets <- udpPacket{source, destination, append([]byte(nil), data.Bytes()...), writeBack}
+	data.Release()
+}
+
+func (h *testHandler) NewPingPacket(source net.Destination, destination net.Destination, message *buf.Buffer, writeBack func([]byte) error, closer io.Closer) bool {
+	h.pings <- destination
+	h.access.Lock()
+	ping := h.ping
+	h.access.Unlock()
+	if ping != nil {
+		return ping(closer)
+	}
+	return false
+}
+
+// setPing answers the pings with ping, it is set after the stack started.
+func (h *testHandler) setPing(ping func(closer io.Closer) bool) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	h.ping = ping
+}
+
+func newTestTun(t *testing.T) (*SystemTun, *tuntest.Device, *testHandler) {
+	return newLimitedTestTun(t, TCPLimit{}, nil, func(event *tun.Event) {
+		t.Error(event.Message)
+	})
+}
+
+func newLimitedTestTun(t *testing.T, limit TCPLimit, udpLimiter *tun.PacketLimiter, eventHandler func(event *tun.Event)) (*SystemTun, *tuntest.Device, *testHandler) {
+	device, err := tuntest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &testHandler{packets: make(chan udpPacket, 1), pings: make(chan net.Destination, 1)}
+	tun, err := New(device.Detach(), 1500, handler, comm.IPv6Enable, nil, limit, udpLimiter, eventHandler)
+	if err != nil {
+		device.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tun.Close()
+		device.Close()
+	})
+	return tun, device, handler
+}
+
+func TestUDP(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		source      netip.AddrPort
+		destination netip.AddrPort
+		remote      netip.AddrPort
+	}{
+		{"ipv4", netip.MustParseAddrPort("172.19.0.1:40000"), netip.MustParseAddrPort("1.1.1.1:53"), netip.MustParseAddrPort("8.8.8.8:5353")},
+		{"ipv6", netip.MustParseAddrPort("[fdfe:dcba:9876::1]:40000"), netip.MustParseAddrPort("[2606:4700::1111]:53"), netip.MustParseAddrPort("[2001:4860::8888]:5353")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, device, handler := newTestTun(t)
+			err := device.Write(tuntest.UDPPacket(c.source, c.destination, []byte("ping")))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var packet udpPacket
+			select {
+			case packet = <-handler.packets:
+			case <-time.After(timeout):
+				t.Fatal("udp packet not dispatched")
+			}
+			if packet.source.NetAddr() != c.source.String() || packet.destination.NetAddr() != c.destination.String() {
+				t.Fatalf("unexpected session %s -> %s", packet.source.NetAddr(), packet.destination.NetAddr())
+			}
+			if !bytes.Equal(packet.payload, []byte("ping")) {
+				t.Fatalf("unexpected payload %q", packet.payload)
+			}
+
+			// Replies without an address come from the original destination.
+			_, err = packet.writeBack([]byte("pong"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply, err := device.Expect(timeout, func(packet *tuntest.Packet) bool {
+				return packet.Protocol == header.UDPProtocolNumber
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Source != c.destination || reply.Destination != c.source || !bytes.Equal(reply.Payload, []byte("pong")) {
+				t.Fatalf("unexpected reply %s -> %s %q", reply.Source, reply.Destination, reply.Payload)
+			}
+
+			// Replies with an address are rewritten to come from it, and the
+			// header cache must not leak into the next reply.
+			_, err = packet.writeBack([]byte("pong from elsewhere"), &net.UDPAddr{IP: c.remote.Addr().AsSlice(), Port: int(c.remote.Port())})
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply, err = device.Expect(timeout, func(packet *tuntest.Packet) bool {
+				return packet.Protocol == header.UDPProtocolNumber
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Source != c.remote || reply.Destination != c.source || !bytes.Equal(reply.Payload, []byte("pong from elsewhere")) {
+				t.Fatalf("unexpected reply %s -> %s %q", reply.Source, reply.Destination, reply.Payload)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	tun, device, _ := newTestTun(t)
+	tun.Close()
+	// The dispatch loop wakes up and the descriptor gets closed.
+	packet := tuntest.UDPPacket(netip.MustParseAddrPort("172.19.0.1:40000"), netip.MustParseAddrPort("1.1.1.1:53"), []byte("ping"))
+	deadline := time.Now().Add(timeout)
+	for device.Write(packet) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("device not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		source      netip.AddrPort
+		destination netip.AddrPort
+		vlanClient  netip.Addr
+	}{
+		{"ipv4", netip.MustParseAddrPort("172.19.0.1:40000"), netip.MustParseAddrPort("1.1.1.1:443"), netip.MustParseAddr("172.19.0.1")},
+		{"ipv6", netip.MustParseAddrPort("[fdfe:dcba:9876::1]:40000"), netip.MustParseAddrPort("[2606:4700::1111]:443"), netip.MustParseAddr("fdfe:dcba:9876::1")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tun, device, _ := newTestTun(t)
+			port := tun.tcpForwarder.port
+
+			// Outgoing segments are redirected to the local forwarder.
+			err := device.Write(tuntest.TCPPacket(c.source, c.destination, header.TCPFlagSyn, 1000, 0, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			syn, err := device.Expect(timeout, func(packet *tuntest.Packet) bool {
+				return packet.Protocol == header.TCPProtocolNumber
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			forwarder := netip.AddrPortFrom(c.vlanClient, port)
+			if syn.Source != netip.AddrPortFrom(c.destination.Addr(), c.source.Port()) || syn.Destination != forwarder {
+				t.Fatalf("unexpected rewritten syn %s -> %s", syn.Source, syn.Destination)
+			}
+			if syn.TCPFlags != header.TCPFlagSyn || syn.Seq != 1000 {
+				t.Fatalf("unexpected rewritten syn flags %s seq %d", syn.TCPFlags, syn.Seq)
+			}
+
+			// Segments from the forwarder are mapped back to the original session.
+			err = device.Write(tuntest.TCPPacket(forwarder, syn.Source, header.TCPFlagSyn|header.TCPFlagAck, 5000, 1001, []byte("hello")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			synAck, err := device.Expect(timeout, func(packet *tuntest.Packet) bool {
+				return packet.Protocol == header.TCPProtocolNumber
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if synAck.Source != c.destination || synAck.Destination != c.source {
+				t.Fatalf("unexpected rewritten reply %s -> %s", synAck.Source, synAck.Destination)
+			}
+			if synAck.Ack != 1001 || !bytes.Equal(synAck.Payload, []byte("hello")) {
+				t.Fatalf("unexpected rewritten reply ack %d payload %q", synAck.Ack, synAck.Payload)
+			}
+		})
+	}
+}
+
+func TestICMPEcho(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		source      netip.Addr
+		destination netip.Addr
+		reply       uint8
+	}{
+		{"ipv4", netip.MustParseAddr("172.19.0.1"), netip.MustParseAddr("1.1.1.1"), uint8(header.ICMPv4EchoReply)},
+		{"ipv6", netip.MustParseAddr("fdfe:dcba:9876::1"), netip.MustParseAddr("2606:4700::1111"), uint8(header.ICMPv6EchoReply)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, device, handler := newTestTun(t)
+			err := device.Write(tuntest.ICMPEchoPacket(c.source, c.destination, 0x1234, 1, []byte("ping")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case destination := <-handler.pings:
+				if destination.Address.IP().String() != c.destination.String() {
+					t.Fatalf("unexpected ping destination %s", destination.Address)
+				}
+			case <-time.After(timeout):
+				t.Fatal("ping not dispatched")
+			}
+
+			// Unhandled pings are answered locally.
+			reply, err := device.Expect(timeout, func(packet *tuntest.Packet) bool {
+				return packet.ICMPType == c.reply
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Source.Addr() != c.destination || reply.Destination.Addr() != c.source {
+				t.Fatalf("unexpected echo reply %s -> %s", reply.Source, reply.Destination)
+			}
+			if reply.Ident != 0x1234 || reply.Sequence != 1 || !bytes.Equal(reply.Payload, []byte("ping")) {
+				t.Fatalf("unexpected echo reply ident %d sequence %d payload %q", reply.Ident, reply.Sequence, reply.Payload)
+			}
+		})
+	}
+}
+
+func TestICMPTimeExceeded(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		source      netip.Addr
+		destination netip.Addr
+		router      netip.Addr
+		icmpType    uint8
+	}{
+		{"ipv4", netip.MustParseAddr("172.19.0.1"), netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("10.0.0.1"), uint8(header.ICMPv4TimeExceeded)},
+		{"ipv6", netip.MustParseAddr("fdfe:dcba:9876::1"), netip.MustParseAddr("2606:4700::1111"), netip.MustParseAddr("2001:db8::1"), uint8(header.ICMPv6TimeExceeded)},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			_, device, handler := newTestTun(t)
+			handler.setPing(func(closer io.Closer) bool {
+				writer := closer.(tun.ICMPErrorWriter)
+				if writer.TTL() != 3 {
+					t.Errorf("unexpected ttl %d", writer.TTL())
+				}
+				if err := writer.WriteICMPError(c.router, c.icmpType, 0); err != nil {
+					t.Error(err)
+				}
+				closer.Close()
+				return true
+			})
+			request := tuntest.ICMPEchoPacket(c.source, c.destination, 0x1234, 1, []byte("ping"))
+			tuntest.SetTTL(request, 3)
+			err := device.Write(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The error comes from the router and quotes the request as sent.
+			reply, err := device.Expect(timeout, func(packet *tuntest.Packet) bool {
+				return packet.ICMPType == c.icmpType
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Source.Addr() != c.router || reply.Destination.Addr() != c.source {
+				t.Fatalf("unexpected time exceeded %s -> %s", reply.Source, reply.Destination)
+			}
+			if !bytes.Equal(reply.Payload, request[:len(request)-len("ping")]) {
+				t.Fatalf("unexpected quoted request %x", reply.Payload)
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"libcore/comm"
+	"libcore/tun"
 )
 
 type tcpForwarder struct {
@@ -18,9 +19,10 @@ type tcpForwarder struct {
 	port     uint16
 	listener *net.TCPListener
 	sessions *cache.LruCache
+	limiter  *tcpLimiter
 }
 
-func newTcpForwarder(tun *SystemTun) (*tcpForwarder, error) {
+func newTcpForwarder(tun *SystemTun, limit TCPLimit) (*tcpForwarder, error) {
 	var network string
 	address := &net.TCPAddr{}
 	if tun.ipv6Mode == comm.IPv6Disable {
@@ -40,7 +42,7 @@ func newTcpForwarder(tun *SystemTun) (*tcpForwarder, error) {
 	return &tcpForwarder{tun, port, listener, cache.NewLRUCache(
 		cache.WithAge(300),
 		cache.WithUpdateAgeOnGet(),
-	)}, nil
+	), newTcpLimiter(limit)}, nil
 }
 
 func (t *tcpForwarder) dispatch() (bool, error) {
@@ -58,6 +60,7 @@ func (t *tcpForwarder) dispatch() (bool, error) {
 	if ok {
 		session = iSession.(*peerValue)
 	} else {
+		t.limiter.drop(tcpDropUnknown)
 		conn.Close()
 		return false, newError("dropped unknown tcp session with source port ", key.sourcePort, " to destination address ", key.destinationAddress)
 	}
@@ -73,8 +76,20 @@ func (t *tcpForwarder) dispatch() (bool, error) {
 		Network: v2rayNet.Network_TCP,
 	}
 
+	// The limits are checked off the accept loop, as finding the uid may
+	// take a while.
 	go func() {
+		release, uid, reason := t.limiter.acquire(source, destination)
+		if release == nil {
+			t.limitExceeded(reason, destination, uid)
+			// Reset so the application fails fast and no socket lingers.
+			conn.SetLinger(0)
+			conn.Close()
+			t.sessions.Delete(key)
+			return
+		}
 		t.tun.handler.NewConnection(source, destination, conn)
+		release()
 		time.Sleep(time.Second * 5)
 		t.sessions.Delete(key)
 	}()
@@ -91,7 +106,15 @@ func (t *tcpForwarder) dispatchLoop() {
 			if stop {
 				if !errors.Is(err, net.ErrClosed) {
 					t.Close()
-					t.tun.errorHandler(e.String())
+					t.tun.eventHandler(&tun.Event{
+						Code:     comm.EventTunStopped,
+						Severity: comm.EventSeverityError,
+						Message:  e.String(),
+						Fields: map[string]string{
+							"implementation": "system",
+							"error":          err.Error(),
+						},
+					})
 				}
 				return
 			}
@@ -114,6 +137,9 @@ func (t *tcpForwarder) processIPv4(ipHdr header.IPv4, tcpHdr header.TCP) {
 		if ok {
 			session = iSession.(*peerValue)
 		} else {
+			if !t.allowSession(destinationAddress, destinationPort) {
+				return
+			}
 			session = &peerValue{sourceAddress, destinationPort}
 			t.sessions.Set(key, session)
 		}
@@ -162,6 +188,9 @@ func (t *tcpForwarder) processIPv6(ipHdr header.IPv6, tcpHdr header.TCP) {
 		if ok {
 			session = iSession.(*peerValue)
 		} else {
+			if !t.allowSession(destinationAddress, destinationPort) {
+				return
+			}
 			session = &peerValue{sourceAddress, destinationPort}
 			t.sessions.Set(key, session)
 		}
@@ -6,10 +6,14 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
-	"libcore/comm"
+	"libcore/tun"
 )
 
-func (t *SystemTun) processIPv4UDP(cache *buf.Buffer, ipHdr header.IPv4, hdr header.UDP) {
+func (t *SystemTun) processIPv4UDP(cache *buf.Buffer, ipHdr header.IPv4, hdr header.UDP) bool {
+	if !t.udpLimiter.Acquire() {
+		return false
+	}
+
 	sourceAddress := ipHdr.SourceAddress()
 	destinationAddress := ipHdr.DestinationAddress()
 	sourcePort := hdr.SourcePort()
@@ -34,7 +38,7 @@ func (t *SystemTun) processIPv4UDP(cache *buf.Buffer, ipHdr header.IPv4, hdr hea
 	headerCache.Write(ipHdr[:headerLength+header.UDPMinimumSize])
 
 	cache.Advance(int32(headerLength + header.UDPMinimumSize))
-	go t.handler.NewPacket(source, destination, cache, func(bytes []byte, addr *v2rayNet.UDPAddr) (int, error) {
+	writeBack := func(bytes []byte, addr *v2rayNet.UDPAddr) (int, error) {
 		index := headerCache.Len()
 		newHeader := headerCache.ExtendCopy(headerCache.Bytes())
 		headerCache.Advance(index)
@@ -76,10 +80,19 @@ func (t *SystemTun) processIPv4UDP(cache *buf.Buffer, ipHdr header.IPv4, hdr hea
 		}
 
 		return len(bytes), nil
-	}, comm.Closer(headerCache.Release))
+	}
+	go func() {
+		t.handler.NewPacket(source, destination, cache, writeBack, &udpCloser{t, headerCache, destinationAddress, destinationPort})
+		t.udpLimiter.Release()
+	}()
+	return true
 }
 
-func (t *SystemTun) processIPv6UDP(cache *buf.Buffer, ipHdr header.IPv6, hdr header.UDP) {
+func (t *SystemTun) processIPv6UDP(cache *buf.Buffer, ipHdr header.IPv6, hdr header.UDP) bool {
+	if !t.udpLimiter.Acquire() {
+		return false
+	}
+
 	sourceAddress := ipHdr.SourceAddress()
 	destinationAddress := ipHdr.DestinationAddress()
 	sourcePort := hdr.SourcePort()
@@ -104,7 +117,7 @@ func (t *SystemTun) processIPv6UDP(cache *buf.Buffer, ipHdr header.IPv6, hdr hea
 	headerCache.Write(ipHdr[:headerLength+header.UDPMinimumSize])
 
 	cache.Advance(int32(headerLength + header.UDPMinimumSize))
-	go t.handler.NewPacket(source, destination, cache, func(bytes []byte, addr *v2rayNet.UDPAddr) (int, error) {
+	writeBack := func(bytes []byte, addr *v2rayNet.UDPAddr) (int, error) {
 		index := headerCache.Len()
 		newHeader := headerCache.ExtendCopy(headerCache.Bytes())
 		headerCache.Advance(index)
@@ -144,5 +157,43 @@ func (t *SystemTun) processIPv6UDP(cache *buf.Buffer, ipHdr header.IPv6, hdr hea
 		}
 
 		return len(bytes), nil
-	}, comm.Closer(headerCache.Release))
+	}
+	go func() {
+		t.handler.NewPacket(source, destination, cache, writeBack, &udpCloser{t, headerCache, destinationAddress, destinationPort})
+		t.udpLimiter.Release()
+	}()
+	return true
+}
+
+// udpCloser releases the reply header of a packet. The header still holds the
+// original source, so a rejected packet can be quoted in ICMP errors.
+type udpCloser struct {
+	tun                *SystemTun
+	headerCache        *buf.Buffer
+	destinationAddress tcpip.Address
+	destinationPort    uint16
+}
+
+func (c *udpCloser) Close() error {
+	c.headerCache.Release()
+	return nil
+}
+
+func (c *udpCloser) Reject(reason tun.Unreachable) error {
+	origin := buffer.NewViewFromBytes(c.headerCache.Bytes())
+	header.UDP(origin[len(origin)-header.UDPMinimumSize:]).SetDestinationPort(c.destinationPort)
+	if header.IPVersion(origin) == header.IPv4Version {
+		ipHdr := header.IPv4(origin)
+		ipHdr.SetDestinationAddress(c.destinationAddress)
+		ipHdr.SetChecksum(0)
+		ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+	} else {
+		header.IPv6(origin).SetDestinationAddress(c.destinationAddress)
+	}
+
+	backData := buffer.NewViewFromBytes(tun.ICMPUnreachable(origin, reason)).ToVectorisedView()
+	if err := c.tun.writeRawPacket(backData); err != nil {
+		return newError("failed to write packet to device: ", err.String())
+	}
+	return nil
 }
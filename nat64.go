@@ -0,0 +1,271 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"github.com/v2fly/v2ray-core/v5/features/dns/localdns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	nat64DiscoveryHost    = "ipv4only.arpa"
+	nat64DiscoveryTimeout = 5 * time.Second
+	dns64DefaultTTL       = 60
+)
+
+var (
+	nat64WellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+	// ipv4only.arpa resolves to these, RFC 7050 finds the prefix around them.
+	nat64DiscoveryAddrs = []netip.Addr{netip.AddrFrom4([4]byte{192, 0, 0, 170}), netip.AddrFrom4([4]byte{192, 0, 0, 171})}
+	// Prefix lengths of RFC 6052, longest first.
+	nat64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+)
+
+func parseNAT64Prefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, newError("invalid nat64 prefix ", s).Base(err)
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return netip.Prefix{}, newError("nat64 prefix ", s, " is not ipv6")
+	}
+	for _, bits := range nat64PrefixLengths {
+		if prefix.Bits() == bits {
+			return prefix.Masked(), nil
+		}
+	}
+	return netip.Prefix{}, newError("invalid nat64 prefix length ", prefix.Bits())
+}
+
+// nat64Embed places ip4 after prefix as RFC 6052 section 2.2, skipping the
+// reserved bits 64 to 71.
+func nat64Embed(prefix netip.Prefix, ip4 netip.Addr) netip.Addr {
+	ip6 := prefix.Addr().As16()
+	offset := prefix.Bits() / 8
+	for _, b := range ip4.As4() {
+		if offset == 8 {
+			offset++
+		}
+		ip6[offset] = b
+		offset++
+	}
+	return netip.AddrFrom16(ip6)
+}
+
+func nat64Extract(prefix netip.Prefix, ip6 netip.Addr) (netip.Addr, bool) {
+	if !ip6.Is6() || ip6.Is4In6() || !prefix.Contains(ip6) {
+		return netip.Addr{}, false
+	}
+	bytes := ip6.As16()
+	var ip4 [4]byte
+	offset := prefix.Bits() / 8
+	for i := range ip4 {
+		if offset == 8 {
+			offset++
+		}
+		ip4[i] = bytes[offset]
+		offset++
+	}
+	return netip.AddrFrom4(ip4), true
+}
+
+// findNAT64Prefix looks for the addresses of ipv4only.arpa in its AAAA
+// answers, as RFC 7050 section 3.
+func findNAT64Prefix(ips []net.IP) (netip.Prefix, error) {
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok || !addr.Is6() || addr.Is4In6() {
+			continue
+		}
+		for _, bits := range nat64PrefixLengths {
+			prefix := netip.PrefixFrom(addr, bits).Masked()
+			ip4, _ := nat64Extract(prefix, addr)
+			for _, discoveryAddr := range nat64DiscoveryAddrs {
+				if ip4 == discoveryAddr {
+					return prefix, nil
+				}
+			}
+		}
+	}
+	return netip.Prefix{}, newError("no nat64 prefix in answers of ", nat64DiscoveryHost)
+}
+
+// nat64Translator maps IPv4 destinations into the NAT64 prefix when they
+// leave the device, like a CLAT. Without TunConfig.NAT64Prefix the prefix is
+// discovered on start. A nil translator or one without a prefix leaves
+// addresses alone.
+type nat64Translator struct {
+	access sync.RWMutex
+	prefix netip.Prefix
+}
+
+func (n *nat64Translator) load() (netip.Prefix, bool) {
+	if n == nil {
+		return netip.Prefix{}, false
+	}
+	n.access.RLock()
+	defer n.access.RUnlock()
+	return n.prefix, n.prefix.IsValid()
+}
+
+func (n *nat64Translator) store(prefix netip.Prefix) {
+	n.access.Lock()
+	defer n.access.Unlock()
+	n.prefix = prefix
+}
+
+func (n *nat64Translator) translate(ip net.IP) net.IP {
+	prefix, ok := n.load()
+	if !ok {
+		return ip
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || !addr.Unmap().Is4() {
+		return ip
+	}
+	addr = addr.Unmap()
+	// The well-known prefix must not carry private addresses, RFC 6052 section 3.1.
+	if !addr.IsGlobalUnicast() || prefix == nat64WellKnownPrefix && addr.IsPrivate() {
+		return ip
+	}
+	return nat64Embed(prefix, addr).AsSlice()
+}
+
+// restore turns a destination inside the prefix, as dialed by applications
+// after DNS64, back into IPv4 so it is routed and proxied like one.
+func (n *nat64Translator) restore(destination *v2rayNet.Destination) bool {
+	prefix, ok := n.load()
+	if !ok || !destination.Address.Family().IsIPv6() {
+		return false
+	}
+	addr, _ := netip.AddrFromSlice(destination.Address.IP())
+	ip4, ok := nat64Extract(prefix, addr)
+	if !ok {
+		return false
+	}
+	destination.Address = v2rayNet.IPAddress(ip4.AsSlice())
+	return true
+}
+
+// synthesize adds AAAA records made from the A records of the name to an
+// AAAA response without any, as DNS64. Other responses return nil.
+func (n *nat64Translator) synthesize(response []byte, lookup func(domain string) ([]net.IP, uint32, error)) []byte {
+	prefix, ok := n.load()
+	if !ok {
+		return nil
+	}
+	var message dnsmessage.Message
+	err := message.Unpack(response)
+	if err != nil || !message.Response || message.RCode != dnsmessage.RCodeSuccess || len(message.Questions) != 1 {
+		return nil
+	}
+	question := message.Questions[0]
+	if question.Class != dnsmessage.ClassINET || question.Type != dnsmessage.TypeAAAA {
+		return nil
+	}
+	name := question.Name
+	for _, answer := range message.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AAAAResource:
+			return nil
+		case *dnsmessage.CNAMEResource:
+			if strings.EqualFold(answer.Header.Name.String(), name.String()) {
+				name = body.CNAME
+			}
+		}
+	}
+	ips, ttl, err := lookup(strings.TrimSuffix(name.String(), "."))
+	if err != nil {
+		return nil
+	}
+	if ttl == 0 {
+		ttl = dns64DefaultTTL
+	}
+	var synthesized int
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok || !addr.Unmap().Is4() || !addr.Unmap().IsGlobalUnicast() {
+			continue
+		}
+		message.Answers = append(message.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  name,
+				Type:  dnsmessage.TypeAAAA,
+				Class: dnsmessage.ClassINET,
+				TTL:   ttl,
+			},
+			Body: &dnsmessage.AAAAResource{AAAA: nat64Embed(prefix, addr.Unmap()).As16()},
+		})
+		synthesized++
+	}
+	if synthesized == 0 {
+		return nil
+	}
+	message.Authorities = nil
+	response, err = message.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// nat64PacketConn translates the peers of a UDP socket opened by the
+// protected dialer.
+type nat64PacketConn struct {
+	net.PacketConn
+	nat64 *nat64Translator
+}
+
+func (c *nat64PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		addr = &net.UDPAddr{IP: c.nat64.translate(udpAddr.IP), Port: udpAddr.Port}
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *nat64PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		destination := v2rayNet.UDPDestination(v2rayNet.IPAddress(udpAddr.IP), v2rayNet.Port(udpAddr.Port))
+		if c.nat64.restore(&destination) {
+			addr = &net.UDPAddr{IP: destination.Address.IP(), Port: udpAddr.Port}
+		}
+	}
+	return n, addr, err
+}
+
+// DiscoverNAT64Prefix looks the NAT64 prefix up on the underlying network
+// as RFC 7050, it should be called again when the network changes.
+func (t *Tun2ray) DiscoverNAT64Prefix() error {
+	if t.nat64 == nil {
+		return newError("nat64 is not enabled")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nat64DiscoveryTimeout)
+	defer cancel()
+	ips, _, err := localdns.Client().Lookup(ctx, nat64DiscoveryHost, dns.QueryStrategy_USE_IP6)
+	if err != nil {
+		return newError("failed to resolve ", nat64DiscoveryHost).Base(err)
+	}
+	prefix, err := findNAT64Prefix(ips)
+	if err != nil {
+		return err
+	}
+	t.nat64.store(prefix)
+	newError("discovered nat64 prefix ", prefix).AtInfo().WriteToLog()
+	return nil
+}
+
+// NAT64Prefix returns the prefix in use, or an empty string.
+func (t *Tun2ray) NAT64Prefix() string {
+	if prefix, ok := t.nat64.load(); ok {
+		return prefix.String()
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package libcore
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNAT64Embed(t *testing.T) {
+	ip4 := netip.MustParseAddr("192.0.2.33")
+	// RFC 6052 section 2.4.
+	for _, test := range []struct {
+		prefix string
+		ip6    string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	} {
+		prefix, err := parseNAT64Prefix(test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip6 := nat64Embed(prefix, ip4)
+		if ip6 != netip.MustParseAddr(test.ip6) {
+			t.Fatalf("%s: expected %s, got %s", test.prefix, test.ip6, ip6)
+		}
+		if extracted, ok := nat64Extract(prefix, ip6); !ok || extracted != ip4 {
+			t.Fatalf("%s: extracted %s", test.prefix, extracted)
+		}
+	}
+	for _, prefix := range []string{"2001:db8::/33", "192.0.2.0/24", "64:ff9b"} {
+		if _, err := parseNAT64Prefix(prefix); err == nil {
+			t.Fatalf("expected error for prefix %s", prefix)
+		}
+	}
+}
+
+func TestFindNAT64Prefix(t *testing.T) {
+	prefix, err := findNAT64Prefix([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("64:ff9b::c000:aa")})
+	if err != nil || prefix != nat64WellKnownPrefix {
+		t.Fatalf("unexpected prefix %s %v", prefix, err)
+	}
+	prefix, err = findNAT64Prefix([]net.IP{net.ParseIP("2001:db8:122:344:c0:0:ab00:0")})
+	if err != nil || prefix != netip.MustParsePrefix("2001:db8:122:344::/64") {
+		t.Fatalf("unexpected prefix %s %v", prefix, err)
+	}
+	if _, err = findNAT64Prefix([]net.IP{net.ParseIP("192.0.0.170")}); err == nil {
+		t.Fatal("expected error without ipv6 answers")
+	}
+}
+
+func TestNAT64Translate(t *testing.T) {
+	var disabled *nat64Translator
+	if ip := disabled.translate(net.ParseIP("1.1.1.1")); !ip.Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatalf("disabled translator changed address to %s", ip)
+	}
+	translator := &nat64Translator{prefix: nat64WellKnownPrefix}
+	for _, test := range []struct {
+		ip         string
+		translated string
+	}{
+		{"1.1.1.1", "64:ff9b::101:101"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"127.0.0.1", "127.0.0.1"},
+		{"2001:db8::1", "2001:db8::1"},
+	} {
+		if ip := translator.translate(net.ParseIP(test.ip)); !ip.Equal(net.ParseIP(test.translated)) {
+			t.Fatalf("%s: expected %s, got %s", test.ip, test.translated, ip)
+		}
+	}
+	destination := v2rayNet.TCPDestination(v2rayNet.ParseAddress("64:ff9b::101:101"), 443)
+	if !translator.restore(&destination) || destination.Address.String() != "1.1.1.1" {
+		t.Fatalf("unexpected restored destination %s", destination)
+	}
+	if translator.restore(&destination) {
+		t.Fatal("restored an ipv4 destination")
+	}
+}
+
+func TestDNS64Synthesize(t *testing.T) {
+	translator := &nat64Translator{prefix: nat64WellKnownPrefix}
+	name := dnsmessage.MustNewName("example.com.")
+	response := func(answers ...dnsmessage.Resource) []byte {
+		message := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 1, Response: true},
+			Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}},
+			Answers:   answers,
+			Authorities: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.SOAResource{NS: name, MBox: name},
+			}},
+		}
+		packed, err := message.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packed
+	}
+	var lookups []string
+	lookup := func(domain string) ([]net.IP, uint32, error) {
+		lookups = append(lookups, domain)
+		return []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("127.0.0.1")}, 30, nil
+	}
+
+	synthesized := translator.synthesize(response(), lookup)
+	var message dnsmessage.Message
+	if err := message.Unpack(synthesized); err != nil {
+		t.Fatal(err)
+	}
+	if len(lookups) != 1 || lookups[0] != "example.com" {
+		t.Fatalf("unexpected lookups %v", lookups)
+	}
+	if message.ID != 1 || len(message.Answers) != 1 || len(message.Authorities) != 0 {
+		t.Fatalf("unexpected response %+v", message)
+	}
+	answer := message.Answers[0]
+	if answer.Header.TTL != 30 || netip.AddrFrom16(answer.Body.(*dnsmessage.AAAAResource).AAAA) != netip.MustParseAddr("64:ff9b::102:304") {
+		t.Fatalf("unexpected answer %+v", answer)
+	}
+
+	existing := response(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("2001:db8::1").As16()},
+	})
+	if translator.synthesize(existing, lookup) != nil || len(lookups) != 1 {
+		t.Fatal("synthesized records next to real ones")
+	}
+}
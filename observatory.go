@@ -8,10 +8,11 @@ import (
 )
 
 func (instance *V2RayInstance) GetObservatoryStatus(tag string) ([]byte, error) {
-	if instance.observatory == nil {
+	v2ray := instance.load()
+	if v2ray == nil || v2ray.observatory == nil {
 		return nil, newError("observatory unavailable")
 	}
-	observer, err := instance.observatory.GetFeaturesByTag(tag)
+	observer, err := v2ray.observatory.GetFeaturesByTag(tag)
 	if err != nil {
 		return nil, err
 	}
@@ -23,7 +24,8 @@ func (instance *V2RayInstance) GetObservatoryStatus(tag string) ([]byte, error)
 }
 
 func (instance *V2RayInstance) UpdateStatus(tag string, status []byte) error {
-	if instance.observatory == nil {
+	v2ray := instance.load()
+	if v2ray == nil || v2ray.observatory == nil {
 		return newError("observatory unavailable")
 	}
 
@@ -33,7 +35,7 @@ func (instance *V2RayInstance) UpdateStatus(tag string, status []byte) error {
 		return err
 	}
 
-	observer, err := instance.observatory.GetFeaturesByTag(tag)
+	observer, err := v2ray.observatory.GetFeaturesByTag(tag)
 	if err != nil {
 		return err
 	}
@@ -46,14 +48,18 @@ type ObservatoryStatusUpdateListener interface {
 }
 
 func (instance *V2RayInstance) SetStatusUpdateListener(tag string, listener ObservatoryStatusUpdateListener) error {
+	v2ray := instance.load()
+	if v2ray == nil || v2ray.observatory == nil {
+		return newError("observatory unavailable")
+	}
 	if listener == nil {
-		observer, err := instance.observatory.GetFeaturesByTag(tag)
+		observer, err := v2ray.observatory.GetFeaturesByTag(tag)
 		if err != nil {
 			return err
 		}
 		observer.(*observatory.Observer).StatusUpdate = nil
 	} else {
-		observer, err := instance.observatory.GetFeaturesByTag(tag)
+		observer, err := v2ray.observatory.GetFeaturesByTag(tag)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,229 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	gonet "net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/dispatcher"
+	"github.com/v2fly/v2ray-core/v5/app/proxyman"
+	"github.com/v2fly/v2ray-core/v5/common/net"
+	commonSerial "github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+	v4 "github.com/v2fly/v2ray-core/v5/infra/conf/v4"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	TestErrorTimeout    = "timeout"
+	TestErrorConnection = "connection"
+	TestErrorTLS        = "tls"
+	TestErrorHTTP       = "http"
+	TestErrorConfig     = "config"
+	TestErrorUnknown    = "unknown"
+)
+
+type OutboundTestResult struct {
+	// Index is the position of the outbound in the request.
+	Index    int32
+	Outbound string
+	// Latency and TLSHandshake are in milliseconds, zero on failure.
+	Latency      int32
+	TLSHandshake int32
+	// ErrorClass is one of the TestError constants, empty on success.
+	ErrorClass string
+	Error      string
+}
+
+type OutboundTestListener interface {
+	OnOutboundTestResult(result *OutboundTestResult)
+}
+
+// TestOutbounds measures link through each outbound in outbounds, a JSON
+// array of outbound tags or outbound objects, running at most concurrency
+// tests at once. Results are passed to listener as they finish, and the call
+// returns when all tests are done. Outbound objects run in a core of their
+// own and are never seen by the running one.
+func (instance *V2RayInstance) TestOutbounds(outbounds string, link string, timeout int32, concurrency int32, listener OutboundTestListener) error {
+	if timeout <= 0 {
+		return newError("invalid timeout ", timeout)
+	}
+	if listener == nil {
+		return newError("missing listener")
+	}
+	var items []json.RawMessage
+	err := json.Unmarshal([]byte(outbounds), &items)
+	if err != nil {
+		return newError("invalid outbound list").Base(err)
+	}
+	request, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return err
+	}
+	v2ray := instance.acquire()
+	if v2ray == nil {
+		return newError("v2ray instance not started")
+	}
+	defer v2ray.release()
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var access sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, concurrency)
+	for i, item := range items {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(index int, item json.RawMessage) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			result := v2ray.testOutbound(index, item, request, time.Duration(timeout)*time.Millisecond)
+			access.Lock()
+			listener.OnOutboundTestResult(result)
+			access.Unlock()
+		}(i, item)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (v2ray *v2rayCore) testOutbound(index int, item json.RawMessage, request *http.Request, timeout time.Duration) *OutboundTestResult {
+	result := &OutboundTestResult{Index: int32(index)}
+	var tag string
+	if json.Unmarshal(item, &tag) != nil {
+		testCore, err := newTestCore(index, item)
+		if err != nil {
+			result.ErrorClass = TestErrorConfig
+			result.Error = err.Error()
+			return result
+		}
+		defer testCore.core.Close()
+		v2ray = testCore
+		tag = v2ray.outboundManager.GetDefaultHandler().Tag()
+	}
+	result.Outbound = tag
+	if v2ray.outboundManager.GetHandler(tag) == nil {
+		result.ErrorClass = TestErrorConfig
+		result.Error = fmt.Sprint("outbound ", tag, " not found")
+		return result
+	}
+
+	var tlsStart time.Time
+	var tlsHandshake time.Duration
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			tlsHandshake = time.Since(tlsStart)
+		},
+	})
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (gonet.Conn, error) {
+			destination, err := net.ParseDestination(fmt.Sprintf("%s:%s", network, addr))
+			if err != nil {
+				return nil, err
+			}
+			ctx = session.ContextWithInbound(ctx, &session.Inbound{Tag: "test"})
+			ctx = session.SetForcedOutboundTagToContext(ctx, tag)
+			return v2ray.dialContext(ctx, destination)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	req := request.Clone(ctx)
+	req.Header.Set("User-Agent", fmt.Sprintf("curl/7.%d.%d", rand.Int()%54, rand.Int()%2))
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+			result.ErrorClass = TestErrorHTTP
+			result.Error = fmt.Sprint("unexpected response status: ", resp.StatusCode)
+			return result
+		}
+	} else {
+		result.ErrorClass = classifyTestError(ctx, err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Latency = int32(time.Since(start).Milliseconds())
+	result.TLSHandshake = int32(tlsHandshake.Milliseconds())
+	return result
+}
+
+// newTestCore starts a core with item as its only outbound. It has no log
+// app, which would replace the handler of the running core.
+func newTestCore(index int, item json.RawMessage) (*v2rayCore, error) {
+	config := new(v4.OutboundDetourConfig)
+	err := json.Unmarshal(item, config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Tag == "" {
+		config.Tag = fmt.Sprint("test-", index)
+	}
+	handler, err := config.Build()
+	if err != nil {
+		return nil, err
+	}
+	c, err := core.New(&core.Config{
+		App: []*anypb.Any{
+			commonSerial.ToTypedMessage(&dispatcher.Config{}),
+			commonSerial.ToTypedMessage(&proxyman.OutboundConfig{}),
+		},
+		Outbound: []*core.OutboundHandlerConfig{handler},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = c.Start()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &v2rayCore{
+		core:            c,
+		dispatcher:      c.GetFeature(routing.DispatcherType()).(routing.Dispatcher),
+		outboundManager: c.GetFeature(outbound.ManagerType()).(outbound.Manager),
+	}, nil
+}
+
+func classifyTestError(ctx context.Context, err error) string {
+	var netErr gonet.Error
+	var recordHeaderErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateErr x509.CertificateInvalidError
+	switch {
+	case ctx.Err() != nil, errors.As(err, &netErr) && netErr.Timeout():
+		return TestErrorTimeout
+	case errors.As(err, &recordHeaderErr), errors.As(err, &unknownAuthorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &certificateErr):
+		return TestErrorTLS
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return TestErrorConnection
+	}
+	return TestErrorUnknown
+}
@@ -0,0 +1,127 @@
+package libcore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type testOutboundListener struct {
+	access  sync.Mutex
+	results map[int32]*OutboundTestResult
+}
+
+func (l *testOutboundListener) OnOutboundTestResult(result *OutboundTestResult) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	l.results[result.Index] = result
+}
+
+func TestTestOutbounds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	instance := NewV2rayInstance()
+	err := instance.LoadConfig(`{
+  "log": {"loglevel": "none"},
+  "outbounds": [
+    {"protocol": "freedom", "tag": "direct"},
+    {"protocol": "blackhole", "tag": "block"}
+  ]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.Start(testErrorHandler{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	outbounds := `["direct", {"protocol": "freedom"}, "missing", {"protocol": "unknown"}, "block"]`
+	listener := &testOutboundListener{results: make(map[int32]*OutboundTestResult)}
+	err = instance.TestOutbounds(outbounds, server.URL+"/generate_204", 2000, 2, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listener.results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(listener.results))
+	}
+	for _, index := range []int32{0, 1} {
+		result := listener.results[index]
+		if result.ErrorClass != "" || result.Outbound == "" {
+			t.Fatalf("unexpected result %+v", *result)
+		}
+	}
+	for index, errorClass := range map[int32]string{2: TestErrorConfig, 3: TestErrorConfig, 4: TestErrorConnection} {
+		result := listener.results[index]
+		if result.ErrorClass != errorClass {
+			t.Fatalf("unexpected result %+v, expected error class %s", *result, errorClass)
+		}
+	}
+
+	listener = &testOutboundListener{results: make(map[int32]*OutboundTestResult)}
+	err = instance.TestOutbounds(`["direct"]`, server.URL+"/missing", 2000, 1, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := listener.results[0]; result.ErrorClass != TestErrorHTTP {
+		t.Fatalf("unexpected result %+v", *result)
+	}
+
+	err = instance.TestOutbounds("not json", server.URL, 2000, 1, listener)
+	if err == nil {
+		t.Fatal("expected error for invalid outbound list")
+	}
+	err = instance.TestOutbounds(`["direct"]`, server.URL, 0, 1, listener)
+	if err == nil {
+		t.Fatal("expected error for zero timeout")
+	}
+	err = instance.TestOutbounds(`["direct"]`, server.URL, 2000, 1, nil)
+	if err == nil {
+		t.Fatal("expected error for missing listener")
+	}
+}
+
+func TestTestOutboundsIsolated(t *testing.T) {
+	instance := NewV2rayInstance()
+	err := instance.LoadConfig(`{
+  "log": {"loglevel": "none"},
+  "outbounds": [{"protocol": "freedom", "tag": "direct"}]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.Start(testErrorHandler{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	// The running core must not see the outbound while it is tested.
+	var visible bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		visible = instance.load().outboundManager.GetHandler("probe") != nil
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	listener := &testOutboundListener{results: make(map[int32]*OutboundTestResult)}
+	err = instance.TestOutbounds(`[{"protocol": "freedom", "tag": "probe"}]`, server.URL, 2000, 1, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := listener.results[0]; result.ErrorClass != "" || result.Outbound != "probe" {
+		t.Fatalf("unexpected result %+v", *result)
+	}
+	if visible {
+		t.Fatal("test outbound added to the running core")
+	}
+}
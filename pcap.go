@@ -0,0 +1,362 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/common/cache"
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	pcapDir            = "pcap"
+	pcapLinkTypeRaw    = 101
+	defaultPCapSnapLen = 65535
+)
+
+const (
+	pcapngSectionHeaderBlock   = 0x0a0d0d0a
+	pcapngInterfaceBlock       = 1
+	pcapngEnhancedPacketBlock  = 6
+	pcapngByteOrderMagic       = 0x1a2b3c4d
+	pcapngOptionEnd            = 0
+	pcapngOptionComment        = 1
+	pcapngOptionInterfaceName  = 2
+	pcapngOptionFlags          = 2
+	pcapngFlagInbound          = 1
+	pcapngFlagOutbound         = 2
+	pcapngPacketBlockFixedSize = 32
+)
+
+// pcapPendingPackets caps the packets of a connection held back by the uid
+// filter until the tun handler tells its owner.
+const pcapPendingPackets = 16
+
+// pcapMaxFlows caps the connections annotating packets, so a flood of short
+// flows doesn't grow them for their 300 second age.
+const pcapMaxFlows = 4096
+
+// captureFlow annotates the packets of a connection, keyed by its
+// application side address.
+type captureFlow struct {
+	annotated   bool
+	uid         int32
+	packageName string
+	outbound    string
+	pending     [][]byte
+}
+
+func (f *captureFlow) comment() string {
+	var parts []string
+	if f.uid >= 0 {
+		if f.packageName != "" {
+			parts = append(parts, fmt.Sprint("uid ", f.uid, " (", f.packageName, ")"))
+		} else {
+			parts = append(parts, fmt.Sprint("uid ", f.uid))
+		}
+	}
+	if f.outbound != "" {
+		parts = append(parts, "outbound "+f.outbound)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// packetCapture writes the packets of a tun in pcapng format, starting a new
+// file under dir once rotateSize bytes are written. Packets carry the owner
+// and outbound of their connection as comments, with a uid only packets of
+// its connections are kept. Owners come from the tun handler, which counts
+// the system uids below 10000 as 1000 like the traffic stats, so that is the
+// uid to filter them by.
+type packetCapture struct {
+	access     sync.Mutex
+	dir        string
+	snapLen    int
+	rotateSize int64
+	uid        int32
+	flows      *cache.LruCache
+	file       *os.File
+	headerSize int64
+	size       int64
+}
+
+func newPacketCapture(dir string, snapLen int32, rotateSize int64, uid int32) (*packetCapture, error) {
+	if snapLen <= 0 {
+		snapLen = defaultPCapSnapLen
+	}
+	c := &packetCapture{
+		dir:        dir,
+		snapLen:    int(snapLen),
+		rotateSize: rotateSize,
+		uid:        uid,
+		flows:      cache.NewLRUCache(cache.WithAge(300), cache.WithSize(pcapMaxFlows), cache.WithUpdateAgeOnGet()),
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, newError("unable to create pcap dir").Base(err)
+	}
+	err = c.open()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func appendPCapNGOption(block []byte, code uint16, value []byte) []byte {
+	var optionHeader [4]byte
+	binary.LittleEndian.PutUint16(optionHeader[0:], code)
+	binary.LittleEndian.PutUint16(optionHeader[2:], uint16(len(value)))
+	block = append(block, optionHeader[:]...)
+	block = append(block, value...)
+	for len(block)%4 != 0 {
+		block = append(block, 0)
+	}
+	return block
+}
+
+// finishPCapNGBlock fills in the length of block and appends its trailer.
+func finishPCapNGBlock(block []byte) []byte {
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(len(block)+4))
+	copy(block[4:], trailer[:])
+	return append(block, trailer[:]...)
+}
+
+func (c *packetCapture) open() error {
+	path := filepath.Join(c.dir, time.Now().UTC().String()+".pcapng")
+	file, err := os.Create(path)
+	if err != nil {
+		return newError("unable to create pcap file").Base(err)
+	}
+	sectionHeader := make([]byte, 24)
+	binary.LittleEndian.PutUint32(sectionHeader[0:], pcapngSectionHeaderBlock)
+	binary.LittleEndian.PutUint32(sectionHeader[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(sectionHeader[12:], 1)
+	binary.LittleEndian.PutUint64(sectionHeader[16:], ^uint64(0))
+	fileHeader := finishPCapNGBlock(sectionHeader)
+
+	interfaceBlock := make([]byte, 16)
+	binary.LittleEndian.PutUint32(interfaceBlock[0:], pcapngInterfaceBlock)
+	binary.LittleEndian.PutUint16(interfaceBlock[8:], pcapLinkTypeRaw)
+	binary.LittleEndian.PutUint32(interfaceBlock[12:], uint32(c.snapLen))
+	interfaceBlock = appendPCapNGOption(interfaceBlock, pcapngOptionInterfaceName, []byte("tun"))
+	interfaceBlock = appendPCapNGOption(interfaceBlock, pcapngOptionEnd, nil)
+	fileHeader = append(fileHeader, finishPCapNGBlock(interfaceBlock)...)
+
+	_, err = file.Write(fileHeader)
+	if err != nil {
+		file.Close()
+		return newError("unable to write pcap file").Base(err)
+	}
+	c.file = file
+	c.headerSize = int64(len(fileHeader))
+	c.size = c.headerSize
+	return nil
+}
+
+// Capture runs on the packet path of the stack, so it never looks up owners
+// itself. Until the tun handler annotates a connection its packets carry no
+// comment, or are held back when filtering by uid.
+func (c *packetCapture) Capture(inbound bool, packet [][]byte) {
+	flow := c.packetFlow(inbound, packet)
+	var comment string
+	uid := int32(-1)
+	var pending bool
+	if flow != nil {
+		c.access.Lock()
+		comment = flow.comment()
+		uid = flow.uid
+		pending = c.uid > 0 && !flow.annotated
+		c.access.Unlock()
+	}
+	if c.uid > 0 && uid != c.uid && !pending {
+		return
+	}
+	block := c.packetBlock(inbound, packet, comment)
+
+	c.access.Lock()
+	defer c.access.Unlock()
+	if pending && !flow.annotated {
+		if len(flow.pending) < pcapPendingPackets {
+			flow.pending = append(flow.pending, block)
+		}
+		return
+	}
+	if c.uid > 0 && flow.uid != c.uid {
+		return
+	}
+	c.write(block)
+}
+
+func (c *packetCapture) packetBlock(inbound bool, packet [][]byte, comment string) []byte {
+	now := time.Now()
+	length := 0
+	for _, view := range packet {
+		length += len(view)
+	}
+	captureLen := length
+	if captureLen > c.snapLen {
+		captureLen = c.snapLen
+	}
+	timestamp := uint64(now.UnixMicro())
+	block := make([]byte, 28, pcapngPacketBlockFixedSize+captureLen+len(comment)+24)
+	binary.LittleEndian.PutUint32(block[0:], pcapngEnhancedPacketBlock)
+	binary.LittleEndian.PutUint32(block[12:], uint32(timestamp>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(timestamp))
+	binary.LittleEndian.PutUint32(block[20:], uint32(captureLen))
+	binary.LittleEndian.PutUint32(block[24:], uint32(length))
+	for _, view := range packet {
+		if remaining := 28 + captureLen - len(block); len(view) > remaining {
+			view = view[:remaining]
+		}
+		block = append(block, view...)
+	}
+	for len(block)%4 != 0 {
+		block = append(block, 0)
+	}
+	flags := make([]byte, 4)
+	if inbound {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+	}
+	block = appendPCapNGOption(block, pcapngOptionFlags, flags)
+	if comment != "" {
+		block = appendPCapNGOption(block, pcapngOptionComment, []byte(comment))
+	}
+	block = appendPCapNGOption(block, pcapngOptionEnd, nil)
+	return finishPCapNGBlock(block)
+}
+
+func (c *packetCapture) write(block []byte) {
+	if c.file == nil {
+		return
+	}
+	if c.rotateSize > 0 && c.size > c.headerSize && c.size+int64(len(block)) > c.rotateSize {
+		c.file.Close()
+		c.file = nil
+		if err := c.open(); err != nil {
+			newError("failed to rotate pcap file").Base(err).AtWarning().WriteToLog()
+			return
+		}
+	}
+	n, err := c.file.Write(block)
+	c.size += int64(n)
+	if err != nil {
+		logrus.Debug("write pcap file failed: ", err)
+	}
+}
+
+// annotate records the owner and outbound of the connection from source,
+// once the tun handler knows them.
+func (c *packetCapture) annotate(source v2rayNet.Destination, uid uint16, outbound string) {
+	flow := c.flow(source)
+	var packageName string
+	if uid > 0 && uidDumper != nil {
+		if info, err := uidDumper.GetUidInfo(int32(uid)); err == nil {
+			packageName = info.PackageName
+		}
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	flow.annotated = true
+	if uid > 0 {
+		flow.uid = int32(uid)
+		flow.packageName = packageName
+	}
+	flow.outbound = outbound
+	// Held back packets predate the annotation and have no comment.
+	if c.uid > 0 && flow.uid == c.uid {
+		for _, block := range flow.pending {
+			c.write(block)
+		}
+	}
+	flow.pending = nil
+}
+
+// packetFlow returns the connection packet belongs to. Packets other than TCP
+// and UDP have none.
+func (c *packetCapture) packetFlow(inbound bool, packet [][]byte) *captureFlow {
+	var head []byte
+	for _, view := range packet {
+		head = append(head, view...)
+		if len(head) >= header.IPv6MinimumSize+4 {
+			break
+		}
+	}
+	var protocol uint8
+	var sourceIP, destinationIP []byte
+	var transport []byte
+	switch header.IPVersion(head) {
+	case header.IPv4Version:
+		ipHdr := header.IPv4(head)
+		if len(head) < header.IPv4MinimumSize || int(ipHdr.HeaderLength()) > len(head) {
+			return nil
+		}
+		protocol = ipHdr.Protocol()
+		sourceIP, destinationIP = []byte(ipHdr.SourceAddress()), []byte(ipHdr.DestinationAddress())
+		transport = head[ipHdr.HeaderLength():]
+	case header.IPv6Version:
+		ipHdr := header.IPv6(head)
+		if len(head) < header.IPv6MinimumSize {
+			return nil
+		}
+		protocol = ipHdr.NextHeader()
+		sourceIP, destinationIP = []byte(ipHdr.SourceAddress()), []byte(ipHdr.DestinationAddress())
+		transport = head[header.IPv6MinimumSize:]
+	default:
+		return nil
+	}
+	var network v2rayNet.Network
+	switch protocol {
+	case uint8(header.TCPProtocolNumber):
+		network = v2rayNet.Network_TCP
+	case uint8(header.UDPProtocolNumber):
+		network = v2rayNet.Network_UDP
+	default:
+		return nil
+	}
+	if len(transport) < 4 {
+		return nil
+	}
+	source := v2rayNet.Destination{
+		Address: v2rayNet.IPAddress(sourceIP),
+		Port:    v2rayNet.Port(binary.BigEndian.Uint16(transport[0:])),
+		Network: network,
+	}
+	if !inbound {
+		source.Address = v2rayNet.IPAddress(destinationIP)
+		source.Port = v2rayNet.Port(binary.BigEndian.Uint16(transport[2:]))
+	}
+	return c.flow(source)
+}
+
+// flow returns the connection from source, adding it when first seen.
+func (c *packetCapture) flow(source v2rayNet.Destination) *captureFlow {
+	c.access.Lock()
+	defer c.access.Unlock()
+	key := source.String()
+	if flow, loaded := c.flows.Get(key); loaded {
+		return flow.(*captureFlow)
+	}
+	flow := &captureFlow{uid: -1}
+	c.flows.Set(key, flow)
+	return flow
+}
+
+func (c *packetCapture) Close() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
@@ -0,0 +1,213 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun/tuntest"
+)
+
+type testPCapRecord struct {
+	captureLen int
+	length     int
+	data       []byte
+	inbound    bool
+	comment    string
+}
+
+func readTestPCap(t *testing.T, dir string) [][]testPCapRecord {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files [][]testPCapRecord
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) < 28 || binary.LittleEndian.Uint32(content) != pcapngSectionHeaderBlock || binary.LittleEndian.Uint32(content[8:]) != pcapngByteOrderMagic {
+			t.Fatalf("bad pcapng header in %s", entry.Name())
+		}
+		var records []testPCapRecord
+		for len(content) > 0 {
+			blockType := binary.LittleEndian.Uint32(content)
+			length := int(binary.LittleEndian.Uint32(content[4:]))
+			if length%4 != 0 || binary.LittleEndian.Uint32(content[length-4:]) != uint32(length) {
+				t.Fatalf("bad block length %d in %s", length, entry.Name())
+			}
+			block := content[:length-4]
+			content = content[length:]
+			switch blockType {
+			case pcapngInterfaceBlock:
+				if binary.LittleEndian.Uint16(block[8:]) != pcapLinkTypeRaw {
+					t.Fatalf("unexpected link type in %s", entry.Name())
+				}
+			case pcapngEnhancedPacketBlock:
+				captureLen := int(binary.LittleEndian.Uint32(block[20:]))
+				record := testPCapRecord{
+					captureLen: captureLen,
+					length:     int(binary.LittleEndian.Uint32(block[24:])),
+					data:       block[28 : 28+captureLen],
+				}
+				for options := block[28+(captureLen+3)/4*4:]; len(options) >= 4; {
+					code := binary.LittleEndian.Uint16(options)
+					value := options[4 : 4+binary.LittleEndian.Uint16(options[2:])]
+					switch code {
+					case pcapngOptionComment:
+						record.comment = string(value)
+					case pcapngOptionFlags:
+						record.inbound = binary.LittleEndian.Uint32(value)&3 == pcapngFlagInbound
+					}
+					options = options[4+(len(value)+3)/4*4:]
+				}
+				records = append(records, record)
+			}
+		}
+		files = append(files, records)
+	}
+	return files
+}
+
+func TestTun2rayPCap(t *testing.T) {
+	oldAssetsPath := externalAssetsPath
+	externalAssetsPath = t.TempDir()
+	t.Cleanup(func() {
+		externalAssetsPath = oldAssetsPath
+	})
+	SetUidDumper(testUidDumper{10005}, false)
+	t.Cleanup(func() {
+		SetUidDumper(nil, false)
+	})
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationSystem, func(config *TunConfig) {
+		config.PCap = true
+		config.DumpUID = true
+	})
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	destination := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+
+	err := device.Write(tuntest.UDPPacket(source, destination, []byte("ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.UDPProtocolNumber
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun.Close()
+
+	files := readTestPCap(t, filepath.Join(externalAssetsPath, pcapDir))
+	if len(files) != 1 || len(files[0]) != 2 {
+		t.Fatalf("unexpected capture %v", files)
+	}
+	for i, expected := range [][2]netip.AddrPort{{source, destination}, {destination, source}} {
+		packet, err := tuntest.Parse(files[0][i].data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.Source != expected[0] || packet.Destination != expected[1] || string(packet.Payload) != "ping" {
+			t.Fatalf("unexpected packet %d %s -> %s %q", i, packet.Source, packet.Destination, packet.Payload)
+		}
+		if files[0][i].inbound != (i == 0) {
+			t.Fatalf("unexpected direction of packet %d", i)
+		}
+	}
+	if comment := files[0][1].comment; comment != "uid 10005 (test), outbound direct" {
+		t.Fatalf("unexpected reply comment %q", comment)
+	}
+}
+
+func TestPacketCaptureRotateAndFilter(t *testing.T) {
+	SetUidDumper(testUidDumper{10005}, false)
+	t.Cleanup(func() {
+		SetUidDumper(nil, false)
+	})
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	destination := netip.MustParseAddrPort("1.1.1.1:53")
+	packet := tuntest.UDPPacket(source, destination, make([]byte, 100))
+	reply := tuntest.UDPPacket(destination, source, make([]byte, 100))
+	packets := [][]byte{packet, reply}
+
+	dir := t.TempDir()
+	capture, err := newPacketCapture(dir, 64, 350, 10005)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first packet is held back until its owner is known.
+	for i := 0; i < 4; i++ {
+		capture.Capture(i%2 == 0, [][]byte{packets[i%2][:20], packets[i%2][20:]})
+		if i == 0 {
+			capture.annotate(v2rayNet.UDPDestination(v2rayNet.IPAddress(source.Addr().AsSlice()), v2rayNet.Port(source.Port())), 10005, "")
+		}
+	}
+	capture.Close()
+	files := readTestPCap(t, dir)
+	if len(files) != 2 || len(files[0]) != 2 || len(files[1]) != 2 {
+		t.Fatalf("expected two files of two records, got %v", files)
+	}
+	record := files[1][1]
+	if record.captureLen != 64 || record.length != len(reply) || string(record.data) != string(reply[:64]) {
+		t.Fatalf("unexpected record of %d/%d bytes", record.captureLen, record.length)
+	}
+	if record.comment != "uid 10005 (test)" {
+		t.Fatalf("unexpected comment %q", record.comment)
+	}
+
+	dir = t.TempDir()
+	capture, err = newPacketCapture(dir, 0, 0, 10006)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture.Capture(true, [][]byte{packet})
+	capture.annotate(v2rayNet.UDPDestination(v2rayNet.IPAddress(source.Addr().AsSlice()), v2rayNet.Port(source.Port())), 10005, "")
+	capture.Capture(false, [][]byte{reply})
+	capture.Close()
+	if files = readTestPCap(t, dir); len(files) != 1 || len(files[0]) != 0 {
+		t.Fatalf("expected packets of other apps to be filtered, got %v", files)
+	}
+}
+
+func TestPacketCaptureFlowLimit(t *testing.T) {
+	capture, err := newPacketCapture(t.TempDir(), 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capture.Close()
+	flow := func(port int) v2rayNet.Destination {
+		return v2rayNet.UDPDestination(v2rayNet.IPAddress([]byte{172, 19, 0, 1}), v2rayNet.Port(port))
+	}
+	for port := 0; port <= pcapMaxFlows; port++ {
+		capture.flow(flow(port))
+	}
+	if capture.flows.Exist(flow(0).String()) || !capture.flows.Exist(flow(pcapMaxFlows).String()) {
+		t.Fatal("oldest flow not evicted")
+	}
+
+	// Captures only look up owners for the uid filter.
+	oldAssetsPath := externalAssetsPath
+	externalAssetsPath = t.TempDir()
+	t.Cleanup(func() {
+		externalAssetsPath = oldAssetsPath
+	})
+	tun, _, _ := newTestTun2ray(t, comm.TunImplementationSystem, func(config *TunConfig) {
+		config.PCap = true
+	})
+	if tun.dumpUid {
+		t.Fatal("capture without uid filter dumps uids")
+	}
+	tun, _, _ = newTestTun2ray(t, comm.TunImplementationSystem, func(config *TunConfig) {
+		config.PCap = true
+		config.PCapUid = 10005
+	})
+	if !tun.dumpUid {
+		t.Fatal("capture with uid filter doesn't dump uids")
+	}
+}
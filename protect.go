@@ -12,6 +12,7 @@ import (
 	"github.com/v2fly/v2ray-core/v5/features/dns"
 	"github.com/v2fly/v2ray-core/v5/transport/internet"
 	"golang.org/x/sys/unix"
+	"libcore/comm"
 )
 
 type Protector interface {
@@ -29,6 +30,7 @@ func (n *noopProtector) Protect(int32) bool {
 type protectedDialer struct {
 	protector Protector
 	resolver  func(ctx context.Context, domain string) ([]net.IP, error)
+	nat64     *nat64Translator
 }
 
 func (dialer protectedDialer) Dial(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) (conn net.Conn, err error) {
@@ -58,7 +60,7 @@ func (dialer protectedDialer) Dial(ctx context.Context, source v2rayNet.Address,
 			}
 			logrus.Debug("trying next address: ", ip.String())
 		}
-		destination.Address = v2rayNet.IPAddress(ip)
+		destination.Address = v2rayNet.IPAddress(dialer.nat64.translate(ip))
 		conn, err = dialer.dial(ctx, source, destination, sockopt)
 	}
 
@@ -74,6 +76,9 @@ func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address,
 
 	if !dialer.protector.Protect(int32(fd)) {
 		unix.Close(fd)
+		emitEventOnce("protect", newEvent(comm.EventProtectFailed, comm.EventSeverityError, "protect failed", map[string]string{
+			"destination": destination.NetAddr(),
+		}))
 		return nil, errors.New("protect failed")
 	}
 
@@ -117,6 +122,9 @@ func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address,
 	case v2rayNet.Network_UDP:
 		pc, err := net.FilePacketConn(file)
 		if err == nil {
+			if dialer.nat64 != nil {
+				pc = &nat64PacketConn{pc, dialer.nat64}
+			}
 			destAddr, err := net.ResolveUDPAddr("udp", destination.NetAddr())
 			if err != nil {
 				return nil, err
@@ -0,0 +1,193 @@
+package libcore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QuotaPeriodDaily int32 = iota
+	QuotaPeriodMonthly
+)
+
+const (
+	QuotaActionBlock int32 = iota
+	QuotaActionReroute
+)
+
+const quotaCheckInterval = time.Second
+
+type QuotaListener interface {
+	OnQuotaExceeded(uid int32, used int64, limit int64)
+}
+
+type appQuota struct {
+	access   sync.Mutex
+	period   int32
+	limit    int64
+	action   int32
+	outbound string
+	used     int64
+	last     uint64
+	end      time.Time
+	exceeded bool
+}
+
+func quotaPeriodEnd(period int32, now time.Time) time.Time {
+	if period == QuotaPeriodMonthly {
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.Local)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.Local)
+}
+
+// SetQuota limits the bytes uid may use per period, starting from used. When
+// crossed, the quota listener is called, open connections of uid are closed
+// and new ones are blocked or sent to outbound. A zero limit removes the quota.
+func (t *Tun2ray) SetQuota(uid int32, period int32, limit int64, used int64, action int32, outbound string) error {
+	if !t.trafficStats {
+		return newError("quota requires traffic stats")
+	}
+	if limit <= 0 {
+		t.quotas.Delete(uint16(uid))
+		return nil
+	}
+	if period != QuotaPeriodDaily && period != QuotaPeriodMonthly {
+		return newError("unknown quota period ", period)
+	}
+	switch action {
+	case QuotaActionBlock:
+	case QuotaActionReroute:
+		if outbound == "" {
+			return newError("reroute quota requires an outbound")
+		}
+	default:
+		return newError("unknown quota action ", action)
+	}
+	t.quotas.Store(uint16(uid), &appQuota{
+		period:   period,
+		limit:    limit,
+		action:   action,
+		outbound: outbound,
+		used:     used,
+		last:     t.appTraffic(uint16(uid)),
+		end:      quotaPeriodEnd(period, time.Now()),
+	})
+	t.quotaOnce.Do(func() {
+		go t.loopQuotas()
+	})
+	t.checkQuotas()
+	return nil
+}
+
+func (t *Tun2ray) SetQuotaListener(listener QuotaListener) {
+	t.quotaAccess.Lock()
+	defer t.quotaAccess.Unlock()
+	t.quotaListener = listener
+}
+
+// GetQuotaUsage returns the bytes used by uid in the current period, or -1
+// if it has no quota.
+func (t *Tun2ray) GetQuotaUsage(uid int32) int64 {
+	value, loaded := t.quotas.Load(uint16(uid))
+	if !loaded {
+		return -1
+	}
+	quota := value.(*appQuota)
+	quota.access.Lock()
+	defer quota.access.Unlock()
+	return quota.used
+}
+
+func (t *Tun2ray) appTraffic(uid uint16) uint64 {
+	value, loaded := t.appStats.Load(uid)
+	if !loaded {
+		return 0
+	}
+	stat := value.(*appStats)
+	return atomic.LoadUint64(&stat.uplink) + atomic.LoadUint64(&stat.uplinkTotal) +
+		atomic.LoadUint64(&stat.downlink) + atomic.LoadUint64(&stat.downlinkTotal)
+}
+
+func (t *Tun2ray) loopQuotas() {
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.checkQuotas()
+		case <-t.quotaDone:
+			return
+		}
+	}
+}
+
+type exceededQuota struct {
+	uid   uint16
+	used  int64
+	limit int64
+}
+
+func (t *Tun2ray) checkQuotas() {
+	now := time.Now()
+	var exceeded []exceededQuota
+	// statsAccess keeps pending plus total constant, see ReadAppTraffics.
+	t.statsAccess.Lock()
+	t.quotas.Range(func(key, value interface{}) bool {
+		uid := key.(uint16)
+		quota := value.(*appQuota)
+		current := t.appTraffic(uid)
+		quota.access.Lock()
+		if current >= quota.last {
+			quota.used += int64(current - quota.last)
+		} else {
+			// The counters were reset.
+			quota.used += int64(current)
+		}
+		quota.last = current
+		if !now.Before(quota.end) {
+			quota.used = 0
+			quota.exceeded = false
+			quota.end = quotaPeriodEnd(quota.period, now)
+		}
+		if !quota.exceeded && quota.used >= quota.limit {
+			quota.exceeded = true
+			exceeded = append(exceeded, exceededQuota{uid, quota.used, quota.limit})
+		}
+		quota.access.Unlock()
+		return true
+	})
+	t.statsAccess.Unlock()
+	if len(exceeded) == 0 {
+		return
+	}
+	t.quotaAccess.Lock()
+	listener := t.quotaListener
+	t.quotaAccess.Unlock()
+	for _, quota := range exceeded {
+		newError("uid ", quota.uid, " exceeded its quota of ", quota.limit, " bytes").AtWarning().WriteToLog()
+		if listener != nil {
+			listener.OnQuotaExceeded(int32(quota.uid), quota.used, quota.limit)
+		}
+		t.CloseConnections(int32(quota.uid))
+	}
+}
+
+// quotaOutbound returns the outbound for a new connection of uid once its
+// quota is exceeded, or block if it must not be opened.
+func (t *Tun2ray) quotaOutbound(uid uint16) (outbound string, block bool) {
+	value, loaded := t.quotas.Load(uid)
+	if !loaded {
+		return "", false
+	}
+	quota := value.(*appQuota)
+	quota.access.Lock()
+	defer quota.access.Unlock()
+	if !quota.exceeded {
+		return "", false
+	}
+	if quota.action == QuotaActionBlock {
+		return "", true
+	}
+	return quota.outbound, false
+}
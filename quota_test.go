@@ -0,0 +1,105 @@
+package libcore
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun/tuntest"
+)
+
+type testQuotaListener struct {
+	access   sync.Mutex
+	exceeded []int32
+}
+
+func (l *testQuotaListener) OnQuotaExceeded(uid int32, used int64, limit int64) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	l.exceeded = append(l.exceeded, uid)
+}
+
+func TestTun2rayQuota(t *testing.T) {
+	SetUidDumper(testUidDumper{10005}, false)
+	t.Cleanup(func() {
+		SetUidDumper(nil, false)
+	})
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationSystem, func(config *TunConfig) {
+		config.TrafficStats = true
+	})
+	listener := &testQuotaListener{}
+	tun.SetQuotaListener(listener)
+	destination := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+	exchange := func(source netip.AddrPort, timeout time.Duration) error {
+		err := device.Write(tuntest.UDPPacket(source, destination, []byte("ping")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = device.Expect(timeout, func(packet *tuntest.Packet) bool {
+			return packet.Protocol == header.UDPProtocolNumber && packet.Destination == source
+		})
+		return err
+	}
+
+	err := tun.SetQuota(10005, QuotaPeriodDaily, 6, 0, QuotaActionBlock, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := netip.MustParseAddrPort("172.19.0.1:40000")
+	err = exchange(first, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun.checkQuotas()
+	if used := tun.GetQuotaUsage(10005); used != 8 {
+		t.Fatalf("unexpected usage %d", used)
+	}
+	if len(listener.exceeded) != 1 || listener.exceeded[0] != 10005 {
+		t.Fatalf("unexpected callbacks %v", listener.exceeded)
+	}
+	for deadline := time.Now().Add(testTimeout); tun.GetConnections().HasNext(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not closed after the quota was exceeded")
+		}
+	}
+	err = exchange(netip.MustParseAddrPort("172.19.0.1:40001"), 200*time.Millisecond)
+	if err != tuntest.ErrTimeout {
+		t.Fatalf("expected new connection to be blocked, got %v", err)
+	}
+
+	err = tun.SetQuota(10005, QuotaPeriodMonthly, 6, 100, QuotaActionReroute, "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listener.exceeded) != 2 {
+		t.Fatalf("unexpected callbacks %v", listener.exceeded)
+	}
+	err = exchange(netip.MustParseAddrPort("172.19.0.1:40002"), testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tun.SetQuota(10005, QuotaPeriodDaily, 0, 0, QuotaActionBlock, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := tun.GetQuotaUsage(10005); used != -1 {
+		t.Fatalf("quota not removed, usage %d", used)
+	}
+	if err = tun.SetQuota(10005, QuotaPeriodDaily, 1, 0, QuotaActionReroute, ""); err == nil {
+		t.Fatal("expected error for reroute without outbound")
+	}
+}
+
+func TestQuotaPeriodEnd(t *testing.T) {
+	now := time.Date(2024, time.December, 31, 15, 4, 5, 0, time.Local)
+	if end := quotaPeriodEnd(QuotaPeriodDaily, now); !end.Equal(time.Date(2025, time.January, 1, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("unexpected daily end %s", end)
+	}
+	if end := quotaPeriodEnd(QuotaPeriodMonthly, now); !end.Equal(time.Date(2025, time.January, 1, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("unexpected monthly end %s", end)
+	}
+}
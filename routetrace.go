@@ -0,0 +1,169 @@
+package libcore
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	"github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+	routing_dns "github.com/v2fly/v2ray-core/v5/features/routing/dns"
+	routing_session "github.com/v2fly/v2ray-core/v5/features/routing/session"
+)
+
+type RouteResult struct {
+	// RuleIndex is the index of the matched rule in routing.rules, or -1.
+	RuleIndex int32
+	// OutboundTag is empty for a balancer without an override target.
+	OutboundTag string
+	BalancerTag string
+	// BalancerOutbounds are the outbounds the balancer picks from, separated
+	// by newlines.
+	BalancerOutbounds string
+	// Default is set when no rule matched and the default outbound is used.
+	Default bool
+}
+
+type traceRule struct {
+	router.Rule
+	balancerTag string
+}
+
+// routeTracer mirrors the rules of the router of a core, keeping the indexes
+// the router itself does not expose. Balancers are not asked to pick, which
+// would advance strategies like round robin for real connections.
+type routeTracer struct {
+	once           sync.Once
+	err            error
+	domainStrategy router.DomainStrategy
+	rules          []traceRule
+	balancers      map[string][]string
+}
+
+func (v2ray *v2rayCore) loadRouteTracer() (*routeTracer, error) {
+	tracer := &v2ray.routeTracer
+	tracer.once.Do(func() {
+		config := v2ray.routerConfig
+		if config == nil {
+			return
+		}
+		tracer.domainStrategy = config.DomainStrategy
+
+		tracer.balancers = make(map[string][]string, len(config.BalancingRule))
+		for _, rule := range config.BalancingRule {
+			tracer.balancers[rule.Tag] = rule.OutboundSelector
+		}
+		for _, rule := range config.Rule {
+			condition, err := rule.BuildCondition()
+			if err != nil {
+				tracer.err = err
+				return
+			}
+			tracerRule := traceRule{Rule: router.Rule{Tag: rule.GetTag(), Condition: condition}}
+			if tag := rule.GetBalancingTag(); tag != "" {
+				if _, ok := tracer.balancers[tag]; !ok {
+					tracer.err = newError("balancer ", tag, " not found")
+					return
+				}
+				tracerRule.balancerTag = tag
+			}
+			tracer.rules = append(tracer.rules, tracerRule)
+		}
+	})
+	return tracer, tracer.err
+}
+
+func (t *routeTracer) pick(ctx routing.Context, dnsClient dns.Client) int {
+	if t.domainStrategy == router.DomainStrategy_IpOnDemand {
+		ctx = routing_dns.ContextWithDNSClient(ctx, dnsClient)
+	}
+	for i := range t.rules {
+		if t.rules[i].Apply(ctx) {
+			return i
+		}
+	}
+	if t.domainStrategy != router.DomainStrategy_IpIfNonMatch || len(ctx.GetTargetDomain()) == 0 {
+		return -1
+	}
+	ctx = routing_dns.ContextWithDNSClient(ctx, dnsClient)
+	for i := range t.rules {
+		if t.rules[i].Apply(ctx) {
+			return i
+		}
+	}
+	return -1
+}
+
+// TestRoute runs the configured routing rules for a connection without
+// opening it. source and destination are host:port, domain is the sniffed
+// domain if any. A balancer gives its candidates instead of a pick.
+func (instance *V2RayInstance) TestRoute(network string, source string, destination string, domain string, uid int32, inboundTag string) (*RouteResult, error) {
+	v2ray := instance.load()
+	if v2ray == nil {
+		return nil, newError("v2ray instance not started")
+	}
+	tracer, err := v2ray.loadRouteTracer()
+	if err != nil {
+		return nil, newError("failed to build routing rules").Base(err)
+	}
+
+	network = strings.ToLower(network)
+	if network == "" {
+		network = "tcp"
+	}
+	target, err := net.ParseDestination(network + ":" + destination)
+	if err != nil {
+		return nil, newError("invalid destination ", destination).Base(err)
+	}
+	inbound := &session.Inbound{
+		Tag:         inboundTag,
+		Uid:         uint32(uid),
+		NetworkType: networkType,
+		WifiSSID:    wifiSSID,
+	}
+	if source != "" {
+		inbound.Source, err = net.ParseDestination(network + ":" + source)
+		if err != nil {
+			return nil, newError("invalid source ", source).Base(err)
+		}
+	}
+	ob := &session.Outbound{Target: target}
+	if domain != "" {
+		ob.RouteTarget = net.Destination{Network: target.Network, Address: net.DomainAddress(domain), Port: target.Port}
+	}
+
+	ctx := core.WithContext(context.Background(), v2ray.core)
+	ctx = session.ContextWithInbound(ctx, inbound)
+	ctx = session.ContextWithOutbound(ctx, ob)
+	routingContext := routing_session.AsRoutingContext(ctx)
+
+	result := &RouteResult{RuleIndex: -1}
+	if index := tracer.pick(routingContext, v2ray.dnsClient); index >= 0 {
+		rule := tracer.rules[index]
+		result.RuleIndex = int32(index)
+		result.OutboundTag = rule.Tag
+		if rule.balancerTag != "" {
+			result.BalancerTag = rule.balancerTag
+			if overrider, ok := v2ray.router.(routing.BalancerOverrider); ok {
+				result.OutboundTag, _ = overrider.GetOverrideTarget(rule.balancerTag)
+			}
+			if selector, ok := v2ray.outboundManager.(outbound.HandlerSelector); ok {
+				candidates := selector.Select(tracer.balancers[rule.balancerTag])
+				sort.Strings(candidates)
+				result.BalancerOutbounds = strings.Join(candidates, "\n")
+			}
+		}
+	} else {
+		result.Default = true
+		if handler := v2ray.outboundManager.GetDefaultHandler(); handler != nil {
+			result.OutboundTag = handler.Tag()
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,80 @@
+package libcore
+
+import (
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+)
+
+func TestTestRoute(t *testing.T) {
+	instance := NewV2rayInstance()
+	err := instance.LoadConfig(`{
+  "log": {"loglevel": "none"},
+  "outbounds": [
+    {"protocol": "freedom", "tag": "direct"},
+    {"protocol": "freedom", "tag": "proxy"},
+    {"protocol": "blackhole", "tag": "block"}
+  ],
+  "routing": {
+    "rules": [
+      {"type": "field", "inboundTag": ["dns-in"], "outboundTag": "direct"},
+      {"type": "field", "domain": ["domain:example.com"], "outboundTag": "proxy"},
+      {"type": "field", "ip": ["10.0.0.0/8"], "network": "udp", "outboundTag": "block"},
+      {"type": "field", "port": "8443", "balancerTag": "balancer"}
+    ],
+    "balancers": [{"tag": "balancer", "selector": ["proxy", "block"], "strategy": {"type": "random"}}]
+  }
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.Start(testErrorHandler{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	for _, c := range []struct {
+		name        string
+		network     string
+		destination string
+		domain      string
+		inboundTag  string
+		expected    RouteResult
+	}{
+		{"inbound", "udp", "1.1.1.1:53", "", "dns-in", RouteResult{RuleIndex: 0, OutboundTag: "direct"}},
+		{"sniffed domain", "tcp", "93.184.216.34:443", "www.example.com", "tun", RouteResult{RuleIndex: 1, OutboundTag: "proxy"}},
+		{"domain destination", "tcp", "example.com:80", "", "tun", RouteResult{RuleIndex: 1, OutboundTag: "proxy"}},
+		{"ip and network", "udp", "10.1.2.3:443", "", "tun", RouteResult{RuleIndex: 2, OutboundTag: "block"}},
+		{"network mismatch", "tcp", "10.1.2.3:443", "", "tun", RouteResult{RuleIndex: -1, OutboundTag: "direct", Default: true}},
+		{"balancer", "tcp", "1.1.1.1:8443", "", "tun", RouteResult{RuleIndex: 3, BalancerTag: "balancer", BalancerOutbounds: "block\nproxy"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := instance.TestRoute(c.network, "172.19.0.1:40000", c.destination, c.domain, 10000, c.inboundTag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *result != c.expected {
+				t.Fatalf("unexpected result %+v, expected %+v", *result, c.expected)
+			}
+		})
+	}
+
+	// An override of the running router is the only pick reported.
+	err = instance.load().router.(routing.BalancerOverrider).SetOverrideTarget("balancer", "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := instance.TestRoute("tcp", "", "1.1.1.1:8443", "", 0, "tun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OutboundTag != "direct" || result.BalancerTag != "balancer" {
+		t.Fatalf("balancer override ignored, got %+v", *result)
+	}
+
+	_, err = instance.TestRoute("tcp", "", "not a destination", "", 0, "")
+	if err == nil {
+		t.Fatal("expected error for invalid destination")
+	}
+}
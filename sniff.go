@@ -0,0 +1,197 @@
+package libcore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/protocol/bittorrent"
+	"github.com/v2fly/v2ray-core/v5/common/protocol/dns"
+	"github.com/v2fly/v2ray-core/v5/common/protocol/http"
+	"github.com/v2fly/v2ray-core/v5/common/protocol/quic"
+	"github.com/v2fly/v2ray-core/v5/common/protocol/tls"
+)
+
+type sniffResult interface {
+	Protocol() string
+	Domain() string
+}
+
+type protocolSniffer struct {
+	protocol string
+	network  v2rayNet.Network
+	sniff    func(b []byte) (sniffResult, error)
+	// override marks protocols whose domain may replace the destination.
+	override bool
+}
+
+// sniffers are tried in order and the first match wins, so stricter formats
+// go first.
+var sniffers = []protocolSniffer{
+	{"http", v2rayNet.Network_TCP, func(b []byte) (sniffResult, error) { return http.SniffHTTP(b) }, true},
+	{"tls", v2rayNet.Network_TCP, func(b []byte) (sniffResult, error) { return tls.SniffTLS(b) }, true},
+	{"ssh", v2rayNet.Network_TCP, sniffSSH, false},
+	{"rdp", v2rayNet.Network_TCP, sniffRDP, false},
+	{"bittorrent", v2rayNet.Network_TCP, func(b []byte) (sniffResult, error) { return bittorrent.SniffBittorrent(b) }, false},
+	{"dns", v2rayNet.Network_TCP, func(b []byte) (sniffResult, error) { return dns.SniffTCPDNS(b) }, false},
+	{"quic", v2rayNet.Network_UDP, func(b []byte) (sniffResult, error) { return quic.SniffQUIC(b) }, true},
+	{"stun", v2rayNet.Network_UDP, sniffSTUN, false},
+	{"dtls", v2rayNet.Network_UDP, sniffDTLS, false},
+	{"bittorrent", v2rayNet.Network_UDP, func(b []byte) (sniffResult, error) { return bittorrent.SniffUTP(b) }, false},
+	{"dns", v2rayNet.Network_UDP, func(b []byte) (sniffResult, error) { return dns.SniffDNS(b) }, false},
+}
+
+var udpDnsSniffers, _ = newSnifferChain(v2rayNet.Network_UDP, "dns")
+
+// newSnifferChain returns the sniffers for network, limited to the comma
+// separated protocols if any are given.
+func newSnifferChain(network v2rayNet.Network, protocols string) ([]protocolSniffer, error) {
+	enabled := make(map[string]bool)
+	for _, protocol := range strings.Split(protocols, ",") {
+		protocol = strings.ToLower(strings.TrimSpace(protocol))
+		if protocol == "" {
+			continue
+		}
+		known := false
+		for _, sniffer := range sniffers {
+			known = known || sniffer.protocol == protocol
+		}
+		if !known {
+			return nil, newError("unknown sniffer protocol ", protocol)
+		}
+		enabled[protocol] = true
+	}
+	var chain []protocolSniffer
+	for _, sniffer := range sniffers {
+		if sniffer.network == network && (len(enabled) == 0 || enabled[sniffer.protocol]) {
+			chain = append(chain, sniffer)
+		}
+	}
+	return chain, nil
+}
+
+func sniff(payload []byte, sniffers []protocolSniffer) (protocol string, domain string) {
+	for _, sniffer := range sniffers {
+		result, err := sniffer.sniff(payload)
+		if err != nil {
+			continue
+		}
+		protocol = result.Protocol()
+		if sniffer.override {
+			domain = result.Domain()
+		}
+		return
+	}
+	return
+}
+
+// protocolResult is the result of sniffers that only identify a protocol.
+type protocolResult string
+
+func (r protocolResult) Protocol() string {
+	return string(r)
+}
+
+func (r protocolResult) Domain() string {
+	return ""
+}
+
+var errUnknownProtocol = newError("unknown protocol")
+
+// sniffSSH matches the identification string both sides send first.
+func sniffSSH(b []byte) (sniffResult, error) {
+	for _, version := range []string{"SSH-2.0-", "SSH-1.99-", "SSH-1.5-"} {
+		if bytes.HasPrefix(b, []byte(version)) {
+			return protocolResult("ssh"), nil
+		}
+	}
+	return nil, errUnknownProtocol
+}
+
+// sniffRDP matches a TPKT wrapped X.224 connection request.
+func sniffRDP(b []byte) (sniffResult, error) {
+	if len(b) < 11 || b[0] != 3 || b[1] != 0 {
+		return nil, errUnknownProtocol
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length < 11 || length > len(b) || int(b[4]) != length-5 || b[5] != 0xe0 {
+		return nil, errUnknownProtocol
+	}
+	return protocolResult("rdp"), nil
+}
+
+// sniffSTUN matches RFC 5389 messages, which carry a magic cookie.
+func sniffSTUN(b []byte) (sniffResult, error) {
+	if len(b) < 20 || b[0]&0xc0 != 0 || binary.BigEndian.Uint32(b[4:]) != 0x2112a442 {
+		return nil, errUnknownProtocol
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length%4 != 0 || 20+length != len(b) {
+		return nil, errUnknownProtocol
+	}
+	return protocolResult("stun"), nil
+}
+
+// sniffDTLS matches a record carrying a ClientHello, DTLS 1.0 to 1.3.
+func sniffDTLS(b []byte) (sniffResult, error) {
+	const recordHeaderSize = 13
+	if len(b) < recordHeaderSize+12 || b[0] != 22 || b[1] != 0xfe {
+		return nil, errUnknownProtocol
+	}
+	if b[2] != 0xff && b[2] != 0xfd && b[2] != 0xfc {
+		return nil, errUnknownProtocol
+	}
+	length := int(binary.BigEndian.Uint16(b[11:]))
+	if recordHeaderSize+length > len(b) || b[recordHeaderSize] != 1 {
+		return nil, errUnknownProtocol
+	}
+	return protocolResult("dtls"), nil
+}
+
+// peekConn reads the first segment sent by the client, the same way the
+// dispatcher does before sniffing, and returns a conn that replays it.
+func peekConn(conn net.Conn) (net.Conn, []byte, error) {
+	err := conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err != nil {
+		return conn, nil, nil
+	}
+	header := buf.New()
+	_, err = header.ReadFrom(conn)
+	if err != nil {
+		if netErr, isNetErr := err.(net.Error); !isNetErr || !netErr.Timeout() {
+			header.Release()
+			return nil, nil, err
+		}
+	}
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		header.Release()
+		return nil, nil, err
+	}
+	if header.IsEmpty() {
+		header.Release()
+		return conn, nil, nil
+	}
+	return &cachedConn{conn, header}, header.Bytes(), nil
+}
+
+type cachedConn struct {
+	net.Conn
+	cache *buf.Buffer
+}
+
+func (c *cachedConn) Read(p []byte) (n int, err error) {
+	if c.cache != nil {
+		n, _ = c.cache.Read(p)
+		if c.cache.IsEmpty() {
+			c.cache.Release()
+			c.cache = nil
+		}
+		return
+	}
+	return c.Conn.Read(p)
+}
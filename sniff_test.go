@@ -0,0 +1,81 @@
+package libcore
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	routing_session "github.com/v2fly/v2ray-core/v5/features/routing/session"
+)
+
+func TestSniff(t *testing.T) {
+	tcpSniffers, err := newSnifferChain(v2rayNet.Network_TCP, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpSniffers, err := newSnifferChain(v2rayNet.Network_UDP, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		sniffers []protocolSniffer
+		payload  string
+		protocol string
+	}{
+		{"ssh", tcpSniffers, hex.EncodeToString([]byte("SSH-2.0-OpenSSH_9.6\r\n")), "ssh"},
+		{"rdp", tcpSniffers, "030000130ee000000000000100080003000000", "rdp"},
+		{"stun binding", udpSniffers, "000100002112a442b7e7a701bc34d686fa87dfae", "stun"},
+		{"stun bad length", udpSniffers, "000100042112a442b7e7a701bc34d686fa87dfae", ""},
+		{"dtls client hello", udpSniffers, "16fefd0000000000000000001a010000220000000000000022fefd" + "0000000000000000000000000000", "dtls"},
+		{"dtls application data", udpSniffers, "17fefd0001000000000001001a010000220000000000000022fefd" + "0000000000000000000000000000", ""},
+		{"text", tcpSniffers, hex.EncodeToString([]byte("hello world")), ""},
+	} {
+		payload, err := hex.DecodeString(test.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if protocol, _ := sniff(payload, test.sniffers); protocol != test.protocol {
+			t.Errorf("%s: expected protocol %q, got %q", test.name, test.protocol, protocol)
+		}
+	}
+}
+
+func TestSnifferChain(t *testing.T) {
+	chain, err := newSnifferChain(v2rayNet.Network_UDP, "quic, STUN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0].protocol != "quic" || chain[1].protocol != "stun" {
+		t.Fatalf("unexpected chain %v", chain)
+	}
+	chain, err = newSnifferChain(v2rayNet.Network_TCP, "quic")
+	if err != nil || len(chain) != 0 {
+		t.Fatalf("expected empty tcp chain, got %v %v", chain, err)
+	}
+	if _, err = newSnifferChain(v2rayNet.Network_TCP, "gopher"); err == nil {
+		t.Fatal("expected error for unknown protocol")
+	}
+}
+
+func TestSniffed(t *testing.T) {
+	tun := &Tun2ray{}
+	target := v2rayNet.TCPDestination(v2rayNet.ParseAddress("1.1.1.1"), 443)
+
+	content := new(session.Content)
+	ctx := routing_session.AsRoutingContext(tun.sniffed(context.Background(), content, target, "tls", "example.com"))
+	if content.Protocol != "" || !content.SniffingRequest.Enabled || !content.SniffingRequest.RouteOnly || len(content.SniffingRequest.OverrideDestinationForProtocol) != 1 {
+		t.Fatalf("unexpected content %+v", content)
+	}
+	if ctx.GetTargetDomain() != "example.com" || ctx.GetProtocol() != "tls" {
+		t.Fatalf("unexpected routing domain %q protocol %q", ctx.GetTargetDomain(), ctx.GetProtocol())
+	}
+
+	content = new(session.Content)
+	tun.sniffed(context.Background(), content, target, "ssh", "")
+	if content.Protocol != "ssh" || content.SniffingRequest.Enabled {
+		t.Fatalf("unexpected content %+v", content)
+	}
+}
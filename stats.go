@@ -1,12 +1,9 @@
 package libcore
 
 import (
-	"container/list"
 	"net"
-	"sync"
 	"sync/atomic"
 
-	"github.com/v2fly/v2ray-core/v5/common"
 	"github.com/v2fly/v2ray-core/v5/common/buf"
 	"github.com/v2fly/v2ray-core/v5/transport/internet"
 )
@@ -27,8 +24,6 @@ type AppStats struct {
 }
 
 type appStats struct {
-	sync.Mutex
-
 	tcpConn      int32
 	udpConn      int32
 	tcpConnTotal uint32
@@ -40,8 +35,6 @@ type appStats struct {
 	downlinkTotal uint64
 
 	deactivateAt int64
-
-	connections list.List
 }
 
 type TrafficListener interface {
@@ -56,7 +49,10 @@ func (t *Tun2ray) ResetAppTraffics() {
 	if !t.trafficStats {
 		return
 	}
+	t.flushTrafficHistory()
 
+	t.statsAccess.Lock()
+	defer t.statsAccess.Unlock()
 	var toDel []uint16
 	t.appStats.Range(func(key, value interface{}) bool {
 		uid := key.(uint16)
@@ -65,22 +61,7 @@ func (t *Tun2ray) ResetAppTraffics() {
 	})
 	for _, uid := range toDel {
 		t.appStats.Delete(uid)
-	}
-}
-
-func (t *Tun2ray) CloseConnections(uid int32) {
-	if !t.trafficStats {
-		return
-	}
-	statsI, ok := t.appStats.Load(uint16(uid))
-	if !ok {
-		return
-	}
-	stats := statsI.(*appStats)
-	stats.Lock()
-	defer stats.Unlock()
-	for element := stats.connections.Front(); element != nil; element = element.Next() {
-		common.Close(element.Value)
+		delete(t.historyLast, uid)
 	}
 }
 
@@ -91,6 +72,7 @@ func (t *Tun2ray) ReadAppTraffics(listener TrafficListener) error {
 
 	var stats []*AppStats
 
+	t.statsAccess.Lock()
 	t.appStats.Range(func(key, value interface{}) bool {
 		uid := key.(uint16)
 		stat := value.(*appStats)
@@ -116,6 +98,7 @@ func (t *Tun2ray) ReadAppTraffics(listener TrafficListener) error {
 		stats = append(stats, export)
 		return true
 	})
+	t.statsAccess.Unlock()
 
 	for _, stat := range stats {
 		listener.UpdateStats(stat)
@@ -20,6 +20,7 @@ type stunServerConn struct {
 	RemoteAddr  *net.UDPAddr
 	OtherAddr   *net.UDPAddr
 	messageChan chan *stunResponse
+	timeout     time.Duration
 }
 
 type stunResponse struct {
@@ -55,10 +56,19 @@ func Test(addrStr string, socksPort int) (natMapping int, natFiltering int, err
 	if addrStr == "" {
 		addrStr = "stun.syncthing.net:3478"
 	}
+	return TestConn(addrStr, func() (net.PacketConn, error) {
+		return listenPacket(addrStr, socksPort)
+	}, time.Duration(timeout)*time.Second)
+}
+
+// TestConn runs the tests over connections from newPacketConn, which is
+// called once for the mapping and once for the filtering tests, and waits up
+// to timeout for each response.
+func TestConn(addrStr string, newPacketConn func() (net.PacketConn, error), timeout time.Duration) (natMapping int, natFiltering int, err error) {
 	var mapTestConn *stunServerConn
 	newConn := func() error {
 		if err == nil {
-			mapTestConn, err = connect(addrStr, socksPort)
+			mapTestConn, err = connect(addrStr, newPacketConn, timeout)
 			if err != nil {
 				e := newError("error creating STUN connection").Base(err)
 				logrus.Warn(e)
@@ -269,7 +279,7 @@ func parse(msg *stun.Message) (ret struct {
 }
 
 // Given an address string, returns a StunServerConn
-func connect(addrStr string, socksPort int) (*stunServerConn, error) {
+func connect(addrStr string, newPacketConn func() (net.PacketConn, error), timeout time.Duration) (*stunServerConn, error) {
 	addr, err := net.ResolveUDPAddr("udp", addrStr)
 	if err != nil {
 		return nil, newError("failed to resolve server address ", addrStr).Base(err)
@@ -277,6 +287,27 @@ func connect(addrStr string, socksPort int) (*stunServerConn, error) {
 
 	logrus.Info(newError("connecting to STUN server: ", addrStr))
 
+	mapTestConn, err := newPacketConn()
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Info(newError("local address: ", mapTestConn.LocalAddr()))
+	logrus.Info(newError("remote address: ", addr))
+
+	mChan := listen(mapTestConn)
+
+	return &stunServerConn{
+		conn:        mapTestConn,
+		LocalAddr:   mapTestConn.LocalAddr(),
+		RemoteAddr:  addr,
+		messageChan: mChan,
+		timeout:     timeout,
+	}, nil
+}
+
+// listenPacket goes through the socks inbound when there is one.
+func listenPacket(addrStr string, socksPort int) (net.PacketConn, error) {
 	var mapTestConn net.PacketConn
 
 	socksConn, err := net.Dial("tcp", fmt.Sprint("127.0.0.1:", socksPort))
@@ -297,18 +328,7 @@ func connect(addrStr string, socksPort int) (*stunServerConn, error) {
 			return nil, newError("failed to listen udp").Base(err)
 		}
 	}
-
-	logrus.Info(newError("local address: ", mapTestConn.LocalAddr()))
-	logrus.Info(newError("remote address: ", addr))
-
-	mChan := listen(mapTestConn)
-
-	return &stunServerConn{
-		conn:        mapTestConn,
-		LocalAddr:   mapTestConn.LocalAddr(),
-		RemoteAddr:  addr,
-		messageChan: mChan,
-	}, nil
+	return mapTestConn, nil
 }
 
 // Send request and wait for response or timeout
@@ -332,7 +352,7 @@ func (c *stunServerConn) roundTrip(msg *stun.Message, addr net.Addr) (*stunRespo
 			return nil, errResponseMessage
 		}
 		return r, nil
-	case <-time.After(time.Duration(timeout) * time.Second):
+	case <-time.After(c.timeout):
 		logrus.Info(newError("timed out waiting for response from server ", addr))
 		return nil, errTimedOut
 	}
@@ -353,11 +373,11 @@ func listen(conn net.PacketConn) (messages chan *stunResponse) {
 				return
 			}
 			logrus.Info(newErrorf("response from %v: (%d bytes)", addr, n))
-			b = b[:n]
 
+			// The message is parsed while the next one is read.
 			r := &stunResponse{
 				Message: &stun.Message{
-					Raw: b,
+					Raw: append([]byte(nil), b[:n]...),
 				},
 				Addr: addr,
 			}
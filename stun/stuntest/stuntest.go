@@ -0,0 +1,105 @@
+// Package stuntest provides a local STUN server for the NAT behavior discovery
+// of RFC 5780, answering from two addresses and two ports.
+package stuntest
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/pion/stun"
+)
+
+const (
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+// Server listens on the primary and the other address, each with the same
+// primary and other port. Requests are answered from the socket picked by
+// their CHANGE-REQUEST.
+type Server struct {
+	conns [2][2]*net.UDPConn
+}
+
+func New(primary, other netip.Addr) (*Server, error) {
+	s := &Server{}
+	for port := range s.conns[0] {
+		conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(primary, 0)))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.conns[0][port] = conn
+		otherAddr := netip.AddrPortFrom(other, conn.LocalAddr().(*net.UDPAddr).AddrPort().Port())
+		s.conns[1][port], err = net.ListenUDP("udp", net.UDPAddrFromAddrPort(otherAddr))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	for address := range s.conns {
+		for port := range s.conns[address] {
+			go s.serve(address, port)
+		}
+	}
+	return s, nil
+}
+
+// Addr returns the primary address and port.
+func (s *Server) Addr() netip.AddrPort {
+	return s.addr(0, 0)
+}
+
+func (s *Server) addr(address int, port int) netip.AddrPort {
+	addrPort := s.conns[address][port].LocalAddr().(*net.UDPAddr).AddrPort()
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
+
+func (s *Server) serve(address int, port int) {
+	conn := s.conns[address][port]
+	buffer := make([]byte, 1500)
+	for {
+		n, source, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		request := &stun.Message{Raw: append([]byte(nil), buffer[:n]...)}
+		if request.Decode() != nil || request.Type != stun.BindingRequest {
+			continue
+		}
+		responseAddress, responsePort := address, port
+		if change, err := request.Get(stun.AttrChangeRequest); err == nil && len(change) == 4 {
+			if change[3]&changeIP != 0 {
+				responseAddress ^= 1
+			}
+			if change[3]&changePort != 0 {
+				responsePort ^= 1
+			}
+		}
+		origin := s.addr(responseAddress, responsePort)
+		other := s.addr(address^1, port^1)
+		mapped := source.AddrPort()
+		response, err := stun.Build(
+			stun.NewTransactionIDSetter(request.TransactionID),
+			stun.BindingSuccess,
+			&stun.XORMappedAddress{IP: mapped.Addr().Unmap().AsSlice(), Port: int(mapped.Port())},
+			&stun.ResponseOrigin{IP: origin.Addr().AsSlice(), Port: int(origin.Port())},
+			&stun.OtherAddress{IP: other.Addr().AsSlice(), Port: int(other.Port())},
+		)
+		if err != nil {
+			continue
+		}
+		_, _ = s.conns[responseAddress][responsePort].WriteToUDP(response.Raw, source)
+	}
+}
+
+func (s *Server) Close() error {
+	for _, conns := range s.conns {
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+	return nil
+}
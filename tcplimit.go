@@ -0,0 +1,46 @@
+package libcore
+
+import (
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"libcore/nat"
+)
+
+// TCPDropStats counts the TCP sessions dropped by the system stack, which
+// enforces the TCP limits of TunConfig.
+type TCPDropStats struct {
+	Unknown  int64
+	SynRate  int64
+	Limit    int64
+	UidLimit int64
+}
+
+// limitUid finds the uid of a connection for the per-UID limit, counting the
+// system uids together as NewConnection does.
+func limitUid(source v2rayNet.Destination, destination v2rayNet.Destination) (uint16, error) {
+	if !useProcfs && uidDumper == nil {
+		return 0, newError("no uid dumper")
+	}
+	uid, err := dumpUid(source, destination)
+	if err != nil {
+		return 0, err
+	}
+	if uid < 0 {
+		return 0, newError("uid not found for ", source.NetAddr())
+	}
+	if uid < 10000 {
+		uid = 1000
+	}
+	return uint16(uid), nil
+}
+
+func (t *Tun2ray) GetTCPDropStats() *TCPDropStats {
+	stats := &TCPDropStats{}
+	if dev, ok := t.dev.(*nat.SystemTun); ok {
+		drops := dev.TCPDrops()
+		stats.Unknown = drops.Unknown
+		stats.SynRate = drops.SynRate
+		stats.Limit = drops.Limit
+		stats.UidLimit = drops.UidLimit
+	}
+	return stats
+}
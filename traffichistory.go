@@ -0,0 +1,375 @@
+package libcore
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TrafficHistoryHourly int32 = iota
+	TrafficHistoryDaily
+)
+
+const (
+	trafficHistoryFile     = "traffic.history"
+	trafficHistoryInterval = time.Minute
+	hourlyRetention        = 7 * 24 * time.Hour
+	dailyRetention         = 400 * 24 * time.Hour
+
+	// The file is compacted once this much was appended to it, or it was
+	// last compacted this long ago.
+	trafficHistoryCompactSize     = 1 << 20
+	trafficHistoryCompactInterval = 24 * time.Hour
+)
+
+type TrafficHistoryEntry struct {
+	Uid int32
+	// Start is the unix time the bucket begins at, hours and days follow
+	// the local time zone.
+	Start    int64
+	Uplink   int64
+	Downlink int64
+	TcpConn  int32
+	UdpConn  int32
+}
+
+type TrafficHistoryListener interface {
+	OnTrafficHistory(entry *TrafficHistoryEntry)
+}
+
+type trafficBucketKey struct {
+	uid    int32
+	period int32
+	start  int64
+}
+
+// trafficRecord is a line of the history file. Compacted records carry a
+// period, records appended while running add to both buckets.
+type trafficRecord struct {
+	Period   *int32 `json:"p,omitempty"`
+	Uid      int32  `json:"u"`
+	Time     int64  `json:"t"`
+	Uplink   int64  `json:"up,omitempty"`
+	Downlink int64  `json:"down,omitempty"`
+	TcpConn  int32  `json:"tcp,omitempty"`
+	UdpConn  int32  `json:"udp,omitempty"`
+}
+
+// TrafficHistory keeps per-app hourly and daily usage in an append-only file
+// that is compacted on open and then periodically while recording.
+type TrafficHistory struct {
+	access    sync.Mutex
+	path      string
+	file      *os.File
+	appended  int64
+	compacted time.Time
+	buckets   map[trafficBucketKey]*TrafficHistoryEntry
+}
+
+// NewTrafficHistory opens the history at path, or in the external assets
+// directory if path is empty.
+func NewTrafficHistory(path string) (*TrafficHistory, error) {
+	if path == "" {
+		path = filepath.Join(externalAssetsPath, trafficHistoryFile)
+	}
+	h := &TrafficHistory{
+		path:    path,
+		buckets: make(map[trafficBucketKey]*TrafficHistoryEntry),
+	}
+	err := h.load()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, newError("failed to load traffic history").Base(err)
+	}
+	err = h.compact()
+	if err != nil {
+		return nil, newError("failed to write traffic history").Base(err)
+	}
+	return h, nil
+}
+
+func (h *TrafficHistory) load() error {
+	file, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record trafficRecord
+		// A partial last line is left by a crash, skip it.
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		if record.Period != nil {
+			h.add(*record.Period, record.Time, &record)
+		} else {
+			h.record(&record)
+		}
+	}
+	return scanner.Err()
+}
+
+func (h *TrafficHistory) compact() error {
+	now := time.Now()
+	records := make([]*trafficRecord, 0, len(h.buckets))
+	for key, entry := range h.buckets {
+		if now.Sub(time.Unix(key.start, 0)) > trafficRetention(key.period) {
+			delete(h.buckets, key)
+			continue
+		}
+		period := key.period
+		records = append(records, &trafficRecord{
+			Period:   &period,
+			Uid:      entry.Uid,
+			Time:     entry.Start,
+			Uplink:   entry.Uplink,
+			Downlink: entry.Downlink,
+			TcpConn:  entry.TcpConn,
+			UdpConn:  entry.UdpConn,
+		})
+	}
+	temp := h.path + ".tmp"
+	err := os.MkdirAll(filepath.Dir(h.path), 0o755)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, record := range records {
+		if err = encoder.Encode(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if h.file != nil {
+		h.file.Close()
+	}
+	err = os.Rename(temp, h.path)
+	if err != nil {
+		os.Remove(temp)
+	}
+	// Records are still appended to the old file if it was not replaced.
+	file, openErr := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	h.file = file
+	if openErr != nil {
+		h.file = nil
+	}
+	if err != nil {
+		return err
+	}
+	h.appended = 0
+	h.compacted = now
+	return openErr
+}
+
+// compactIfDue compacts the file once it grew by trafficHistoryCompactSize
+// or trafficHistoryCompactInterval passed since the last compaction.
+func (h *TrafficHistory) compactIfDue() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.file == nil || (h.appended < trafficHistoryCompactSize && time.Since(h.compacted) < trafficHistoryCompactInterval) {
+		return nil
+	}
+	return h.compact()
+}
+
+func trafficRetention(period int32) time.Duration {
+	if period == TrafficHistoryDaily {
+		return dailyRetention
+	}
+	return hourlyRetention
+}
+
+func periodStart(period int32, unix int64) int64 {
+	at := time.Unix(unix, 0)
+	if period == TrafficHistoryHourly {
+		return time.Date(at.Year(), at.Month(), at.Day(), at.Hour(), 0, 0, 0, time.Local).Unix()
+	}
+	return time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.Local).Unix()
+}
+
+func (h *TrafficHistory) add(period int32, start int64, record *trafficRecord) {
+	if time.Since(time.Unix(start, 0)) > trafficRetention(period) {
+		return
+	}
+	key := trafficBucketKey{record.Uid, period, start}
+	entry := h.buckets[key]
+	if entry == nil {
+		entry = &TrafficHistoryEntry{Uid: record.Uid, Start: start}
+		h.buckets[key] = entry
+	}
+	entry.Uplink += record.Uplink
+	entry.Downlink += record.Downlink
+	entry.TcpConn += record.TcpConn
+	entry.UdpConn += record.UdpConn
+}
+
+func (h *TrafficHistory) record(record *trafficRecord) {
+	h.add(TrafficHistoryHourly, periodStart(TrafficHistoryHourly, record.Time), record)
+	h.add(TrafficHistoryDaily, periodStart(TrafficHistoryDaily, record.Time), record)
+}
+
+func (h *TrafficHistory) append(records []*trafficRecord) error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.file == nil {
+		return os.ErrClosed
+	}
+	for _, record := range records {
+		h.record(record)
+	}
+	writer := bufio.NewWriter(h.file)
+	encoder := json.NewEncoder(writer)
+	for _, record := range records {
+		err := encoder.Encode(record)
+		if err != nil {
+			return err
+		}
+	}
+	h.appended += int64(writer.Buffered())
+	return writer.Flush()
+}
+
+// Query passes the buckets of period starting between from and to, in unix
+// seconds, to listener ordered by time. A negative uid selects all apps.
+func (h *TrafficHistory) Query(uid int32, period int32, from int64, to int64, listener TrafficHistoryListener) error {
+	if period != TrafficHistoryHourly && period != TrafficHistoryDaily {
+		return newError("unknown traffic history period ", period)
+	}
+	h.access.Lock()
+	var entries []TrafficHistoryEntry
+	for key, entry := range h.buckets {
+		if key.period != period || key.start < from || key.start > to {
+			continue
+		}
+		if uid >= 0 && key.uid != uid {
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	h.access.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Start != entries[j].Start {
+			return entries[i].Start < entries[j].Start
+		}
+		return entries[i].Uid < entries[j].Uid
+	})
+	for i := range entries {
+		listener.OnTrafficHistory(&entries[i])
+	}
+	return nil
+}
+
+// Clear drops all history.
+func (h *TrafficHistory) Clear() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	h.buckets = make(map[trafficBucketKey]*TrafficHistoryEntry)
+	return h.compact()
+}
+
+func (h *TrafficHistory) Close() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+type trafficSnapshot struct {
+	uplink   uint64
+	downlink uint64
+	tcpConn  uint32
+	udpConn  uint32
+}
+
+func (t *Tun2ray) loopTrafficHistory() {
+	ticker := time.NewTicker(trafficHistoryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flushTrafficHistory()
+			t.statsAccess.Lock()
+			history := t.history
+			t.statsAccess.Unlock()
+			if history == nil {
+				continue
+			}
+			if err := history.compactIfDue(); err != nil {
+				newError("failed to compact traffic history").Base(err).AtWarning().WriteToLog()
+			}
+		case <-t.historyDone:
+			return
+		}
+	}
+}
+
+// flushTrafficHistory appends the traffic since the last flush. Counters
+// are read as pending plus total, which ReadAppTraffics keeps constant under
+// statsAccess.
+func (t *Tun2ray) flushTrafficHistory() {
+	t.statsAccess.Lock()
+	history := t.history
+	if history == nil {
+		t.statsAccess.Unlock()
+		return
+	}
+	now := time.Now().Unix()
+	var records []*trafficRecord
+	t.appStats.Range(func(key, value interface{}) bool {
+		uid := key.(uint16)
+		stat := value.(*appStats)
+		current := trafficSnapshot{
+			uplink:   atomic.LoadUint64(&stat.uplink) + atomic.LoadUint64(&stat.uplinkTotal),
+			downlink: atomic.LoadUint64(&stat.downlink) + atomic.LoadUint64(&stat.downlinkTotal),
+			tcpConn:  atomic.LoadUint32(&stat.tcpConnTotal),
+			udpConn:  atomic.LoadUint32(&stat.udpConnTotal),
+		}
+		last := t.historyLast[uid]
+		if current != last {
+			records = append(records, &trafficRecord{
+				Uid:      int32(uid),
+				Time:     now,
+				Uplink:   int64(current.uplink - last.uplink),
+				Downlink: int64(current.downlink - last.downlink),
+				TcpConn:  int32(current.tcpConn - last.tcpConn),
+				UdpConn:  int32(current.udpConn - last.udpConn),
+			})
+			t.historyLast[uid] = current
+		}
+		return true
+	})
+	t.statsAccess.Unlock()
+	if len(records) == 0 {
+		return
+	}
+	err := history.append(records)
+	if err != nil {
+		newError("failed to write traffic history").Base(err).AtWarning().WriteToLog()
+	}
+}
@@ -0,0 +1,206 @@
+package libcore
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun/tuntest"
+)
+
+type testTrafficHistoryListener struct {
+	entries []TrafficHistoryEntry
+}
+
+func (l *testTrafficHistoryListener) OnTrafficHistory(entry *TrafficHistoryEntry) {
+	l.entries = append(l.entries, *entry)
+}
+
+func queryTrafficHistory(t *testing.T, history *TrafficHistory, uid int32, period int32) []TrafficHistoryEntry {
+	t.Helper()
+	listener := &testTrafficHistoryListener{}
+	err := history.Query(uid, period, 0, time.Now().Unix(), listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener.entries
+}
+
+func TestTrafficHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	history, err := NewTrafficHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour := time.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+	err = history.append([]*trafficRecord{
+		{Uid: 10001, Time: hour.Unix(), Uplink: 100, Downlink: 1000, TcpConn: 1},
+		{Uid: 10001, Time: hour.Add(10 * time.Minute).Unix(), Uplink: 50, Downlink: 500, UdpConn: 2},
+		{Uid: 10001, Time: hour.Add(time.Hour).Unix(), Uplink: 1, Downlink: 2},
+		{Uid: 10002, Time: hour.Unix(), Uplink: 7, Downlink: 8},
+		{Uid: 10002, Time: time.Now().Add(-30 * 24 * time.Hour).Unix(), Uplink: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(history *TrafficHistory) {
+		t.Helper()
+		hourly := queryTrafficHistory(t, history, 10001, TrafficHistoryHourly)
+		if len(hourly) != 2 || hourly[0].Start != hour.Unix() || hourly[0].Uplink != 150 || hourly[0].Downlink != 1500 || hourly[0].TcpConn != 1 || hourly[0].UdpConn != 2 {
+			t.Fatalf("unexpected hourly history %+v", hourly)
+		}
+		if hourly[1].Uplink != 1 || hourly[1].Downlink != 2 {
+			t.Fatalf("unexpected hourly history %+v", hourly)
+		}
+		all := queryTrafficHistory(t, history, -1, TrafficHistoryHourly)
+		if len(all) != 3 {
+			t.Fatalf("unexpected hourly history for all apps %+v", all)
+		}
+		var uplink int64
+		for _, entry := range queryTrafficHistory(t, history, 10001, TrafficHistoryDaily) {
+			uplink += entry.Uplink
+		}
+		if uplink != 151 {
+			t.Fatalf("unexpected daily uplink %d", uplink)
+		}
+		// Only the daily bucket outlives the hourly retention.
+		if daily := queryTrafficHistory(t, history, 10002, TrafficHistoryDaily); len(daily) < 2 {
+			t.Fatalf("unexpected daily history %+v", daily)
+		}
+	}
+	check(history)
+	history.Close()
+
+	// A partial line left by a crash is skipped.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"u":10001,"t":`)
+	file.Close()
+
+	history, err = NewTrafficHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	check(history)
+
+	err = history.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := queryTrafficHistory(t, history, -1, TrafficHistoryDaily); len(all) != 0 {
+		t.Fatalf("history not cleared %+v", all)
+	}
+}
+
+func TestTrafficHistoryCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	history, err := NewTrafficHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	hour := time.Now().Truncate(time.Hour)
+	for i := 0; i < 3; i++ {
+		err = history.append([]*trafficRecord{{Uid: 10001, Time: hour.Unix(), Uplink: 100}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := func() []string {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(content)), "\n")
+	}
+
+	if err = history.compactIfDue(); err != nil || len(lines()) != 3 {
+		t.Fatalf("compacted before due: %v", err)
+	}
+	history.compacted = time.Now().Add(-trafficHistoryCompactInterval)
+	if err = history.compactIfDue(); err != nil {
+		t.Fatal(err)
+	}
+	// One hourly and one daily bucket are left.
+	if compacted := lines(); len(compacted) != 2 {
+		t.Fatalf("unexpected compacted file %q", compacted)
+	}
+	err = history.append([]*trafficRecord{{Uid: 10001, Time: hour.Unix(), Uplink: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := queryTrafficHistory(t, history, 10001, TrafficHistoryHourly); len(entries) != 1 || entries[0].Uplink != 400 {
+		t.Fatalf("unexpected history %+v", entries)
+	}
+	if len(lines()) != 3 {
+		t.Fatal("record not appended after compaction")
+	}
+}
+
+func TestTun2rayTrafficHistory(t *testing.T) {
+	history, err := NewTrafficHistory(filepath.Join(t.TempDir(), "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	SetUidDumper(testUidDumper{10005}, false)
+	t.Cleanup(func() {
+		SetUidDumper(nil, false)
+	})
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationSystem, func(config *TunConfig) {
+		config.TrafficStats = true
+		config.TrafficHistory = history
+	})
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	destination := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+
+	err = device.Write(tuntest.UDPPacket(source, destination, []byte("ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.UDPProtocolNumber
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply.Payload, []byte("ping")) {
+		t.Fatalf("unexpected reply %q", reply.Payload)
+	}
+
+	// Counters read by the app are still recorded.
+	tun.ReadAppTraffics(&testTrafficListener{})
+	tun.ResetAppTraffics()
+	tun.Close()
+
+	entries := queryTrafficHistory(t, history, 10005, TrafficHistoryHourly)
+	if len(entries) != 1 || entries[0].Uplink != 4 || entries[0].Downlink != 4 || entries[0].UdpConn != 1 {
+		t.Fatalf("unexpected history %+v", entries)
+	}
+}
+
+type testTrafficListener struct{}
+
+func (testTrafficListener) UpdateStats(*AppStats) {}
+
+type testUidDumper struct {
+	uid int32
+}
+
+func (d testUidDumper) DumpUid(int32, string, int32, string, int32) (int32, error) {
+	return d.uid, nil
+}
+
+func (d testUidDumper) GetUidInfo(int32) (*UidInfo, error) {
+	return &UidInfo{PackageName: "test", Label: "Test"}, nil
+}
@@ -5,10 +5,11 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"math"
 	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,9 +21,11 @@ import (
 	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
 	"github.com/v2fly/v2ray-core/v5/common/net/pingproto"
 	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
 	"github.com/v2fly/v2ray-core/v5/features/dns/localdns"
 	"github.com/v2fly/v2ray-core/v5/features/outbound"
 	routing_session "github.com/v2fly/v2ray-core/v5/features/routing/session"
+	dnsOutbound "github.com/v2fly/v2ray-core/v5/proxy/dns"
 	"github.com/v2fly/v2ray-core/v5/proxy/wireguard"
 	"github.com/v2fly/v2ray-core/v5/transport/internet"
 	"golang.org/x/sys/unix"
@@ -37,42 +40,99 @@ var _ tun.Handler = (*Tun2ray)(nil)
 type Tun2ray struct {
 	dev                 tun.Tun
 	router              string
+	router6             string
 	v2ray               *V2RayInstance
 	sniffing            bool
 	overrideDestination bool
 	debug               bool
+	tcpSniffers         []protocolSniffer
+	udpSniffers         []protocolSniffer
 
 	dumpUid      bool
 	trafficStats bool
-	pcap         bool
-
-	udpTable  sync.Map
-	appStats  sync.Map
-	lockTable sync.Map
-
-	defaultOutboundForPing outbound.Handler
+	capture      *packetCapture
+
+	udpTable     sync.Map
+	appStats     sync.Map
+	lockTable    sync.Map
+	connections  connectionTable
+	fakeDNS      *fakeIPPool
+	dnsQueries   sync.Map
+	nat64        *nat64Translator
+	udpNATMode   int32
+	udpSessions  *udpSessions
+	errorHandler ErrorHandler
+
+	udpIdleTimeout time.Duration
+	dnsTimeout     time.Duration
+	quicTimeout    time.Duration
+	pingTimeout    time.Duration
+
+	firewallAccess sync.RWMutex
+	firewallRules  []*firewallRule
+
+	globalLimit bandwidthLimit
+	appLimits   sync.Map
+
+	quotas        sync.Map
+	quotaAccess   sync.Mutex
+	quotaListener QuotaListener
+	quotaOnce     sync.Once
+	quotaDone     chan struct{}
+
+	statsAccess sync.Mutex
+	history     *TrafficHistory
+	historyLast map[uint16]trafficSnapshot
+	historyDone chan struct{}
 }
 
 type TunConfig struct {
-	FileDescriptor      int32
-	Protect             bool
-	Protector           Protector
-	MTU                 int32
-	V2Ray               *V2RayInstance
-	Gateway4            string
-	Gateway6            string
-	BindUpstream        Protector
-	IPv6Mode            int32
-	Implementation      int32
-	Sniffing            bool
-	OverrideDestination bool
-	Debug               bool
-	DumpUID             bool
-	TrafficStats        bool
-	PCap                bool
-	ErrorHandler        ErrorHandler
+	FileDescriptor          int32
+	Name                    string
+	Inet4Address            string
+	Inet6Address            string
+	Routes                  string
+	Protect                 bool
+	Protector               Protector
+	MTU                     int32
+	V2Ray                   *V2RayInstance
+	Gateway4                string
+	Gateway6                string
+	BindUpstream            Protector
+	IPv6Mode                int32
+	Implementation          int32
+	Sniffing                bool
+	SniffProtocols          string
+	OverrideDestination     bool
+	Debug                   bool
+	DumpUID                 bool
+	TrafficStats            bool
+	TrafficHistory          *TrafficHistory
+	PCap                    bool
+	PCapSnapLen             int32
+	PCapRotateSize          int64
+	PCapUid                 int32
+	FakeDNS                 bool
+	FakeDNSRange4           string
+	FakeDNSRange6           string
+	FakeDNSExclude          string
+	FakeDNSCache            string
+	NAT64                   bool
+	NAT64Prefix             string
+	UDPNATMode              int32
+	UDPTimeout              int32
+	DNSTimeout              int32
+	QUICTimeout             int32
+	PingTimeout             int32
+	MaxUDPSessions          int32
+	MaxTCPConnections       int32
+	MaxTCPConnectionsPerUID int32
+	TCPSynRate              int32
+	ErrorHandler            ErrorHandler
 }
 
+// ErrorHandler gets the message of every event of the tun, SetEventListener
+// gives typed ones.
 type ErrorHandler interface {
 	HandleError(err string)
 }
@@ -91,31 +151,100 @@ func NewTun2ray(config *TunConfig) (*Tun2ray, error) {
 		debug:               config.Debug,
 		dumpUid:             config.DumpUID,
 		trafficStats:        config.TrafficStats,
+		udpNATMode:          config.UDPNATMode,
+		udpSessions:         newUDPSessions(config.MaxUDPSessions),
+		udpIdleTimeout:      timeoutOrDefault(config.UDPTimeout, defaultUDPTimeout),
+		dnsTimeout:          timeoutOrDefault(config.DNSTimeout, defaultDNSTimeout),
+		quicTimeout:         timeoutOrDefault(config.QUICTimeout, defaultQUICTimeout),
+		pingTimeout:         timeoutOrDefault(config.PingTimeout, defaultPingTimeout),
+		errorHandler:        config.ErrorHandler,
+		quotaDone:           make(chan struct{}),
+	}
+
+	if config.Gateway6 != "" {
+		t.router6 = v2rayNet.ParseAddress(config.Gateway6).String()
+	}
+
+	// The uid filter of captures needs the owners found by the handlers,
+	// otherwise packets carry them only when uids are dumped anyway.
+	if config.PCap && config.PCapUid > 0 {
+		t.dumpUid = true
+	}
+
+	if config.UDPNATMode < comm.UDPNATEndpointIndependent || config.UDPNATMode > comm.UDPNATSymmetric {
+		return nil, newError("unknown udp nat mode ", config.UDPNATMode)
 	}
 
 	var err error
-	switch config.Implementation {
-	case comm.TunImplementationGVisor:
-		var pcapFile *os.File
-		if config.PCap {
-			path := time.Now().UTC().String()
-			path = externalAssetsPath + "/pcap/" + path + ".pcap"
-			err = os.MkdirAll(filepath.Dir(path), 0o755)
-			if err != nil {
-				return nil, newError("unable to create pcap dir").Base(err)
-			}
-			pcapFile, err = os.Create(path)
+	t.tcpSniffers, err = newSnifferChain(v2rayNet.Network_TCP, config.SniffProtocols)
+	if err != nil {
+		return nil, err
+	}
+	t.udpSniffers, err = newSnifferChain(v2rayNet.Network_UDP, config.SniffProtocols)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.FakeDNS {
+		t.fakeDNS, err = newFakeIPPool(config.FakeDNSRange4, config.FakeDNSRange6, config.FakeDNSExclude, config.IPv6Mode, config.FakeDNSCache)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.NAT64 {
+		t.nat64 = new(nat64Translator)
+		if config.NAT64Prefix != "" {
+			t.nat64.prefix, err = parseNAT64Prefix(config.NAT64Prefix)
 			if err != nil {
-				return nil, newError("unable to create pcap file").Base(err)
+				return nil, err
 			}
 		}
+	}
+
+	// The stack takes over the descriptor, an app owned one is duplicated.
+	var fd int
+	if config.Name != "" {
+		fd, err = openTunDevice(config)
+	} else {
+		fd, err = unix.FcntlInt(uintptr(config.FileDescriptor), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			err = newError("failed to duplicate tun descriptor").Base(err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var capture tun.PacketCapture
+	if config.PCap {
+		t.capture, err = newPacketCapture(filepath.Join(externalAssetsPath, pcapDir), config.PCapSnapLen, config.PCapRotateSize, config.PCapUid)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+		capture = t.capture
+	}
 
-		t.dev, err = gvisor.New(config.FileDescriptor, config.MTU, t, gvisor.DefaultNIC, config.PCap, pcapFile, math.MaxUint32, config.IPv6Mode)
+	switch config.Implementation {
+	case comm.TunImplementationGVisor:
+		t.dev, err = gvisor.New(int32(fd), config.MTU, t, gvisor.DefaultNIC, capture, config.IPv6Mode, t.udpSessions.packets, t.handleEvent)
 	case comm.TunImplementationSystem:
-		t.dev, err = nat.New(config.FileDescriptor, config.MTU, t, config.IPv6Mode, config.ErrorHandler.HandleError)
+		t.dev, err = nat.New(int32(fd), config.MTU, t, config.IPv6Mode, capture, nat.TCPLimit{
+			MaxConnections:       config.MaxTCPConnections,
+			MaxConnectionsPerUid: config.MaxTCPConnectionsPerUID,
+			SynRate:              config.TCPSynRate,
+			Uid:                  limitUid,
+		}, t.udpSessions.packets, t.handleEvent)
+	default:
+		err = newError("unknown tun implementation ", config.Implementation)
 	}
 
 	if err != nil {
+		unix.Close(fd)
+		if t.capture != nil {
+			t.capture.Close()
+		}
 		return nil, err
 	}
 
@@ -123,11 +252,15 @@ func NewTun2ray(config *TunConfig) (*Tun2ray, error) {
 		config.Protector = noopProtectorInstance
 	}
 
-	dc := config.V2Ray.dnsClient
 	internet.UseAlternativeSystemDialer(&protectedDialer{
 		protector: config.Protector,
+		nat64:     t.nat64,
 		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
-			ips, _, err := dc.LookupDefault(ctx, domain)
+			v2ray := t.v2ray.load()
+			if v2ray == nil {
+				return nil, newError("v2ray instance closed")
+			}
+			ips, _, err := v2ray.dnsClient.LookupDefault(ctx, domain)
 			return ips, err
 		},
 	})
@@ -141,20 +274,30 @@ func NewTun2ray(config *TunConfig) (*Tun2ray, error) {
 			bindToUpstream(fd)
 		}
 	}
-	if defaultOutbound, ok := t.v2ray.outboundManager.GetDefaultHandler().(*appOutbound.Handler); ok {
-		if _, isWireGuard := defaultOutbound.GetOutbound().(*wireguard.Client); isWireGuard {
-			t.defaultOutboundForPing = defaultOutbound
-		}
-	}
-
 	internet.UseAlternativeSystemDNSDialer(&protectedDialer{
 		protector: config.Protector,
+		nat64:     t.nat64,
 		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
 			ips, _, err := localdns.Client().LookupDefault(ctx, domain)
 			return ips, err
 		},
 	})
 
+	if t.trafficStats && config.TrafficHistory != nil {
+		t.history = config.TrafficHistory
+		t.historyLast = make(map[uint16]trafficSnapshot)
+		t.historyDone = make(chan struct{})
+		go t.loopTrafficHistory()
+	}
+
+	if config.NAT64 && config.NAT64Prefix == "" {
+		go func() {
+			if err := t.DiscoverNAT64Prefix(); err != nil {
+				newError("failed to discover nat64 prefix").Base(err).AtWarning().WriteToLog()
+			}
+		}()
+	}
+
 	return t, nil
 }
 
@@ -163,6 +306,57 @@ func (t *Tun2ray) Close() {
 	internet.UseAlternativeSystemDialer(nil)
 	internet.UseAlternativeSystemDNSDialer(nil)
 	comm.CloseIgnore(t.dev)
+	if t.capture != nil {
+		t.capture.Close()
+	}
+	select {
+	case <-t.quotaDone:
+	default:
+		close(t.quotaDone)
+	}
+	if t.history != nil {
+		close(t.historyDone)
+		t.flushTrafficHistory()
+		t.statsAccess.Lock()
+		t.history = nil
+		t.statsAccess.Unlock()
+	}
+	if t.fakeDNS != nil {
+		if err := t.fakeDNS.close(); err != nil {
+			newError("failed to save fake dns cache").Base(err).AtWarning().WriteToLog()
+		}
+	}
+}
+
+// openTunDevice creates the interface itself instead of using a descriptor
+// from VpnService, for desktop Linux and network namespaces.
+func openTunDevice(config *TunConfig) (int, error) {
+	options := tun.Options{
+		Name: config.Name,
+		MTU:  uint32(config.MTU),
+	}
+	for _, address := range []string{config.Inet4Address, config.Inet6Address} {
+		if address == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			return -1, newError("invalid tun address ", address).Base(err)
+		}
+		options.Addresses = append(options.Addresses, prefix)
+	}
+	for _, route := range strings.Split(config.Routes, "\n") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return -1, newError("invalid tun route ", route).Base(err)
+		}
+		options.Routes = append(options.Routes, prefix)
+	}
+	return tun.Open(options)
 }
 
 func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNet.Destination, conn net.Conn) {
@@ -209,20 +403,26 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 		}
 	}
 
-	ctx := core.WithContext(context.Background(), t.v2ray.core)
-	ctx = session.ContextWithInbound(ctx, inbound)
-
-	if !isDns && t.sniffing {
-		req := session.SniffingRequest{
-			Enabled:   true,
-			RouteOnly: !t.overrideDestination,
-		}
-		if t.sniffing {
-			req.OverrideDestinationForProtocol = append(req.OverrideDestinationForProtocol, "http", "tls")
+	if !self {
+		switch t.firewallAction(uid, source, destination) {
+		case FirewallActionDrop:
+			dropConn(conn)
+			return
+		case FirewallActionReject:
+			resetConn(conn)
+			return
 		}
-		ctx = session.ContextWithContent(ctx, &session.Content{
-			SniffingRequest: req,
-		})
+	}
+
+	connection := &trackedConnection{
+		source:      source,
+		destination: destination,
+		uid:         uint32(uid),
+		closer:      conn,
+	}
+	conn = NewStatsCounterConn(conn, &connection.uplink, &connection.downlink)
+	if t.fakeDNS != nil && (isDns || destination.Address.String() == t.router6) {
+		conn = &fakeDNSConn{Conn: conn, t: t, uid: int32(uid)}
 	}
 
 	var stats *appStats
@@ -252,38 +452,205 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 		atomic.AddUint32(&stats.tcpConnTotal, 1)
 		atomic.StoreInt64(&stats.deactivateAt, 0)
 		conn = NewStatsCounterConn(conn, &stats.uplink, &stats.downlink)
-		stats.Lock()
-		statsElement := stats.connections.PushBack(conn)
-		stats.Unlock()
 		defer func() {
 			if atomic.AddInt32(&stats.tcpConn, -1)+atomic.LoadInt32(&stats.udpConn) == 0 {
 				atomic.StoreInt64(&stats.deactivateAt, time.Now().Unix())
 			}
-			stats.Lock()
-			stats.connections.Remove(statsElement)
-			stats.Unlock()
 		}()
 	}
+	if !isDns {
+		conn = t.newLimitedConn(conn, uid)
+	}
+
+	v2ray := t.v2ray.acquire()
+	if v2ray == nil {
+		comm.CloseIgnore(connection.closer)
+		return
+	}
+	defer v2ray.release()
+	defer v2ray.track(connection.closer)()
+
+	ctx := core.WithContext(context.Background(), v2ray.core)
+	ctx = session.ContextWithInbound(ctx, inbound)
+	ob := &session.Outbound{Target: destination}
+	ctx = session.ContextWithOutbound(ctx, ob)
+	content := new(session.Content)
+	ctx = session.ContextWithContent(ctx, content)
+	outboundErr := new(outboundErrorTracker)
+	ctx = session.TrackedConnectionError(ctx, outboundErr)
+
+	if t.fakeDNS != nil {
+		domain, err := t.fakeDNS.restore(&ob.Target)
+		if err != nil {
+			newError("[TCP] ", source.NetAddr(), " ==> ", destination.NetAddr()).Base(err).AtWarning().WriteToLog()
+			comm.CloseIgnore(connection.closer)
+			return
+		}
+		connection.domain = domain
+	}
+	t.nat64.restore(&ob.Target)
+
+	var domain string
+	if !isDns && t.sniffing {
+		var header []byte
+		var err error
+		conn, header, err = peekConn(conn)
+		if err != nil {
+			comm.CloseIgnore(connection.closer)
+			return
+		}
+		if len(header) > 0 {
+			connection.protocol, domain = sniff(header, t.tcpSniffers)
+			if domain != "" {
+				connection.domain = domain
+			}
+		}
+	}
 	inbound.Conn = conn
 
-	_ = t.v2ray.dispatcher.DispatchConn(ctx, destination, conn, true)
+	routeCtx := t.sniffed(ctx, content, ob.Target, connection.protocol, domain)
+	connection.outbound = t.pickOutbound(v2ray, routeCtx)
+	if outbound, block := t.quotaOutbound(uid); block {
+		comm.CloseIgnore(connection.closer)
+		return
+	} else if outbound != "" {
+		connection.outbound = outbound
+		ctx = session.SetForcedOutboundTagToContext(ctx, outbound)
+	}
+	if t.capture != nil {
+		t.capture.annotate(source, uid, connection.outbound)
+	}
+
+	t.connections.add(connection)
+	defer t.connections.remove(connection)
+
+	_ = v2ray.dispatcher.DispatchConn(ctx, ob.Target, conn, true)
+	if atomic.LoadUint64(&connection.downlink) == 0 {
+		reportOutboundFailure(connection.outbound, outboundErr.Err())
+	}
+}
+
+// sniffed passes the protocol and domain found by the sniffers of the tun on
+// to the dispatcher. Protocols with a domain are sniffed again by it, so it
+// routes by the domain or replaces the destination with it as configured. It
+// returns a copy of ctx for picking the outbound the connection is shown with.
+func (t *Tun2ray) sniffed(ctx context.Context, content *session.Content, target v2rayNet.Destination, protocol string, domain string) context.Context {
+	ob := &session.Outbound{Target: target}
+	if domain != "" {
+		content.SniffingRequest = session.SniffingRequest{
+			Enabled:                        true,
+			RouteOnly:                      !t.overrideDestination,
+			OverrideDestinationForProtocol: []string{protocol},
+		}
+		ob.RouteTarget = target
+		ob.RouteTarget.Address = v2rayNet.ParseAddress(domain)
+	} else {
+		content.Protocol = protocol
+	}
+	ctx = session.ContextWithOutbound(ctx, ob)
+	return session.ContextWithContent(ctx, &session.Content{Protocol: protocol})
+}
+
+// dnsOutbound reports if tag is a DNS outbound, which answers queries with the
+// DNS client of the core.
+func (v2ray *v2rayCore) dnsOutbound(tag string) bool {
+	handler, ok := v2ray.outboundManager.GetHandler(tag).(*appOutbound.Handler)
+	if !ok {
+		return false
+	}
+	_, ok = handler.GetOutbound().(*dnsOutbound.Handler)
+	return ok
+}
+
+// pickOutbound returns the outbound the router picks for ctx, as the
+// dispatcher does. Balancers may pick another one for the dispatched
+// connection.
+func (t *Tun2ray) pickOutbound(v2ray *v2rayCore, ctx context.Context) string {
+	if route, err := v2ray.router.PickRoute(routing_session.AsRoutingContext(ctx)); err == nil {
+		tag := route.GetOutboundTag()
+		if v2ray.outboundManager.GetHandler(tag) != nil {
+			return tag
+		}
+		newError("non existing tag: ", tag).AtWarning().WriteToLog()
+	}
+	if handler := v2ray.outboundManager.GetDefaultHandler(); handler != nil {
+		return handler.Tag()
+	}
+	return ""
 }
 
 func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.Destination, data *buf.Buffer, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) {
+	isDns := destination.Address.String() == t.router
+	if t.fakeDNS != nil && (isDns || destination.Address.String() == t.router6) {
+		if response := t.exchangeFakeDNS(data.Bytes(), func() int32 {
+			var uid int32
+			if t.dumpUid {
+				uid, _ = dumpUid(source, destination)
+			}
+			return uid
+		}); response != nil {
+			data.Release()
+			_, _ = writeBack(response, nil)
+			comm.CloseIgnore(closer)
+			return
+		}
+	}
+
+	target := destination
+	var fakeDomain string
+	if t.fakeDNS != nil {
+		var err error
+		fakeDomain, err = t.fakeDNS.restore(&target)
+		if err != nil {
+			newError("[UDP] ", source.NetAddr(), " ==> ", destination.NetAddr()).Base(err).AtWarning().WriteToLog()
+			rejectPacket(closer, tun.UnreachableHost)
+			data.Release()
+			comm.CloseIgnore(closer)
+			return
+		}
+	}
+
+	nat64Restored := t.nat64.restore(&target)
+
 	natKey := source.NetAddr()
+	if t.udpNATMode == comm.UDPNATSymmetric && !isDns {
+		natKey += "-" + destination.NetAddr()
+	}
+
+	var pending *pendingDNSQuery
+	var queryID uint16
+	if isDns {
+		pending = newPendingDNSQuery(data.Bytes(), 0, "")
+		queryID, _ = dnsMessageID(data.Bytes())
+	}
 
 	sendTo := func() bool {
 		iConn, ok := t.udpTable.Load(natKey)
 		if !ok {
 			return false
 		}
+		t.udpSessions.touch(natKey)
+		// Queries are only registered with a session to answer them, which
+		// removes those left unanswered when it ends.
+		if pending != nil {
+			t.dnsQueries.Store(dnsQueryKey{natKey, queryID}, pending)
+		}
 		conn := iConn.(packetConn)
-		err := conn.writeTo(data, &net.UDPAddr{
-			IP:   destination.Address.IP(),
-			Port: int(destination.Port),
-		})
+		var addr net.Addr
+		if fakeDomain != "" {
+			addr = &fakeAddr{target}
+		} else {
+			addr = &net.UDPAddr{
+				IP:   target.Address.IP(),
+				Port: int(target.Port),
+			}
+		}
+		err := conn.writeTo(data, addr)
 		if err != nil {
 			_ = conn.Close()
+			if pending != nil {
+				t.dnsQueries.Delete(dnsQueryKey{natKey, queryID})
+			}
 		}
 		return true
 	}
@@ -313,7 +680,6 @@ func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.De
 		NetworkType: networkType,
 		WifiSSID:    wifiSSID,
 	}
-	isDns := destination.Address.String() == t.router
 
 	if isDns {
 		inbound.Tag = "dns-in"
@@ -366,30 +732,99 @@ func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.De
 
 	}
 
-	ctx := core.WithContext(context.Background(), t.v2ray.core)
+	if !self {
+		if action := t.firewallAction(uid, source, destination); action != FirewallActionAllow {
+			if action == FirewallActionReject {
+				rejectPacket(closer, tun.UnreachablePort)
+			}
+			data.Release()
+			comm.CloseIgnore(closer)
+			t.lockTable.Delete(natKey)
+			cond.Broadcast()
+			return
+		}
+	}
+
+	v2ray := t.v2ray.acquire()
+	if v2ray == nil {
+		data.Release()
+		comm.CloseIgnore(closer)
+		t.lockTable.Delete(natKey)
+		cond.Broadcast()
+		return
+	}
+	defer v2ray.release()
+
+	ctx := core.WithContext(context.Background(), v2ray.core)
 	ctx = session.ContextWithInbound(ctx, inbound)
+	ob := &session.Outbound{Target: target}
+	ctx = session.ContextWithOutbound(ctx, ob)
+	content := new(session.Content)
+	ctx = session.ContextWithContent(ctx, content)
+	outboundErr := new(outboundErrorTracker)
+	ctx = session.TrackedConnectionError(ctx, outboundErr)
+
+	connection := &trackedConnection{
+		source:      source,
+		destination: destination,
+		uid:         uint32(uid),
+		domain:      fakeDomain,
+	}
 
+	sniffers := udpDnsSniffers
 	if !isDns && t.sniffing {
-		req := session.SniffingRequest{
-			Enabled:   true,
-			RouteOnly: !t.overrideDestination,
-		}
-		if t.sniffing {
-			req.OverrideDestinationForProtocol = append(req.OverrideDestinationForProtocol, "quic")
-		}
-		ctx = session.ContextWithContent(ctx, &session.Content{
-			SniffingRequest: req,
-		})
+		sniffers = t.udpSniffers
+	}
+	var domain string
+	connection.protocol, domain = sniff(data.Bytes(), sniffers)
+	if domain != "" {
+		connection.domain = domain
+	}
+
+	routeCtx := t.sniffed(ctx, content, ob.Target, connection.protocol, domain)
+	connection.outbound = t.pickOutbound(v2ray, routeCtx)
+	if outbound, block := t.quotaOutbound(uid); block {
+		data.Release()
+		comm.CloseIgnore(closer)
+		t.lockTable.Delete(natKey)
+		cond.Broadcast()
+		return
+	} else if outbound != "" {
+		connection.outbound = outbound
+		ctx = session.SetForcedOutboundTagToContext(ctx, outbound)
+	}
+	if t.capture != nil {
+		t.capture.annotate(source, uid, connection.outbound)
+	}
+	var trace *dnsQueryTrace
+	if isDns {
+		trace = &dnsQueryTrace{cache: v2ray.localDNS && localResolverSet() && v2ray.dnsOutbound(connection.outbound)}
+		ctx = contextWithDNSQueryTrace(ctx, trace)
 	}
 
-	conn, err := t.v2ray.dialUDP(ctx, destination, time.Minute*5)
+	conn, err := v2ray.dialUDP(ctx, ob.Target, t.udpTimeout(isDns, connection.protocol, destination))
 	if err != nil {
 		logrus.Errorf("[UDP] dial failed: %s", err.Error())
+		reportOutboundFailure(connection.outbound, err)
+		rejectPacket(closer, unreachableReason(err))
+		data.Release()
+		comm.CloseIgnore(closer)
+		t.lockTable.Delete(natKey)
+		cond.Broadcast()
 		return
 	}
 	element := v2rayNet.AddConnection(conn)
 	defer v2rayNet.RemoveConnection(element)
 
+	connection.closer = conn
+	defer v2ray.track(conn)()
+	if !isDns {
+		conn = newNATPacketConn(conn, t.udpNATMode)
+	}
+	conn = statsPacketConn{conn, &connection.uplink, &connection.downlink}
+	t.connections.add(connection)
+	defer t.connections.remove(connection)
+
 	var stats *appStats
 	if t.trafficStats && !self && !isDns {
 		if iStats, exists := t.appStats.Load(uid); exists {
@@ -417,50 +852,104 @@ func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.De
 		atomic.AddUint32(&stats.udpConnTotal, 1)
 		atomic.StoreInt64(&stats.deactivateAt, 0)
 		conn = statsPacketConn{conn, &stats.uplink, &stats.downlink}
-		stats.Lock()
-		statsElement := stats.connections.PushBack(conn)
-		stats.Unlock()
 		defer func() {
 			if atomic.AddInt32(&stats.udpConn, -1)+atomic.LoadInt32(&stats.tcpConn) == 0 {
 				atomic.StoreInt64(&stats.deactivateAt, time.Now().Unix())
 			}
-			stats.Lock()
-			stats.connections.Remove(statsElement)
-			stats.Unlock()
 		}()
 	}
+	if !isDns {
+		conn = t.newLimitedPacketConn(conn, uid)
+	}
 
 	t.udpTable.Store(natKey, conn)
+	t.udpSessions.add(natKey, connection.closer)
 
 	go sendTo()
 
 	t.lockTable.Delete(natKey)
 	cond.Broadcast()
 
+	var replied bool
 	for {
 		buffer, addr, err := conn.readFrom()
 		if err != nil {
 			break
 		}
-		if isDns {
+		replied = true
+		t.udpSessions.touch(natKey)
+		// Replies from a restored domain or NAT64 address come from its
+		// real address, which the application never saw.
+		if isDns || fakeDomain != "" || nat64Restored {
 			addr = nil
 		}
+		response := buffer.Bytes()
+		if isDns {
+			if synthesized := t.nat64.synthesize(response, func(domain string) ([]net.IP, uint32, error) {
+				return v2ray.dnsClient.Lookup(ctx, domain, dns.QueryStrategy_USE_IP4)
+			}); synthesized != nil {
+				response = synthesized
+			}
+			if id, ok := dnsMessageID(response); ok {
+				if pending, loaded := t.dnsQueries.LoadAndDelete(dnsQueryKey{natKey, id}); loaded {
+					pending := pending.(*pendingDNSQuery)
+					pending.entry.Uid = int32(uid)
+					trace.finish(pending, response, nil)
+				}
+			}
+		}
 		if addr, ok := addr.(*net.UDPAddr); ok {
-			_, err = writeBack(buffer.Bytes(), addr)
+			_, err = writeBack(response, addr)
 		} else {
-			_, err = writeBack(buffer.Bytes(), nil)
+			_, err = writeBack(response, nil)
 		}
 		buffer.Release()
 		if err != nil {
 			break
 		}
 	}
+	// The outbound failed before anything came back, tell the application
+	// instead of letting it wait for a timeout.
+	if err := outboundErr.Err(); err != nil && !replied {
+		reportOutboundFailure(connection.outbound, err)
+		rejectPacket(closer, unreachableReason(err))
+	}
 	// close
 	comm.CloseIgnore(closer)
 	t.udpTable.Delete(natKey)
+	t.udpSessions.remove(natKey, connection.closer)
+	if isDns {
+		t.dnsQueries.Range(func(key, value interface{}) bool {
+			if key.(dnsQueryKey).source == natKey {
+				t.dnsQueries.Delete(key)
+				pending := value.(*pendingDNSQuery)
+				pending.entry.Uid = int32(uid)
+				trace.finish(pending, nil, newError("no response"))
+				reportDNSFailure(connection.outbound, newError("no response"))
+			}
+			return true
+		})
+	}
 }
 
 func (t *Tun2ray) NewPingPacket(source v2rayNet.Destination, destination v2rayNet.Destination, message *buf.Buffer, writeBack func([]byte) error, closer io.Closer) bool {
+	// The owner of a ping cannot be found, so only the rules without a uid,
+	// protocol or ports apply to it.
+	if action := t.firewallAction(0, source, v2rayNet.Destination{Address: destination.Address}); action != FirewallActionAllow {
+		if action == FirewallActionReject {
+			rejectPing(destination, closer, tun.UnreachableProhibited)
+		}
+		message.Release()
+		comm.CloseIgnore(closer)
+		return true
+	}
+
+	if writer, ok := closer.(tun.ICMPErrorWriter); ok && writer.TTL() <= traceTTL {
+		if t.tracePing(source, destination, message, writeBack, writer, closer) {
+			return true
+		}
+	}
+
 	natKey := fmt.Sprint(source.Address, "-", destination.Address)
 
 	sendTo := func() bool {
@@ -504,35 +993,19 @@ func (t *Tun2ray) NewPingPacket(source v2rayNet.Destination, destination v2rayNe
 		cond.Broadcast()
 	}()
 
-	ctx := core.WithContext(context.Background(), t.v2ray.core)
-	ctx = session.ContextWithInbound(ctx, &session.Inbound{
-		Source:      source,
-		Tag:         "tun",
-		NetworkType: networkType,
-		WifiSSID:    wifiSSID,
-	})
-	ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: destination})
-	ctx = session.ContextWithContent(ctx, &session.Content{Protocol: "ping"})
-
-	var handler outbound.Handler
-	if route, err := t.v2ray.router.PickRoute(routing_session.AsRoutingContext(ctx)); err == nil {
-		tag := route.GetOutboundTag()
-		handler = t.v2ray.outboundManager.GetHandler(tag)
-		if handler != nil {
-			newError("taking detour [", tag, "] for [", destination.Address, "]").WriteToLog()
-		} else {
-			newError("non existing tag: ", tag).AtWarning().WriteToLog()
-			return false
-		}
-	} else if t.defaultOutboundForPing != nil {
-		handler = t.defaultOutboundForPing
-		newError("default route for ", destination.Address).AtWarning().WriteToLog()
+	v2ray := t.v2ray.acquire()
+	if v2ray == nil {
+		return false
+	}
 
-	} else {
+	ctx := pingContext(v2ray, source, destination)
+	handler := pingOutbound(v2ray, ctx, destination)
+	if handler == nil {
+		v2ray.release()
 		return false
 	}
 
-	conn := t.v2ray.handleUDP(ctx, handler, destination, time.Second*30)
+	conn := handleUDP(ctx, handler, destination, t.pingTimeout)
 
 	element := v2rayNet.AddConnection(conn)
 	defer v2rayNet.RemoveConnection(element)
@@ -560,7 +1033,50 @@ func (t *Tun2ray) NewPingPacket(source v2rayNet.Destination, destination v2rayNe
 		// close
 		comm.CloseIgnore(closer)
 		t.udpTable.Delete(natKey)
+		v2ray.release()
 	}()
 
 	return true
 }
+
+func pingContext(v2ray *v2rayCore, source v2rayNet.Destination, destination v2rayNet.Destination) context.Context {
+	ctx := core.WithContext(context.Background(), v2ray.core)
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{
+		Source:      source,
+		Tag:         "tun",
+		NetworkType: networkType,
+		WifiSSID:    wifiSSID,
+	})
+	ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: destination})
+	return session.ContextWithContent(ctx, &session.Content{Protocol: "ping"})
+}
+
+// pingOutbound picks the outbound for a ping request, or nil when it can not
+// be relayed.
+func pingOutbound(v2ray *v2rayCore, ctx context.Context, destination v2rayNet.Destination) outbound.Handler {
+	if route, err := v2ray.router.PickRoute(routing_session.AsRoutingContext(ctx)); err == nil {
+		tag := route.GetOutboundTag()
+		handler := v2ray.outboundManager.GetHandler(tag)
+		if handler != nil {
+			newError("taking detour [", tag, "] for [", destination.Address, "]").WriteToLog()
+		} else {
+			newError("non existing tag: ", tag).AtWarning().WriteToLog()
+		}
+		return handler
+	} else if handler := defaultOutboundForPing(v2ray); handler != nil {
+		newError("default route for ", destination.Address).AtWarning().WriteToLog()
+		return handler
+	}
+	return nil
+}
+
+// defaultOutboundForPing returns the default outbound if it can relay ICMP,
+// which is only the case for WireGuard.
+func defaultOutboundForPing(v2ray *v2rayCore) outbound.Handler {
+	if defaultOutbound, ok := v2ray.outboundManager.GetDefaultHandler().(*appOutbound.Handler); ok {
+		if _, isWireGuard := defaultOutbound.GetOutbound().(*wireguard.Client); isWireGuard {
+			return defaultOutbound
+		}
+	}
+	return nil
+}
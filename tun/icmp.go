@@ -0,0 +1,106 @@
+package tun
+
+import (
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Unreachable is the reason given in an ICMP destination unreachable.
+type Unreachable uint8
+
+const (
+	UnreachableNetwork Unreachable = iota
+	UnreachableHost
+	UnreachablePort
+	UnreachableProhibited
+)
+
+func (u Unreachable) ICMPv4Code() header.ICMPv4Code {
+	switch u {
+	case UnreachableNetwork:
+		return header.ICMPv4NetUnreachable
+	case UnreachableHost:
+		return header.ICMPv4HostUnreachable
+	case UnreachablePort:
+		return header.ICMPv4PortUnreachable
+	default:
+		return header.ICMPv4AdminProhibited
+	}
+}
+
+func (u Unreachable) ICMPv6Code() header.ICMPv6Code {
+	switch u {
+	case UnreachableNetwork:
+		return header.ICMPv6NetworkUnreachable
+	case UnreachableHost:
+		return header.ICMPv6AddressUnreachable
+	case UnreachablePort:
+		return header.ICMPv6PortUnreachable
+	default:
+		return header.ICMPv6Prohibited
+	}
+}
+
+// ICMPUnreachable builds a destination unreachable for the packet quoted by
+// origin, coming from its destination.
+func ICMPUnreachable(origin []byte, reason Unreachable) []byte {
+	if header.IPVersion(origin) == header.IPv4Version {
+		ipHdr := header.IPv4(origin)
+		source, _ := netip.AddrFromSlice([]byte(ipHdr.DestinationAddress()))
+		return ICMPError(source, origin, uint8(header.ICMPv4DstUnreachable), uint8(reason.ICMPv4Code()))
+	}
+	ipHdr := header.IPv6(origin)
+	source, _ := netip.AddrFromSlice([]byte(ipHdr.DestinationAddress()))
+	return ICMPError(source, origin, uint8(header.ICMPv6DstUnreachable), uint8(reason.ICMPv6Code()))
+}
+
+// ICMPError builds an ICMP or ICMPv6 error from source to the sender of the
+// packet quoted by origin, which holds its network header and the first 8
+// bytes of its transport header.
+func ICMPError(source netip.Addr, origin []byte, icmpType uint8, icmpCode uint8) []byte {
+	switch header.IPVersion(origin) {
+	case header.IPv4Version:
+		ipHdr := header.IPv4(origin)
+		packet := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumErrorPayloadSize+len(origin))
+		icmpHdr := header.ICMPv4(packet[header.IPv4MinimumSize:])
+		icmpHdr.SetType(header.ICMPv4Type(icmpType))
+		icmpHdr.SetCode(header.ICMPv4Code(icmpCode))
+		copy(icmpHdr[header.ICMPv4MinimumErrorPayloadSize:], origin)
+		icmpHdr.SetChecksum(header.ICMPv4Checksum(icmpHdr, 0))
+
+		backIpHdr := header.IPv4(packet)
+		backIpHdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         64,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     tcpip.Address(source.AsSlice()),
+			DstAddr:     ipHdr.SourceAddress(),
+		})
+		backIpHdr.SetChecksum(^backIpHdr.CalculateChecksum())
+		return packet
+	case header.IPv6Version:
+		ipHdr := header.IPv6(origin)
+		packet := make([]byte, header.IPv6MinimumSize+header.ICMPv6ErrorHeaderSize+len(origin))
+		icmpHdr := header.ICMPv6(packet[header.IPv6MinimumSize:])
+		icmpHdr.SetType(header.ICMPv6Type(icmpType))
+		icmpHdr.SetCode(header.ICMPv6Code(icmpCode))
+		copy(icmpHdr[header.ICMPv6ErrorHeaderSize:], origin)
+		icmpHdr.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: icmpHdr,
+			Src:    tcpip.Address(source.AsSlice()),
+			Dst:    ipHdr.SourceAddress(),
+		}))
+
+		header.IPv6(packet).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(icmpHdr)),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           tcpip.Address(source.AsSlice()),
+			DstAddr:           ipHdr.SourceAddress(),
+		})
+		return packet
+	}
+	return nil
+}
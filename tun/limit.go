@@ -0,0 +1,45 @@
+package tun
+
+import "sync/atomic"
+
+// PacketLimiter caps the UDP packets a stack is handing to the handler at
+// once, counting the ones that started a session until it ends. Packets over
+// the limit are dropped before a goroutine is started for them, so a flood
+// cannot pile them up. A nil limiter is unlimited.
+type PacketLimiter struct {
+	drops  int64
+	limit  int32
+	active int32
+}
+
+func NewPacketLimiter(limit int32) *PacketLimiter {
+	return &PacketLimiter{limit: limit}
+}
+
+// Acquire takes a slot for a packet, or counts it as dropped.
+func (l *PacketLimiter) Acquire() bool {
+	if l == nil {
+		return true
+	}
+	if atomic.AddInt32(&l.active, 1) > l.limit {
+		atomic.AddInt32(&l.active, -1)
+		atomic.AddInt64(&l.drops, 1)
+		return false
+	}
+	return true
+}
+
+// Release frees the slot of a packet once the handler returns.
+func (l *PacketLimiter) Release() {
+	if l != nil {
+		atomic.AddInt32(&l.active, -1)
+	}
+}
+
+// Drops returns the packets dropped for the limit.
+func (l *PacketLimiter) Drops() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.drops)
+}
@@ -0,0 +1,187 @@
+//go:build linux && !android
+
+package tun
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Open creates a TUN interface through /dev/net/tun, configures it over
+// netlink and returns its file descriptor.
+func Open(options Options) (int, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, newError("failed to open /dev/net/tun").Base(err)
+	}
+	name, err := setInterface(fd, options.Name)
+	if err == nil {
+		err = configureInterface(name, options)
+	}
+	if err == nil {
+		err = unix.SetNonblock(fd, true)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func setInterface(fd int, name string) (string, error) {
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return "", newError("invalid interface name ", name).Base(err)
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr)
+	if err != nil {
+		return "", newError("failed to create tun interface ", name).Base(err)
+	}
+	return ifr.Name(), nil
+}
+
+func configureInterface(name string, options Options) error {
+	iif, err := net.InterfaceByName(name)
+	if err != nil {
+		return newError("failed to find interface ", name).Base(err)
+	}
+	index := iif.Index
+
+	for _, address := range options.Addresses {
+		err = netlinkRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, addressMessage(index, address))
+		if err != nil {
+			return newError("failed to add address ", address, " to ", name).Base(err)
+		}
+	}
+
+	link := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  int32(index),
+		Flags:  unix.IFF_UP,
+		Change: unix.IFF_UP,
+	}
+	message := structBytes(unsafe.Pointer(&link), unix.SizeofIfInfomsg)
+	if options.MTU > 0 {
+		message = append(message, netlinkAttribute(unix.IFLA_MTU, uint32Bytes(options.MTU))...)
+	}
+	err = netlinkRequest(unix.RTM_NEWLINK, 0, message)
+	if err != nil {
+		return newError("failed to set ", name, " up").Base(err)
+	}
+
+	for _, route := range options.Routes {
+		err = netlinkRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, routeMessage(index, route))
+		if err != nil {
+			return newError("failed to add route ", route, " to ", name).Base(err)
+		}
+	}
+	return nil
+}
+
+func addressMessage(index int, prefix netip.Prefix) []byte {
+	address := unix.IfAddrmsg{
+		Prefixlen: uint8(prefix.Bits()),
+		Scope:     unix.RT_SCOPE_UNIVERSE,
+		Index:     uint32(index),
+	}
+	if prefix.Addr().Is4() {
+		address.Family = unix.AF_INET
+	} else {
+		address.Family = unix.AF_INET6
+		address.Flags = unix.IFA_F_NODAD
+	}
+	ip := prefix.Addr().AsSlice()
+	message := structBytes(unsafe.Pointer(&address), unix.SizeofIfAddrmsg)
+	message = append(message, netlinkAttribute(unix.IFA_LOCAL, ip)...)
+	message = append(message, netlinkAttribute(unix.IFA_ADDRESS, ip)...)
+	return message
+}
+
+func routeMessage(index int, prefix netip.Prefix) []byte {
+	prefix = prefix.Masked()
+	route := unix.RtMsg{
+		Dst_len:  uint8(prefix.Bits()),
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_BOOT,
+		Scope:    unix.RT_SCOPE_LINK,
+		Type:     unix.RTN_UNICAST,
+	}
+	if prefix.Addr().Is4() {
+		route.Family = unix.AF_INET
+	} else {
+		route.Family = unix.AF_INET6
+	}
+	message := structBytes(unsafe.Pointer(&route), unix.SizeofRtMsg)
+	if prefix.Bits() > 0 {
+		message = append(message, netlinkAttribute(unix.RTA_DST, prefix.Addr().AsSlice())...)
+	}
+	message = append(message, netlinkAttribute(unix.RTA_OIF, uint32Bytes(uint32(index)))...)
+	return message
+}
+
+func netlinkRequest(messageType uint16, flags uint16, message []byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	header := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(message)),
+		Type:  messageType,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | flags,
+		Seq:   1,
+	}
+	request := append(structBytes(unsafe.Pointer(&header), unix.SizeofNlMsghdr), message...)
+	err = unix.Sendto(fd, request, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+
+	response := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, response, 0)
+		if err != nil {
+			return err
+		}
+		messages, err := syscall.ParseNetlinkMessage(response[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			if m.Header.Type != unix.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+			errno := -*(*int32)(unsafe.Pointer(&m.Data[0]))
+			if errno == 0 {
+				return nil
+			}
+			return syscall.Errno(errno)
+		}
+	}
+}
+
+func netlinkAttribute(attributeType uint16, data []byte) []byte {
+	length := unix.SizeofRtAttr + len(data)
+	attribute := make([]byte, (length+unix.NLA_ALIGNTO-1) & ^(unix.NLA_ALIGNTO-1))
+	header := (*unix.RtAttr)(unsafe.Pointer(&attribute[0]))
+	header.Len = uint16(length)
+	header.Type = attributeType
+	copy(attribute[unix.SizeofRtAttr:], data)
+	return attribute
+}
+
+func structBytes(pointer unsafe.Pointer, size int) []byte {
+	data := make([]byte, size)
+	copy(data, unsafe.Slice((*byte)(pointer), size))
+	return data
+}
+
+func uint32Bytes(value uint32) []byte {
+	return structBytes(unsafe.Pointer(&value), 4)
+}
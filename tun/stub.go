@@ -0,0 +1,7 @@
+//go:build !linux || android
+
+package tun
+
+func Open(options Options) (int, error) {
+	return -1, newError("creating tun interface is not supported on this platform")
+}
@@ -2,11 +2,14 @@ package tun
 
 import (
 	"io"
+	"net/netip"
 
 	"github.com/v2fly/v2ray-core/v5/common/buf"
 	"github.com/v2fly/v2ray-core/v5/common/net"
 )
 
+//go:generate go run ../errorgen
+
 type Tun interface {
 	io.Closer
 }
@@ -16,3 +19,39 @@ type Handler interface {
 	NewPacket(source net.Destination, destination net.Destination, data *buf.Buffer, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer)
 	NewPingPacket(source net.Destination, destination net.Destination, message *buf.Buffer, writeBack func([]byte) error, closer io.Closer) bool
 }
+
+// Rejecter is implemented by the closer passed to NewPacket when the stack can
+// answer the packet with an ICMP destination unreachable.
+type Rejecter interface {
+	Reject(reason Unreachable) error
+}
+
+// ICMPErrorWriter is implemented by the closer passed to NewPingPacket. It
+// gives the TTL of the request and answers it with an ICMP error from a router
+// on the way, like a time exceeded for traceroute.
+type ICMPErrorWriter interface {
+	TTL() uint8
+	WriteICMPError(source netip.Addr, icmpType uint8, icmpCode uint8) error
+}
+
+// PacketCapture records the packets a stack exchanges with the device. Inbound
+// packets were read from it, the packet is split into views.
+type PacketCapture interface {
+	Capture(inbound bool, packet [][]byte)
+}
+
+// Event is something a stack tells the app about, with a code and severity
+// from comm.
+type Event struct {
+	Code     int32
+	Severity int32
+	Message  string
+	Fields   map[string]string
+}
+
+type Options struct {
+	Name      string
+	MTU       uint32
+	Addresses []netip.Prefix
+	Routes    []netip.Prefix
+}
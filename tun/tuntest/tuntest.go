@@ -0,0 +1,290 @@
+// Package tuntest provides a socketpair backed stand-in for a TUN device and
+// helpers to build and inspect the raw packets exchanged through it.
+package tuntest
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+var ErrTimeout = errors.New("timed out waiting for packet")
+
+// Device is a packet oriented socketpair. One end is handed to the stack as
+// its TUN file descriptor, the other one is used by the test as the kernel.
+type Device struct {
+	fd   int
+	peer int
+}
+
+func New() (*Device, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.SetNonblock(fds[0], true)
+	if err != nil {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+		return nil, err
+	}
+	return &Device{fds[0], fds[1]}, nil
+}
+
+func (d *Device) FileDescriptor() int32 {
+	return int32(d.fd)
+}
+
+// Detach hands the stack end over to a stack that closes it, Close then only
+// closes the kernel end.
+func (d *Device) Detach() int32 {
+	fd := d.fd
+	d.fd = -1
+	return int32(fd)
+}
+
+// Write injects a packet into the stack.
+func (d *Device) Write(packet []byte) error {
+	_, err := unix.Write(d.peer, packet)
+	return err
+}
+
+// Read returns the next packet written by the stack.
+func (d *Device) Read(timeout time.Duration) ([]byte, error) {
+	fds := []unix.PollFd{{Fd: int32(d.peer), Events: unix.POLLIN}}
+	for {
+		n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrTimeout
+		}
+		break
+	}
+	packet := make([]byte, 65535)
+	n, err := unix.Read(d.peer, packet)
+	if err != nil {
+		return nil, err
+	}
+	return packet[:n], nil
+}
+
+// Expect reads packets until one is accepted by match, skipping everything
+// else (e.g. neighbor discovery sent by the stack).
+func (d *Device) Expect(timeout time.Duration, match func(packet *Packet) bool) (*Packet, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, ErrTimeout
+		}
+		raw, err := d.Read(remaining)
+		if err != nil {
+			return nil, err
+		}
+		packet, err := Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if match(packet) {
+			return packet, nil
+		}
+	}
+}
+
+func (d *Device) Close() error {
+	err := unix.Close(d.peer)
+	if d.fd >= 0 {
+		err = unix.Close(d.fd)
+	}
+	return err
+}
+
+type Packet struct {
+	Protocol    tcpip.TransportProtocolNumber
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+
+	TCPFlags header.TCPFlags
+	Seq      uint32
+	Ack      uint32
+
+	ICMPType uint8
+	ICMPCode uint8
+	Ident    uint16
+	Sequence uint16
+
+	Payload []byte
+}
+
+// Parse decodes a packet and verifies its network and transport checksums.
+func Parse(raw []byte) (*Packet, error) {
+	var (
+		packet       Packet
+		source       tcpip.Address
+		destination  tcpip.Address
+		transport    []byte
+		pseudoHeader uint16
+	)
+	switch header.IPVersion(raw) {
+	case header.IPv4Version:
+		ipHdr := header.IPv4(raw)
+		if !ipHdr.IsValid(len(raw)) {
+			return nil, errors.New("invalid ipv4 packet")
+		}
+		if !ipHdr.IsChecksumValid() {
+			return nil, errors.New("bad ipv4 header checksum")
+		}
+		packet.Protocol = ipHdr.TransportProtocol()
+		source, destination = ipHdr.SourceAddress(), ipHdr.DestinationAddress()
+		transport = ipHdr.Payload()
+	case header.IPv6Version:
+		ipHdr := header.IPv6(raw)
+		if !ipHdr.IsValid(len(raw)) {
+			return nil, errors.New("invalid ipv6 packet")
+		}
+		packet.Protocol = ipHdr.TransportProtocol()
+		source, destination = ipHdr.SourceAddress(), ipHdr.DestinationAddress()
+		transport = ipHdr.Payload()
+	default:
+		return nil, errors.New("unknown ip version")
+	}
+	if packet.Protocol != header.ICMPv4ProtocolNumber {
+		pseudoHeader = header.PseudoHeaderChecksum(packet.Protocol, source, destination, uint16(len(transport)))
+	}
+	if packet.Protocol != header.UDPProtocolNumber && header.Checksum(transport, pseudoHeader) != 0xffff {
+		return nil, errors.New("bad transport checksum")
+	}
+
+	sourceAddr, _ := netip.AddrFromSlice([]byte(source))
+	destinationAddr, _ := netip.AddrFromSlice([]byte(destination))
+	switch packet.Protocol {
+	case header.TCPProtocolNumber:
+		tcpHdr := header.TCP(transport)
+		packet.Source = netip.AddrPortFrom(sourceAddr, tcpHdr.SourcePort())
+		packet.Destination = netip.AddrPortFrom(destinationAddr, tcpHdr.DestinationPort())
+		packet.TCPFlags = tcpHdr.Flags()
+		packet.Seq = tcpHdr.SequenceNumber()
+		packet.Ack = tcpHdr.AckNumber()
+		packet.Payload = tcpHdr.Payload()
+	case header.UDPProtocolNumber:
+		udpHdr := header.UDP(transport)
+		if udpHdr.Checksum() != 0 && header.Checksum(transport, pseudoHeader) != 0xffff {
+			return nil, errors.New("bad transport checksum")
+		}
+		packet.Source = netip.AddrPortFrom(sourceAddr, udpHdr.SourcePort())
+		packet.Destination = netip.AddrPortFrom(destinationAddr, udpHdr.DestinationPort())
+		packet.Payload = udpHdr.Payload()
+	case header.ICMPv4ProtocolNumber, header.ICMPv6ProtocolNumber:
+		// Echo messages of both versions share the 8 byte header layout.
+		if len(transport) < header.ICMPv4MinimumSize {
+			return nil, errors.New("short icmp packet")
+		}
+		icmpHdr := header.ICMPv4(transport)
+		packet.Source = netip.AddrPortFrom(sourceAddr, 0)
+		packet.Destination = netip.AddrPortFrom(destinationAddr, 0)
+		packet.ICMPType = transport[0]
+		packet.ICMPCode = transport[1]
+		packet.Ident = icmpHdr.Ident()
+		packet.Sequence = icmpHdr.Sequence()
+		packet.Payload = transport[header.ICMPv4MinimumSize:]
+	}
+	return &packet, nil
+}
+
+func UDPPacket(source, destination netip.AddrPort, payload []byte) []byte {
+	transport := make([]byte, header.UDPMinimumSize+len(payload))
+	udpHdr := header.UDP(transport)
+	udpHdr.Encode(&header.UDPFields{
+		SrcPort: source.Port(),
+		DstPort: destination.Port(),
+		Length:  uint16(len(transport)),
+	})
+	copy(udpHdr.Payload(), payload)
+	udpHdr.SetChecksum(^header.Checksum(transport, pseudoHeaderChecksum(header.UDPProtocolNumber, source.Addr(), destination.Addr(), len(transport))))
+	return ipPacket(header.UDPProtocolNumber, source.Addr(), destination.Addr(), transport)
+}
+
+func TCPPacket(source, destination netip.AddrPort, flags header.TCPFlags, seq, ack uint32, payload []byte) []byte {
+	transport := make([]byte, header.TCPMinimumSize+len(payload))
+	tcpHdr := header.TCP(transport)
+	tcpHdr.Encode(&header.TCPFields{
+		SrcPort:    source.Port(),
+		DstPort:    destination.Port(),
+		SeqNum:     seq,
+		AckNum:     ack,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	copy(tcpHdr.Payload(), payload)
+	tcpHdr.SetChecksum(^header.Checksum(transport, pseudoHeaderChecksum(header.TCPProtocolNumber, source.Addr(), destination.Addr(), len(transport))))
+	return ipPacket(header.TCPProtocolNumber, source.Addr(), destination.Addr(), transport)
+}
+
+func ICMPEchoPacket(source, destination netip.Addr, ident, sequence uint16, payload []byte) []byte {
+	transport := make([]byte, header.ICMPv4MinimumSize+len(payload))
+	icmpHdr := header.ICMPv4(transport)
+	icmpHdr.SetIdent(ident)
+	icmpHdr.SetSequence(sequence)
+	copy(transport[header.ICMPv4MinimumSize:], payload)
+	if source.Is4() {
+		icmpHdr.SetType(header.ICMPv4Echo)
+		icmpHdr.SetChecksum(^header.Checksum(transport, 0))
+		return ipPacket(header.ICMPv4ProtocolNumber, source, destination, transport)
+	}
+	header.ICMPv6(transport).SetType(header.ICMPv6EchoRequest)
+	icmpHdr.SetChecksum(^header.Checksum(transport, pseudoHeaderChecksum(header.ICMPv6ProtocolNumber, source, destination, len(transport))))
+	return ipPacket(header.ICMPv6ProtocolNumber, source, destination, transport)
+}
+
+// SetTTL changes the TTL or hop limit of a packet built by this package.
+func SetTTL(packet []byte, ttl uint8) {
+	if header.IPVersion(packet) == header.IPv4Version {
+		ipHdr := header.IPv4(packet)
+		ipHdr.SetTTL(ttl)
+		ipHdr.SetChecksum(0)
+		ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+		return
+	}
+	header.IPv6(packet).SetHopLimit(ttl)
+}
+
+func ipPacket(protocol tcpip.TransportProtocolNumber, source, destination netip.Addr, transport []byte) []byte {
+	if source.Is4() {
+		packet := make([]byte, header.IPv4MinimumSize+len(transport))
+		ipHdr := header.IPv4(packet)
+		ipHdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         64,
+			Protocol:    uint8(protocol),
+			SrcAddr:     tcpip.Address(source.AsSlice()),
+			DstAddr:     tcpip.Address(destination.AsSlice()),
+		})
+		ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+		copy(packet[header.IPv4MinimumSize:], transport)
+		return packet
+	}
+	packet := make([]byte, header.IPv6MinimumSize+len(transport))
+	header.IPv6(packet).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(transport)),
+		TransportProtocol: protocol,
+		HopLimit:          64,
+		SrcAddr:           tcpip.Address(source.AsSlice()),
+		DstAddr:           tcpip.Address(destination.AsSlice()),
+	})
+	copy(packet[header.IPv6MinimumSize:], transport)
+	return packet
+}
+
+func pseudoHeaderChecksum(protocol tcpip.TransportProtocolNumber, source, destination netip.Addr, length int) uint16 {
+	return header.PseudoHeaderChecksum(protocol, tcpip.Address(source.AsSlice()), tcpip.Address(destination.AsSlice()), uint16(length))
+}
@@ -0,0 +1,405 @@
+package libcore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun/tuntest"
+)
+
+const testTimeout = 5 * time.Second
+
+type testErrorHandler struct {
+	t *testing.T
+}
+
+func (h testErrorHandler) HandleError(err string) {
+	h.t.Log(err)
+}
+
+func startEchoServers(t *testing.T) uint16 {
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		udpConn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		udpConn.Close()
+		listener.Close()
+	})
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, addr, err := udpConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			udpConn.WriteTo(buffer[:n], addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return uint16(port)
+}
+
+// newTestTun2ray runs a stack over a fake device with a freedom outbound that
+// redirects TCP to the local echo servers, since the gVisor stack drops
+// loopback destinations.
+func newTestTun2ray(t *testing.T, implementation int32, options ...func(config *TunConfig)) (*Tun2ray, *tuntest.Device, uint16) {
+	port := startEchoServers(t)
+	instance := NewV2rayInstance()
+	err := instance.LoadConfig(fmt.Sprintf(`{
+  "log": {"loglevel": "none"},
+  "outbounds": [{"protocol": "freedom", "tag": "direct", "settings": {"redirect": "127.0.0.1:%d"}}]
+}`, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.Start(testErrorHandler{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := tuntest.New()
+	if err != nil {
+		instance.Close()
+		t.Fatal(err)
+	}
+	config := &TunConfig{
+		FileDescriptor: device.FileDescriptor(),
+		MTU:            1500,
+		V2Ray:          instance,
+		Gateway4:       "172.19.0.2",
+		Gateway6:       "fdfe:dcba:9876::2",
+		IPv6Mode:       comm.IPv6Enable,
+		Implementation: implementation,
+		ErrorHandler:   testErrorHandler{t},
+	}
+	for _, option := range options {
+		option(config)
+	}
+	tun, err := NewTun2ray(config)
+	if err != nil {
+		device.Close()
+		instance.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tun.Close()
+		device.Close()
+		instance.Close()
+	})
+	return tun, device, port
+}
+
+var testImplementations = []struct {
+	name           string
+	implementation int32
+}{
+	{"gvisor", comm.TunImplementationGVisor},
+	{"system", comm.TunImplementationSystem},
+}
+
+// Freedom ignores the redirect for UDP packets and the gVisor stack drops
+// loopback destinations, so UDP goes straight to loopback via the system stack.
+func TestTun2rayUDP(t *testing.T) {
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationSystem)
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	destination := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+
+	err := device.Write(tuntest.UDPPacket(source, destination, []byte("ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.UDPProtocolNumber
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Source != destination || reply.Destination != source || !bytes.Equal(reply.Payload, []byte("ping")) {
+		t.Fatalf("unexpected reply %s -> %s %q", reply.Source, reply.Destination, reply.Payload)
+	}
+
+	connections := tun.GetConnections()
+	if !connections.HasNext() {
+		t.Fatal("udp session missing from connection table")
+	}
+	connection := connections.Next()
+	if connection.Network != "udp" || connection.Source != source.String() || connection.Destination != destination.String() {
+		t.Fatalf("unexpected connection %s %s -> %s", connection.Network, connection.Source, connection.Destination)
+	}
+	if connection.Outbound != "direct" || connection.Uplink != 4 || connection.Downlink != 4 {
+		t.Fatalf("unexpected connection outbound %s uplink %d downlink %d", connection.Outbound, connection.Uplink, connection.Downlink)
+	}
+}
+
+func TestTun2rayTCP(t *testing.T) {
+	_, device, port := newTestTun2ray(t, comm.TunImplementationGVisor)
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	destination := netip.AddrPortFrom(netip.MustParseAddr("198.18.0.1"), port)
+	isTCP := func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.TCPProtocolNumber
+	}
+
+	err := device.Write(tuntest.TCPPacket(source, destination, header.TCPFlagSyn, 1000, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	synAck, err := device.Expect(testTimeout, isTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synAck.TCPFlags != header.TCPFlagSyn|header.TCPFlagAck {
+		t.Fatalf("unexpected syn-ack flags %s", synAck.TCPFlags)
+	}
+	err = device.Write(tuntest.TCPPacket(source, destination, header.TCPFlagAck|header.TCPFlagPsh, 1001, synAck.Seq+1, []byte("ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return isTCP(packet) && len(packet.Payload) > 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Source != destination || reply.Destination != source || !bytes.Equal(reply.Payload, []byte("ping")) {
+		t.Fatalf("unexpected reply %s -> %s %q", reply.Source, reply.Destination, reply.Payload)
+	}
+}
+
+func TestTun2rayPing(t *testing.T) {
+	for _, i := range testImplementations {
+		t.Run(i.name, func(t *testing.T) {
+			_, device, _ := newTestTun2ray(t, i.implementation)
+			source := netip.MustParseAddr("172.19.0.1")
+			destination := netip.MustParseAddr("198.18.0.1")
+
+			// Without a WireGuard outbound pings are answered by the stack.
+			err := device.Write(tuntest.ICMPEchoPacket(source, destination, 0x1234, 1, []byte("ping")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+				return packet.ICMPType == uint8(header.ICMPv4EchoReply)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Source.Addr() != destination || reply.Destination.Addr() != source || reply.Ident != 0x1234 {
+				t.Fatalf("unexpected echo reply %s -> %s ident %d", reply.Source, reply.Destination, reply.Ident)
+			}
+		})
+	}
+}
+
+func TestTun2rayReload(t *testing.T) {
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationSystem)
+	destination := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+	exchange := func(source netip.AddrPort, payload string) {
+		t.Helper()
+		err := device.Write(tuntest.UDPPacket(source, destination, []byte(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+			return packet.Protocol == header.UDPProtocolNumber && packet.Destination == source
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply.Payload, []byte(payload)) {
+			t.Fatalf("unexpected reply %q", reply.Payload)
+		}
+	}
+	outbounds := func() map[string]string {
+		outbounds := make(map[string]string)
+		for connections := tun.GetConnections(); connections.HasNext(); {
+			connection := connections.Next()
+			outbounds[connection.Source] = connection.Outbound
+		}
+		return outbounds
+	}
+
+	before := netip.MustParseAddrPort("172.19.0.1:40000")
+	exchange(before, "before")
+
+	err := tun.v2ray.Reload(`{
+  "log": {"loglevel": "none"},
+  "outbounds": [{"protocol": "freedom", "tag": "reloaded"}]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The running session keeps its core, new ones use the reloaded one.
+	exchange(before, "still before")
+	after := netip.MustParseAddrPort("172.19.0.1:40001")
+	exchange(after, "after")
+
+	current := outbounds()
+	if current[before.String()] != "direct" || current[after.String()] != "reloaded" {
+		t.Fatalf("unexpected outbounds %v", current)
+	}
+}
+
+// Connections still using a reloaded core are closed after the drain timeout.
+func TestTun2rayReloadDrain(t *testing.T) {
+	oldTimeout := v2rayDrainTimeout
+	v2rayDrainTimeout = 100 * time.Millisecond
+	t.Cleanup(func() {
+		v2rayDrainTimeout = oldTimeout
+	})
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationGVisor)
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	destination := netip.AddrPortFrom(netip.MustParseAddr("198.18.0.1"), port)
+	isTCP := func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.TCPProtocolNumber
+	}
+
+	err := device.Write(tuntest.TCPPacket(source, destination, header.TCPFlagSyn, 1000, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	synAck, err := device.Expect(testTimeout, isTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = device.Write(tuntest.TCPPacket(source, destination, header.TCPFlagAck|header.TCPFlagPsh, 1001, synAck.Seq+1, []byte("ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return isTCP(packet) && len(packet.Payload) > 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tun.v2ray.Reload(`{
+  "log": {"loglevel": "none"},
+  "outbounds": [{"protocol": "freedom", "tag": "reloaded"}]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return isTCP(packet) && packet.TCPFlags&(header.TCPFlagFin|header.TCPFlagRst) != 0
+	})
+	if err != nil {
+		t.Fatal("connection not closed after the drain timeout: ", err)
+	}
+}
+
+// A reload that fails to start restarts the inbounds of the running core.
+func TestV2rayReloadRollback(t *testing.T) {
+	busy, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	config := func(ports ...int) string {
+		inbounds := make([]string, len(ports))
+		for i, port := range ports {
+			inbounds[i] = fmt.Sprintf(`{"protocol": "dokodemo-door", "listen": "127.0.0.1", "port": %d, "settings": {"address": "127.0.0.1", "port": 1, "network": "tcp"}}`, port)
+		}
+		return fmt.Sprintf(`{
+  "log": {"loglevel": "none"},
+  "inbounds": [%s],
+  "outbounds": [{"protocol": "freedom"}]
+}`, strings.Join(inbounds, ", "))
+	}
+
+	instance := NewV2rayInstance()
+	err = instance.LoadConfig(config(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.Start(testErrorHandler{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+	current := instance.load()
+
+	err = instance.Reload(config(port, busy.Addr().(*net.TCPAddr).Port))
+	if err == nil {
+		t.Fatal("reload with a busy port succeeded")
+	}
+	if instance.load() != current {
+		t.Fatal("failed reload replaced the running core")
+	}
+	conn, err := net.DialTimeout("tcp4", fmt.Sprint("127.0.0.1:", port), testTimeout)
+	if err != nil {
+		t.Fatal("inbound not restarted: ", err)
+	}
+	conn.Close()
+}
+
+// A packet arriving while the core is stopped must not keep its session
+// locked, or the source is stuck once the core is started again.
+func TestTun2rayStoppedCore(t *testing.T) {
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationSystem)
+	source := netip.MustParseAddrPort("172.19.0.1:40000")
+	destination := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+
+	err := tun.v2ray.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = device.Write(tuntest.UDPPacket(source, destination, []byte("dropped")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	err = tun.v2ray.LoadConfig(`{"log": {"loglevel": "none"}, "outbounds": [{"protocol": "freedom"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tun.v2ray.Start(testErrorHandler{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = device.Write(tuntest.UDPPacket(source, destination, []byte("ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+		return packet.Protocol == header.UDPProtocolNumber
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply.Payload, []byte("ping")) {
+		t.Fatalf("unexpected reply %q", reply.Payload)
+	}
+}
@@ -0,0 +1,79 @@
+package libcore
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+	"libcore/comm"
+)
+
+// newNATPacketConn filters the replies of a UDP session by the peers the
+// application sent to, as the filtering behavior of RFC 4787. The mapping
+// behavior comes from the key of the session in the UDP table. Endpoint
+// independent sessions are not filtered, so they stay full cone as long as
+// the outbound reports where replies come from.
+func newNATPacketConn(conn packetConn, mode int32) packetConn {
+	if mode == comm.UDPNATEndpointIndependent {
+		return conn
+	}
+	return &natPacketConn{
+		packetConn: conn,
+		mode:       mode,
+		peers:      make(map[netip.AddrPort]struct{}),
+	}
+}
+
+type natPacketConn struct {
+	packetConn
+	mode int32
+
+	access sync.RWMutex
+	peers  map[netip.AddrPort]struct{}
+	// Set once a domain is sent to, whose replies come from addresses the
+	// application never saw.
+	unfiltered bool
+}
+
+func (c *natPacketConn) peer(addr netip.AddrPort) netip.AddrPort {
+	if c.mode == comm.UDPNATAddressDependent {
+		return netip.AddrPortFrom(addr.Addr().Unmap(), 0)
+	}
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+func (c *natPacketConn) writeTo(buffer *buf.Buffer, addr net.Addr) error {
+	c.access.Lock()
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		c.peers[c.peer(udpAddr.AddrPort())] = struct{}{}
+	} else {
+		c.unfiltered = true
+	}
+	c.access.Unlock()
+	return c.packetConn.writeTo(buffer, addr)
+}
+
+func (c *natPacketConn) readFrom() (buffer *buf.Buffer, addr net.Addr, err error) {
+	for {
+		buffer, addr, err = c.packetConn.readFrom()
+		if err != nil || c.allowed(addr) {
+			return
+		}
+		buffer.Release()
+	}
+}
+
+func (c *natPacketConn) allowed(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || udpAddr.IP.IsUnspecified() {
+		return true
+	}
+	c.access.RLock()
+	defer c.access.RUnlock()
+	if c.unfiltered {
+		return true
+	}
+	_, ok = c.peers[c.peer(udpAddr.AddrPort())]
+	return ok
+}
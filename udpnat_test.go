@@ -0,0 +1,121 @@
+package libcore
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/stun"
+	"libcore/stun/stuntest"
+	"libcore/tun/tuntest"
+)
+
+// tunPacketConn is a UDP socket of an application behind the tun.
+type tunPacketConn struct {
+	device *tuntest.Device
+	source netip.AddrPort
+
+	reading sync.Mutex
+	closed  chan struct{}
+}
+
+func (c *tunPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.reading.Lock()
+		select {
+		case <-c.closed:
+			c.reading.Unlock()
+			return 0, nil, net.ErrClosed
+		default:
+		}
+		packet, err := c.device.Expect(50*time.Millisecond, func(packet *tuntest.Packet) bool {
+			return packet.Protocol == header.UDPProtocolNumber && packet.Destination == c.source
+		})
+		c.reading.Unlock()
+		if err == tuntest.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return copy(p, packet.Payload), net.UDPAddrFromAddrPort(packet.Source), nil
+	}
+}
+
+func (c *tunPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	destination := addr.(*net.UDPAddr).AddrPort()
+	destination = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+	return len(p), c.device.Write(tuntest.UDPPacket(c.source, destination, p))
+}
+
+// Close waits for a pending read, so it does not take the packets of the next
+// connection.
+func (c *tunPacketConn) Close() error {
+	close(c.closed)
+	c.reading.Lock()
+	c.reading.Unlock()
+	return nil
+}
+
+func (c *tunPacketConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.source)
+}
+
+func (c *tunPacketConn) SetDeadline(time.Time) error      { return os.ErrInvalid }
+func (c *tunPacketConn) SetReadDeadline(time.Time) error  { return os.ErrInvalid }
+func (c *tunPacketConn) SetWriteDeadline(time.Time) error { return os.ErrInvalid }
+
+// The gVisor stack drops loopback destinations, so the STUN server is reached
+// via the system stack.
+func TestTun2rayUDPNAT(t *testing.T) {
+	server, err := stuntest.New(netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+	})
+	for _, c := range []struct {
+		name      string
+		mode      int32
+		mapping   int
+		filtering int
+	}{
+		{"endpoint independent", comm.UDPNATEndpointIndependent, stun.EndpointIndependent, stun.EndpointIndependent},
+		{"address dependent", comm.UDPNATAddressDependent, stun.EndpointIndependent, stun.AddressDependent},
+		{"symmetric", comm.UDPNATSymmetric, stun.AddressAndPortDependent, stun.AddressAndPortDependent},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, device, _ := newTestTun2ray(t, comm.TunImplementationSystem, func(config *TunConfig) {
+				config.UDPNATMode = c.mode
+			})
+			port := uint16(40000)
+			mapping, filtering, err := stun.TestConn(server.Addr().String(), func() (net.PacketConn, error) {
+				port++
+				return &tunPacketConn{
+					device: device,
+					source: netip.AddrPortFrom(netip.MustParseAddr("172.19.0.1"), port),
+					closed: make(chan struct{}),
+				}, nil
+			}, 500*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mapping != c.mapping || filtering != c.filtering {
+				t.Fatalf("expected mapping %d filtering %d, got %d %d", c.mapping, c.filtering, mapping, filtering)
+			}
+		})
+	}
+}
+
+func TestTun2rayUDPNATMode(t *testing.T) {
+	_, err := NewTun2ray(&TunConfig{UDPNATMode: comm.UDPNATSymmetric + 1})
+	if err == nil {
+		t.Fatal("expected error for unknown udp nat mode")
+	}
+}
@@ -0,0 +1,134 @@
+package libcore
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"libcore/tun"
+)
+
+const (
+	defaultUDPTimeout  = 5 * time.Minute
+	defaultDNSTimeout  = 10 * time.Second
+	defaultQUICTimeout = time.Minute
+	defaultPingTimeout = 30 * time.Second
+)
+
+// udpPendingPackets is how many packets may wait for the handler on top of
+// the session limit, as the packets starting sessions keep their slot.
+const udpPendingPackets = 256
+
+func timeoutOrDefault(seconds int32, defaultTimeout time.Duration) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultTimeout
+}
+
+// udpTimeout returns the idle timeout of a UDP session. DNS is done after one
+// reply and QUIC keeps itself alive, so both get shorter ones.
+func (t *Tun2ray) udpTimeout(isDns bool, protocol string, destination v2rayNet.Destination) time.Duration {
+	switch {
+	case isDns || protocol == "dns":
+		return t.dnsTimeout
+	case protocol == "quic" || protocol == "" && destination.Port == 443:
+		return t.quicTimeout
+	default:
+		return t.udpIdleTimeout
+	}
+}
+
+// udpSessions keeps the UDP sessions in use order, so the least recently used
+// one is closed when a new one exceeds the limit. A limit of 0 is unlimited.
+// With a limit the stacks drop packets beyond it and udpPendingPackets.
+type udpSessions struct {
+	evictions int64
+	access    sync.Mutex
+	limit     int
+	order     *list.List
+	elements  map[string]*list.Element
+	packets   *tun.PacketLimiter
+}
+
+type udpSession struct {
+	key    string
+	closer io.Closer
+}
+
+func newUDPSessions(limit int32) *udpSessions {
+	s := &udpSessions{
+		limit:    int(limit),
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+	if limit > 0 {
+		s.packets = tun.NewPacketLimiter(limit + udpPendingPackets)
+	}
+	return s
+}
+
+func (s *udpSessions) add(key string, closer io.Closer) {
+	var evicted []*udpSession
+	s.access.Lock()
+	if element, ok := s.elements[key]; ok {
+		s.order.Remove(element)
+	}
+	s.elements[key] = s.order.PushFront(&udpSession{key, closer})
+	for s.limit > 0 && s.order.Len() > s.limit {
+		session := s.order.Remove(s.order.Back()).(*udpSession)
+		delete(s.elements, session.key)
+		evicted = append(evicted, session)
+	}
+	s.access.Unlock()
+	for _, session := range evicted {
+		atomic.AddInt64(&s.evictions, 1)
+		newError("[UDP] session limit reached, closing ", session.key).AtInfo().WriteToLog()
+		_ = session.closer.Close()
+	}
+}
+
+func (s *udpSessions) touch(key string) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if element, ok := s.elements[key]; ok {
+		s.order.MoveToFront(element)
+	}
+}
+
+// remove drops the session unless it was replaced by a new one with the same
+// key.
+func (s *udpSessions) remove(key string, closer io.Closer) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if element, ok := s.elements[key]; ok && element.Value.(*udpSession).closer == closer {
+		s.order.Remove(element)
+		delete(s.elements, key)
+	}
+}
+
+func (s *udpSessions) len() int {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.order.Len()
+}
+
+// UDPSessionCount returns the number of open UDP sessions.
+func (t *Tun2ray) UDPSessionCount() int32 {
+	return int32(t.udpSessions.len())
+}
+
+// UDPEvictions returns how many UDP sessions were closed for the session
+// limit.
+func (t *Tun2ray) UDPEvictions() int64 {
+	return atomic.LoadInt64(&t.udpSessions.evictions)
+}
+
+// UDPDrops returns how many UDP packets the stack dropped for the session
+// limit.
+func (t *Tun2ray) UDPDrops() int64 {
+	return t.udpSessions.packets.Drops()
+}
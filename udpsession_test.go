@@ -0,0 +1,102 @@
+package libcore
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"libcore/comm"
+	"libcore/tun/tuntest"
+)
+
+type testSessionCloser struct {
+	closed bool
+}
+
+func (c *testSessionCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestUDPSessionsEviction(t *testing.T) {
+	sessions := newUDPSessions(2)
+	first, second, third := &testSessionCloser{}, &testSessionCloser{}, &testSessionCloser{}
+	sessions.add("first", first)
+	sessions.add("second", second)
+	sessions.touch("first")
+	sessions.add("third", third)
+	if !second.closed || first.closed || third.closed {
+		t.Fatal("expected the least recently used session to be evicted")
+	}
+	if sessions.len() != 2 || sessions.evictions != 1 {
+		t.Fatalf("unexpected %d sessions and %d evictions", sessions.len(), sessions.evictions)
+	}
+
+	// A replaced session must not remove its successor.
+	replacement := &testSessionCloser{}
+	sessions.add("first", replacement)
+	sessions.remove("first", first)
+	if _, ok := sessions.elements["first"]; !ok {
+		t.Fatal("removed the replacement session")
+	}
+}
+
+func TestUDPTimeout(t *testing.T) {
+	tun := &Tun2ray{
+		udpIdleTimeout: timeoutOrDefault(0, defaultUDPTimeout),
+		dnsTimeout:     timeoutOrDefault(5, defaultDNSTimeout),
+		quicTimeout:    timeoutOrDefault(0, defaultQUICTimeout),
+	}
+	destination := v2rayNet.UDPDestination(v2rayNet.ParseAddress("1.1.1.1"), 443)
+	for _, test := range []struct {
+		isDns    bool
+		protocol string
+		port     v2rayNet.Port
+		timeout  time.Duration
+	}{
+		{true, "", 53, 5 * time.Second},
+		{false, "quic", 8443, defaultQUICTimeout},
+		{false, "", 443, defaultQUICTimeout},
+		{false, "stun", 443, defaultUDPTimeout},
+		{false, "", 8080, defaultUDPTimeout},
+	} {
+		destination.Port = test.port
+		if timeout := tun.udpTimeout(test.isDns, test.protocol, destination); timeout != test.timeout {
+			t.Fatalf("%s:%d expected %s, got %s", test.protocol, test.port, test.timeout, timeout)
+		}
+	}
+}
+
+func TestTun2rayUDPSessionLimit(t *testing.T) {
+	tun, device, port := newTestTun2ray(t, comm.TunImplementationSystem, func(config *TunConfig) {
+		config.MaxUDPSessions = 1
+		config.UDPTimeout = 1
+	})
+	destination := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+	for _, source := range []netip.AddrPort{netip.MustParseAddrPort("172.19.0.1:40000"), netip.MustParseAddrPort("172.19.0.1:40001")} {
+		err := device.Write(tuntest.UDPPacket(source, destination, []byte("ping")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = device.Expect(testTimeout, func(packet *tuntest.Packet) bool {
+			return packet.Protocol == header.UDPProtocolNumber && packet.Destination == source
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if evictions := tun.UDPEvictions(); evictions != 1 {
+		t.Fatalf("expected 1 eviction, got %d", evictions)
+	}
+
+	// The remaining session is closed once idle.
+	deadline := time.Now().Add(testTimeout)
+	for tun.UDPSessionCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions left after idle timeout", tun.UDPSessionCount())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
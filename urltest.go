@@ -2,10 +2,13 @@ package libcore
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"math/rand"
 	gonet "net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"time"
 
@@ -14,11 +17,38 @@ import (
 	"github.com/v2fly/v2ray-core/v5/common/session"
 )
 
+type UrlTestResult struct {
+	// All durations are in milliseconds.
+	Total int32
+	// DNS is the lookup of the test domain through the proxy, zero for IP links.
+	DNS int32
+	// Connect is the time taken to open the stream through the proxy. Most
+	// outbounds connect lazily, so the remote connect is usually part of
+	// TLSHandshake or FirstByte instead.
+	Connect      int32
+	TLSHandshake int32
+	// FirstByte is the time from the request being written to the first
+	// response byte.
+	FirstByte int32
+	// Steady is the round trip of a second request on the kept-alive
+	// connection, set only when requested.
+	Steady int32
+}
+
 func UrlTest(instance *V2RayInstance, inbound string, link string, timeout int32) (int32, error) {
-	connTestUrl, err := url.Parse(link)
+	result, err := UrlTestDetailed(instance, inbound, link, timeout, false)
 	if err != nil {
 		return 0, err
 	}
+	return result.Total, nil
+}
+
+func UrlTestDetailed(instance *V2RayInstance, inbound string, link string, timeout int32, steady bool) (*UrlTestResult, error) {
+	connTestUrl, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	result := new(UrlTestResult)
 	address := net.ParseAddress(connTestUrl.Hostname())
 	if address.Family().IsDomain() {
 		resolver := &net.Resolver{
@@ -39,15 +69,17 @@ func UrlTest(instance *V2RayInstance, inbound string, link string, timeout int32
 			},
 		}
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		start := time.Now()
 		_, err = resolver.LookupIP(ctx, "ip", address.Domain())
 		cancel()
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
+		result.DNS = int32(time.Since(start).Milliseconds())
 	}
 	transport := &http.Transport{
 		TLSHandshakeTimeout: time.Duration(timeout) * time.Millisecond,
-		DisableKeepAlives:   true,
+		DisableKeepAlives:   !steady,
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			dest, err := net.ParseDestination(fmt.Sprintf("%s:%s", network, addr))
 			if err != nil {
@@ -62,21 +94,73 @@ func UrlTest(instance *V2RayInstance, inbound string, link string, timeout int32
 			return inConn, nil
 		},
 	}
-	req, err := http.NewRequestWithContext(context.Background(), "GET", link, nil)
-	req.Header.Set("User-Agent", fmt.Sprintf("curl/7.%d.%d", rand.Int()%54, rand.Int()%2))
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(timeout) * time.Millisecond,
+	}
+
+	var getConn, gotConn, tlsStart, tlsDone, wroteRequest, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		GetConn:              func(string) { getConn = time.Now() },
+		GotConn:              func(httptrace.GotConnInfo) { gotConn = time.Now() },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wroteRequest = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	total, err := urlTestRequest(client, link, trace)
+	if err != nil {
+		return nil, err
+	}
+	result.Total = int32(total.Milliseconds())
+	// With a custom dialer the connection is returned before the TLS
+	// handshake, so GotConn comes after it.
+	if !tlsStart.IsZero() {
+		result.Connect = int32(tlsStart.Sub(getConn).Milliseconds())
+		result.TLSHandshake = int32(tlsDone.Sub(tlsStart).Milliseconds())
+	} else {
+		result.Connect = int32(gotConn.Sub(getConn).Milliseconds())
+	}
+	result.FirstByte = int32(firstByte.Sub(wroteRequest).Milliseconds())
+
+	if steady {
+		var reused bool
+		steady, err := urlTestRequest(client, link, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !reused {
+			return nil, newError("connection not kept alive")
+		}
+		result.Steady = int32(steady.Milliseconds())
+	}
+	return result, nil
+}
+
+// urlTestBodyLimit is how much of the response body is drained so the
+// connection can be reused.
+const urlTestBodyLimit = 64 * 1024
+
+// urlTestRequest returns the time taken until the response headers arrive.
+func urlTestRequest(client *http.Client, link string, trace *httptrace.ClientTrace) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", link, nil)
 	if err != nil {
 		return 0, err
 	}
+	req.Header.Set("User-Agent", fmt.Sprintf("curl/7.%d.%d", rand.Int()%54, rand.Int()%2))
 	start := time.Now()
-	resp, err := (&http.Client{
-		Transport: transport,
-		Timeout:   time.Duration(timeout) * time.Millisecond,
-	}).Do(req)
-	if err == nil && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("unexcpted response status: %d", resp.StatusCode)
-	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return 0, err
 	}
-	return int32(time.Since(start).Milliseconds()), nil
+	elapsed := time.Since(start)
+	io.CopyN(io.Discard, resp.Body, urlTestBodyLimit)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected response status: %d", resp.StatusCode)
+	}
+	return elapsed, nil
 }
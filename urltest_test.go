@@ -0,0 +1,67 @@
+package libcore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUrlTestDetailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/body":
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("body"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	instance := NewV2rayInstance()
+	err := instance.LoadConfig(`{
+  "log": {"loglevel": "none"},
+  "outbounds": [{"protocol": "freedom", "tag": "direct"}]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.Start(testErrorHandler{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	result, err := UrlTestDetailed(instance, "", server.URL+"/slow", 2000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FirstByte < 100 || result.Total < result.FirstByte || result.Steady < 100 {
+		t.Fatalf("unexpected result %+v", *result)
+	}
+	if result.DNS != 0 || result.TLSHandshake != 0 {
+		t.Fatalf("unexpected dns or tls time in %+v", *result)
+	}
+
+	latency, err := UrlTest(instance, "", server.URL, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency >= 100 {
+		t.Fatalf("unexpected latency %d", latency)
+	}
+
+	// The body is drained after the latency is taken.
+	latency, err = UrlTest(instance, "", server.URL+"/body", 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency >= 100 {
+		t.Fatalf("latency %d includes the body", latency)
+	}
+}
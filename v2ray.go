@@ -1,6 +1,7 @@
 package libcore
 
 import (
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"time"
 
 	"github.com/v2fly/v2ray-core/v5"
+	appDns "github.com/v2fly/v2ray-core/v5/app/dns"
+	"github.com/v2fly/v2ray-core/v5/app/router"
 	"github.com/v2fly/v2ray-core/v5/common"
 	"github.com/v2fly/v2ray-core/v5/common/buf"
 	"github.com/v2fly/v2ray-core/v5/common/net"
@@ -20,6 +23,7 @@ import (
 	"github.com/v2fly/v2ray-core/v5/features"
 	"github.com/v2fly/v2ray-core/v5/features/dns"
 	"github.com/v2fly/v2ray-core/v5/features/extension"
+	"github.com/v2fly/v2ray-core/v5/features/inbound"
 	"github.com/v2fly/v2ray-core/v5/features/outbound"
 	"github.com/v2fly/v2ray-core/v5/features/routing"
 	"github.com/v2fly/v2ray-core/v5/features/stats"
@@ -29,6 +33,7 @@ import (
 	vmessOutbound "github.com/v2fly/v2ray-core/v5/proxy/vmess/outbound"
 	"github.com/v2fly/v2ray-core/v5/transport"
 	"github.com/v2fly/v2ray-core/v5/transport/pipe"
+	"libcore/comm"
 )
 
 func GetV2RayVersion() string {
@@ -36,7 +41,15 @@ func GetV2RayVersion() string {
 }
 
 type V2RayInstance struct {
-	started         bool
+	access       sync.RWMutex
+	started      bool
+	current      *v2rayCore
+	errorHandler ErrorHandler
+}
+
+// v2rayCore is a loaded core with the features used by the tun. Reload swaps
+// it as a whole, connections keep using the one they started with.
+type v2rayCore struct {
 	core            *core.Instance
 	dispatcher      routing.Dispatcher
 	router          routing.Router
@@ -44,13 +57,37 @@ type V2RayInstance struct {
 	statsManager    stats.Manager
 	observatory     features.TaggedFeatures
 	dnsClient       dns.NewClient
+
+	routerConfig *router.Config
+	routeTracer  routeTracer
+	// localDNS is set when the DNS client only asks the localhost server.
+	localDNS    bool
+	connections sync.WaitGroup
+	// closers are closed when the core is closed before they are finished.
+	closersAccess sync.Mutex
+	closers       list.List
 }
 
+// v2rayDrainTimeout is how long a reloaded core waits for its connections
+// before closing them.
+var v2rayDrainTimeout = time.Minute
+
 func NewV2rayInstance() *V2RayInstance {
 	return &V2RayInstance{}
 }
 
 func (instance *V2RayInstance) LoadConfig(content string) error {
+	c, err := newV2rayCore(content)
+	if err != nil {
+		return err
+	}
+	instance.access.Lock()
+	instance.current = c
+	instance.access.Unlock()
+	return nil
+}
+
+func newV2rayCore(content string) (*v2rayCore, error) {
 	config, err := serial.LoadJSONConfig(strings.NewReader(content))
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "geoip.dat: no such file or directory") {
@@ -67,7 +104,7 @@ func (instance *V2RayInstance) LoadConfig(content string) error {
 		}
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if config.Outbound != nil {
 		for _, outbound := range config.Outbound {
@@ -111,45 +148,170 @@ func (instance *V2RayInstance) LoadConfig(content string) error {
 
 	c, err := core.New(config)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	v2ray := &v2rayCore{
+		core:            c,
+		statsManager:    c.GetFeature(stats.ManagerType()).(stats.Manager),
+		router:          c.GetFeature(routing.RouterType()).(routing.Router),
+		outboundManager: c.GetFeature(outbound.ManagerType()).(outbound.Manager),
+		dispatcher:      c.GetFeature(routing.DispatcherType()).(routing.Dispatcher),
+		dnsClient:       c.GetFeature(dns.ClientType()).(dns.NewClient),
 	}
-	instance.core = c
-	instance.statsManager = c.GetFeature(stats.ManagerType()).(stats.Manager)
-	instance.router = c.GetFeature(routing.RouterType()).(routing.Router)
-	instance.outboundManager = c.GetFeature(outbound.ManagerType()).(outbound.Manager)
-	instance.dispatcher = c.GetFeature(routing.DispatcherType()).(routing.Dispatcher)
-	instance.dnsClient = c.GetFeature(dns.ClientType()).(dns.NewClient)
 
 	o := c.GetFeature(extension.ObservatoryType())
 	if o != nil {
-		instance.observatory = o.(features.TaggedFeatures)
+		v2ray.observatory = o.(features.TaggedFeatures)
 	}
-	return nil
+	v2ray.localDNS = true
+	for _, app := range config.App {
+		if appConfig, err := commonSerial.GetInstanceOf(app); err == nil {
+			switch appConfig := appConfig.(type) {
+			case *router.Config:
+				v2ray.routerConfig = appConfig
+			case *appDns.Config:
+				for _, server := range appConfig.NameServer {
+					if server.Address == nil || server.Address.AsDestination().Address.String() != "localhost" {
+						v2ray.localDNS = false
+					}
+				}
+			}
+		}
+	}
+	return v2ray, nil
 }
 
 func (instance *V2RayInstance) Start(errorHandler ErrorHandler) error {
+	instance.access.Lock()
+	defer instance.access.Unlock()
 	if instance.started {
 		return errors.New("already started")
 	}
-	if instance.core == nil {
+	if instance.current == nil {
 		return errors.New("not initialized")
 	}
-	instance.core.SetErrorHandler(func(err error) {
-		errorHandler.HandleError(err.Error())
-	})
-	err := instance.core.Start()
+	instance.current.setErrorHandler(errorHandler)
+	err := instance.current.core.Start()
 	if err != nil {
 		return err
 	}
+	instance.errorHandler = errorHandler
 	instance.started = true
 	return nil
 }
 
+func (v2ray *v2rayCore) setErrorHandler(errorHandler ErrorHandler) {
+	v2ray.core.SetErrorHandler(func(err error) {
+		emitEvent(newEvent(comm.EventError, comm.EventSeverityError, err.Error(), map[string]string{
+			"error": err.Error(),
+		}))
+		if errorHandler != nil {
+			errorHandler.HandleError(err.Error())
+		}
+	})
+}
+
+// Reload starts a core from content and swaps it in. The previous core is
+// closed once the connections still using it are finished, or after
+// v2rayDrainTimeout.
+func (instance *V2RayInstance) Reload(content string) error {
+	c, err := newV2rayCore(content)
+	if err != nil {
+		return err
+	}
+
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if !instance.started {
+		return errors.New("not started")
+	}
+	old := instance.current
+
+	// Inbounds of the new core may listen on the same ports.
+	oldInbounds := old.core.GetFeature(inbound.ManagerType()).(inbound.Manager)
+	common.Close(oldInbounds)
+
+	c.setErrorHandler(instance.errorHandler)
+	err = c.core.Start()
+	if err != nil {
+		c.core.Close()
+		if err := oldInbounds.Start(); err != nil {
+			newError("failed to restart inbounds").Base(err).AtWarning().WriteToLog()
+		}
+		return newError("failed to start new core").Base(err)
+	}
+	instance.current = c
+
+	go old.drain()
+	return nil
+}
+
+// drain closes the core once its connections are finished, closing the ones
+// left after v2rayDrainTimeout.
+func (v2ray *v2rayCore) drain() {
+	done := make(chan struct{})
+	go func() {
+		v2ray.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(v2rayDrainTimeout):
+		v2ray.closersAccess.Lock()
+		for element := v2ray.closers.Front(); element != nil; element = element.Next() {
+			comm.CloseIgnore(element.Value.(io.Closer))
+		}
+		v2ray.closersAccess.Unlock()
+	}
+	if err := v2ray.core.Close(); err != nil {
+		newError("failed to close previous core").Base(err).AtWarning().WriteToLog()
+	}
+}
+
+// load returns the running core, or nil if the instance is not started.
+func (instance *V2RayInstance) load() *v2rayCore {
+	instance.access.RLock()
+	defer instance.access.RUnlock()
+	if !instance.started {
+		return nil
+	}
+	return instance.current
+}
+
+// acquire is like load but keeps the core open until release.
+func (instance *V2RayInstance) acquire() *v2rayCore {
+	instance.access.RLock()
+	defer instance.access.RUnlock()
+	if !instance.started {
+		return nil
+	}
+	instance.current.connections.Add(1)
+	return instance.current
+}
+
+func (v2ray *v2rayCore) release() {
+	v2ray.connections.Done()
+}
+
+// track registers closer to be closed if the core is drained before the
+// returned function is called.
+func (v2ray *v2rayCore) track(closer io.Closer) func() {
+	v2ray.closersAccess.Lock()
+	element := v2ray.closers.PushBack(closer)
+	v2ray.closersAccess.Unlock()
+	return func() {
+		v2ray.closersAccess.Lock()
+		v2ray.closers.Remove(element)
+		v2ray.closersAccess.Unlock()
+	}
+}
+
 func (instance *V2RayInstance) QueryStats(tag string, direct string) int64 {
-	if instance.statsManager == nil {
+	v2ray := instance.load()
+	if v2ray == nil || v2ray.statsManager == nil {
 		return 0
 	}
-	counter := instance.statsManager.GetCounter(fmt.Sprintf("outbound>>>%s>>>traffic>>>%s", tag, direct))
+	counter := v2ray.statsManager.GetCounter(fmt.Sprintf("outbound>>>%s>>>traffic>>>%s", tag, direct))
 	if counter == nil {
 		return 0
 	}
@@ -157,10 +319,14 @@ func (instance *V2RayInstance) QueryStats(tag string, direct string) int64 {
 }
 
 func (instance *V2RayInstance) Close() error {
+	instance.access.Lock()
+	defer instance.access.Unlock()
 	if instance.started {
-		err := instance.core.Close()
+		err := instance.current.core.Close()
 		if err == nil {
-			*instance = V2RayInstance{}
+			instance.started = false
+			instance.current = nil
+			instance.errorHandler = nil
 		}
 		return err
 	}
@@ -185,11 +351,16 @@ func getLink(ctx context.Context) (*transport.Link, *transport.Link) {
 }
 
 func (instance *V2RayInstance) dialContext(ctx context.Context, destination net.Destination) (net.Conn, error) {
-	if !instance.started {
+	v2ray := instance.load()
+	if v2ray == nil {
 		return nil, os.ErrInvalid
 	}
-	ctx = core.WithContext(ctx, instance.core)
-	r, err := instance.dispatcher.Dispatch(ctx, destination)
+	return v2ray.dialContext(ctx, destination)
+}
+
+func (v2ray *v2rayCore) dialContext(ctx context.Context, destination net.Destination) (net.Conn, error) {
+	ctx = core.WithContext(ctx, v2ray.core)
+	r, err := v2ray.dispatcher.Dispatch(ctx, destination)
 	if err != nil {
 		return nil, err
 	}
@@ -203,22 +374,21 @@ func (instance *V2RayInstance) dialContext(ctx context.Context, destination net.
 }
 
 func (instance *V2RayInstance) dispatchContext(ctx context.Context, destination net.Destination, conn net.Conn) error {
-	if !instance.started {
+	v2ray := instance.acquire()
+	if v2ray == nil {
 		return os.ErrInvalid
 	}
-	ctx = core.WithContext(ctx, instance.core)
-	return instance.dispatcher.DispatchLink(ctx, destination, &transport.Link{
+	defer v2ray.release()
+	ctx = core.WithContext(ctx, v2ray.core)
+	return v2ray.dispatcher.DispatchLink(ctx, destination, &transport.Link{
 		Reader: buf.NewReader(conn),
 		Writer: buf.NewWriter(conn),
 	})
 }
 
-func (instance *V2RayInstance) dialUDP(ctx context.Context, destination net.Destination, timeout time.Duration) (packetConn, error) {
-	if !instance.started {
-		return nil, os.ErrInvalid
-	}
+func (v2ray *v2rayCore) dialUDP(ctx context.Context, destination net.Destination, timeout time.Duration) (packetConn, error) {
 	ctx, cancel := context.WithCancel(ctx)
-	link, err := instance.dispatcher.Dispatch(ctx, destination)
+	link, err := v2ray.dispatcher.Dispatch(ctx, destination)
 	if err != nil {
 		cancel()
 		return nil, err
@@ -237,7 +407,7 @@ func (instance *V2RayInstance) dialUDP(ctx context.Context, destination net.Dest
 	return c, nil
 }
 
-func (instance *V2RayInstance) handleUDP(ctx context.Context, handler outbound.Handler, destination net.Destination, timeout time.Duration) packetConn {
+func handleUDP(ctx context.Context, handler outbound.Handler, destination net.Destination, timeout time.Duration) packetConn {
 	ctx, cancel := context.WithCancel(ctx)
 	inboundLink, outboundLink := getLink(ctx)
 	go handler.Dispatch(ctx, outboundLink)
@@ -346,7 +516,7 @@ func (c *dispatcherConn) readFrom() (buffer *buf.Buffer, addr net.Addr, err erro
 func (c *dispatcherConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	buffer := buf.New()
 	buffer.Write(p)
-	endpoint := net.DestinationFromAddr(addr)
+	endpoint := destinationFromAddr(addr)
 	buffer.Endpoint = &endpoint
 	err = c.link.Writer.WriteMultiBuffer(buf.MultiBuffer{buffer})
 	if err != nil {
@@ -361,7 +531,7 @@ func (c *dispatcherConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 }
 
 func (c *dispatcherConn) writeTo(buffer *buf.Buffer, addr net.Addr) (err error) {
-	endpoint := net.DestinationFromAddr(addr)
+	endpoint := destinationFromAddr(addr)
 	buffer.Endpoint = &endpoint
 	err = c.link.Writer.WriteMultiBuffer(buf.MultiBuffer{buffer})
 	if err != nil {